@@ -145,8 +145,8 @@ func lesson9() {
 	min := "Roman"
 	max := "Stepan"
 	results, err := users.Query("name", documentstore.QueryParams{
-		MinValue: &min,
-		MaxValue: &max,
+		MinValue: min,
+		MaxValue: max,
 		Desc:     false,
 	})
 	if err != nil {
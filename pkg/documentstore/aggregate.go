@@ -0,0 +1,366 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"lesson4/pkg/err"
+	"sort"
+	"strings"
+)
+
+// Stage - етап конвеєра агрегації: отримує документи попереднього етапу і повертає нові
+type Stage interface {
+	run(docs []Document, coll *Collection) ([]Document, error)
+}
+
+// MatchStage залишає документи, що відповідають фільтру
+type MatchStage struct {
+	Filter Filter
+}
+
+// GroupStage групує документи за значеннями полів By. Ключ групи записується в поле "_id":
+// значення поля, якщо поле одне, або об'єкт {шлях: значення}, якщо їх кілька; без By - одна група.
+// Групи йдуть у порядку першої появи.
+type GroupStage struct {
+	By     []string
+	Fields map[string]Accumulator // ім'я поля результату -> акумулятор
+}
+
+type AccumulatorOp string
+
+const (
+	AccumulatorCount AccumulatorOp = "count" // кількість документів групи
+	AccumulatorSum   AccumulatorOp = "sum"   // сума чисел, інші значення пропускаються
+	AccumulatorAvg   AccumulatorOp = "avg"   // середнє чисел
+	AccumulatorMin   AccumulatorOp = "min"
+	AccumulatorMax   AccumulatorOp = "max"
+	AccumulatorPush  AccumulatorOp = "push" // масив значень поля в порядку документів
+)
+
+type Accumulator struct {
+	Op    AccumulatorOp
+	Field string // шлях до поля; не потрібен для count
+}
+
+// SortStage сортує документи; документи з однаковими значеннями зберігають попередній порядок
+type SortStage struct {
+	Fields []SortField
+}
+
+type SkipStage struct {
+	N int
+}
+
+type LimitStage struct {
+	N int
+}
+
+// ProjectStage обрізає документи, як Projection у запитах
+type ProjectStage struct {
+	Projection Projection
+}
+
+// UnwindStage розгортає масив у полі Field: для кожного елемента - окремий документ,
+// де замість масиву стоїть цей елемент. Документи без поля або з порожнім масивом
+// відкидаються, якщо не задано PreserveEmpty. Значення, що не є масивом, залишаються як є.
+type UnwindStage struct {
+	Field         string
+	PreserveEmpty bool
+}
+
+// Aggregate проганяє документи колекції через етапи конвеєра по черзі.
+// Вхідні документи йдуть у порядку первинного ключа; якщо перший етап - MatchStage,
+// документи для нього відбирає планувальник, як у Find.
+func (s *Collection) Aggregate(stages ...Stage) ([]Document, error) {
+	var docs []Document
+	if match, ok := firstMatch(stages); ok {
+		found, er := s.Find(match.Filter)
+		if er != nil {
+			return nil, er
+		}
+		docs, stages = found, stages[1:]
+	} else {
+		docs = s.List()
+	}
+
+	for i, stage := range stages {
+		var er error
+		if docs, er = stage.run(docs, s); er != nil {
+			return nil, fmt.Errorf("stage %d: %w", i, er)
+		}
+	}
+	return docs, nil
+}
+
+func firstMatch(stages []Stage) (MatchStage, bool) {
+	if len(stages) == 0 {
+		return MatchStage{}, false
+	}
+	switch stage := stages[0].(type) {
+	case MatchStage:
+		return stage, true
+	case *MatchStage:
+		return *stage, stage != nil
+	}
+	return MatchStage{}, false
+}
+
+func (m MatchStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	match, er := compileFilter(m.Filter)
+	if er != nil {
+		return nil, er
+	}
+	var out []Document
+	for _, doc := range docs {
+		if match(doc) {
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+type group struct {
+	id     any
+	values map[string][]any // значення полів акумуляторів у порядку документів
+	count  int64
+}
+
+func (g GroupStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	for name, acc := range g.Fields {
+		// _id - ключ групи, акумулятор не може його замінити
+		if name == "_id" || strings.HasPrefix(name, "_id.") {
+			return nil, fmt.Errorf("%w: accumulator field %s overwrites the group key", err.ErrInvalidPipeline, name)
+		}
+		switch acc.Op {
+		case AccumulatorCount:
+		case AccumulatorSum, AccumulatorAvg, AccumulatorMin, AccumulatorMax, AccumulatorPush:
+			if acc.Field == "" {
+				return nil, fmt.Errorf("%w: accumulator %s of field %s has no source field", err.ErrInvalidPipeline, acc.Op, name)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown accumulator %q", err.ErrInvalidPipeline, acc.Op)
+		}
+	}
+
+	var groups []*group
+	byKey := map[string]*group{}
+	for _, doc := range docs {
+		id := g.groupID(doc)
+		data, er := json.Marshal(id)
+		if er != nil {
+			return nil, fmt.Errorf("%w: group key: %v", err.ErrInvalidPipeline, er)
+		}
+		gr, ok := byKey[string(data)]
+		if !ok {
+			gr = &group{id: id, values: map[string][]any{}}
+			byKey[string(data)] = gr
+			groups = append(groups, gr)
+		}
+		gr.count++
+		for name, acc := range g.Fields {
+			if acc.Op == AccumulatorCount {
+				continue
+			}
+			if v, ok := lookupPath(doc, acc.Field); ok && v != nil {
+				gr.values[name] = append(gr.values[name], v)
+			}
+		}
+	}
+
+	out := make([]Document, 0, len(groups))
+	for _, gr := range groups {
+		doc := Document{Fields: map[string]DocumentField{}}
+		setField(doc, "_id", gr.id)
+		for name, acc := range g.Fields {
+			setField(doc, name, accumulate(acc.Op, gr.count, gr.values[name]))
+		}
+		out = append(out, doc)
+	}
+	return out, nil
+}
+
+func (g GroupStage) groupID(doc Document) any {
+	switch len(g.By) {
+	case 0:
+		return nil
+	case 1:
+		v, _ := lookupPath(doc, g.By[0])
+		return normalizeValue(v)
+	}
+	id := make(map[string]any, len(g.By))
+	for _, path := range g.By {
+		v, _ := lookupPath(doc, path)
+		id[path] = normalizeValue(v)
+	}
+	return id
+}
+
+func accumulate(op AccumulatorOp, count int64, values []any) any {
+	switch op {
+	case AccumulatorCount:
+		return count
+	case AccumulatorPush:
+		return append([]any{}, values...)
+	case AccumulatorMin, AccumulatorMax:
+		var best any
+		for _, v := range values {
+			v = normalizeValue(v)
+			if best == nil {
+				best = v
+				continue
+			}
+			c := compareValues(v, best)
+			if (op == AccumulatorMin && c < 0) || (op == AccumulatorMax && c > 0) {
+				best = v
+			}
+		}
+		return best
+	}
+
+	// sum та avg: цілі числа додаються як int64, доки не трапиться дробове
+	var isum int64
+	var fsum float64
+	var n int64
+	isFloat := false
+	for _, v := range values {
+		switch num := normalizeValue(v).(type) {
+		case int64:
+			isum += num
+		case float64:
+			fsum += num
+			isFloat = true
+		default:
+			continue
+		}
+		n++
+	}
+	if op == AccumulatorAvg {
+		if n == 0 {
+			return nil
+		}
+		return (float64(isum) + fsum) / float64(n)
+	}
+	if isFloat {
+		return float64(isum) + fsum
+	}
+	return isum
+}
+
+func (st SortStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	values := make([][]any, len(docs))
+	order := make([]int, len(docs))
+	for i, doc := range docs {
+		values[i] = documentSortValues(doc, st.Fields)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareSortValues(values[order[i]], values[order[j]], st.Fields) < 0
+	})
+	out := make([]Document, len(docs))
+	for i, idx := range order {
+		out[i] = docs[idx]
+	}
+	return out, nil
+}
+
+func (st SkipStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	if st.N < 0 {
+		return nil, fmt.Errorf("%w: negative skip %d", err.ErrInvalidPipeline, st.N)
+	}
+	return docs[min(st.N, len(docs)):], nil
+}
+
+func (st LimitStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	if st.N <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive, got %d", err.ErrInvalidPipeline, st.N)
+	}
+	return docs[:min(st.N, len(docs))], nil
+}
+
+func (st ProjectStage) run(docs []Document, coll *Collection) ([]Document, error) {
+	proj, er := compileProjection(st.Projection)
+	if er != nil {
+		return nil, er
+	}
+	out := make([]Document, len(docs))
+	for i, doc := range docs {
+		out[i] = proj.apply(doc, coll.config.PrimaryKey)
+	}
+	return out, nil
+}
+
+func (st UnwindStage) run(docs []Document, _ *Collection) ([]Document, error) {
+	if st.Field == "" {
+		return nil, fmt.Errorf("%w: unwind without field", err.ErrInvalidPipeline)
+	}
+	var out []Document
+	for _, doc := range docs {
+		v, ok := lookupPath(doc, st.Field)
+		list, isList := sliceValues(v)
+		switch {
+		case ok && v != nil && !isList:
+			out = append(out, doc)
+		case len(list) == 0:
+			if st.PreserveEmpty {
+				out = append(out, doc)
+			}
+		default:
+			for _, elem := range list {
+				out = append(out, withPath(doc, st.Field, elem))
+			}
+		}
+	}
+	return out, nil
+}
+
+// withPath повертає копію документа, де за шляхом path записано value;
+// об'єкти на шляху копіюються як map[string]any, щоб не змінювати оригінал
+func withPath(doc Document, path string, value any) Document {
+	doc = doc.clone()
+	segments := strings.Split(path, ".")
+	if len(segments) == 1 {
+		setField(doc, path, value)
+		return doc
+	}
+	field := doc.Fields[segments[0]]
+	field.Value = withValue(field.Value, segments[1:], value)
+	doc.Fields[segments[0]] = field
+	return doc
+}
+
+func withValue(v any, segments []string, value any) any {
+	if len(segments) == 0 {
+		return value
+	}
+	fields, _ := objectFields(v)
+	out := make(map[string]any, len(fields)+1)
+	for name, c := range fields {
+		out[name] = c
+	}
+	out[segments[0]] = withValue(fields[segments[0]], segments[1:], value)
+	return out
+}
+
+// setField записує значення з типом, визначеним за значенням; nil означає відсутнє поле
+func setField(doc Document, name string, v any) {
+	if v == nil {
+		delete(doc.Fields, name)
+		return
+	}
+	doc.Fields[name] = DocumentField{Type: fieldTypeOf(v), Value: v}
+}
+
+func fieldTypeOf(v any) DocumentFieldType {
+	switch normalizeValue(v).(type) {
+	case string:
+		return DocumentFieldTypeString
+	case bool:
+		return DocumentFieldTypeBool
+	case int64, float64:
+		return DocumentFieldTypeNumber
+	}
+	if _, ok := sliceValues(v); ok {
+		return DocumentFieldTypeArray
+	}
+	return DocumentFieldTypeObject
+}
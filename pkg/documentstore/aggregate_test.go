@@ -0,0 +1,186 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+)
+
+var aggregateTestDocuments = func() []map[string]DocumentField {
+	orders := []struct {
+		id     string
+		status string
+		city   string
+		total  any
+		tags   []any
+	}{
+		{"o1", "paid", "Kyiv", int64(100), []any{"gift", "promo"}},
+		{"o2", "new", "Lviv", int64(40), []any{}},
+		{"o3", "paid", "Lviv", 25.5, []any{"promo"}},
+		{"o4", "paid", "Kyiv", int64(10), nil},
+		{"o5", "new", "Kyiv", "n/a", []any{"gift"}},
+	}
+	docs := make([]map[string]DocumentField, 0, len(orders))
+	for _, o := range orders {
+		fields := map[string]DocumentField{
+			"id":      {Type: DocumentFieldTypeString, Value: o.id},
+			"status":  {Type: DocumentFieldTypeString, Value: o.status},
+			"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": o.city}},
+			"total":   {Type: fieldTypeOf(o.total), Value: o.total},
+		}
+		if o.tags != nil {
+			fields["tags"] = DocumentField{Type: DocumentFieldTypeArray, Value: o.tags}
+		}
+		docs = append(docs, fields)
+	}
+	return docs
+}()
+
+func aggregateTestValues(docs []Document) []map[string]any {
+	out := make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		out = append(out, documentFields(doc.Fields))
+	}
+	return out
+}
+
+func TestCollection_Aggregate(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  []Stage
+		want    []map[string]any
+		wantErr error
+	}{
+		{
+			name: "group with accumulators",
+			stages: []Stage{
+				GroupStage{By: []string{"status"}, Fields: map[string]Accumulator{
+					"n":     {Op: AccumulatorCount},
+					"sum":   {Op: AccumulatorSum, Field: "total"},
+					"avg":   {Op: AccumulatorAvg, Field: "total"},
+					"min":   {Op: AccumulatorMin, Field: "total"},
+					"max":   {Op: AccumulatorMax, Field: "total"},
+					"ids":   {Op: AccumulatorPush, Field: "id"},
+					"never": {Op: AccumulatorAvg, Field: "missing"},
+				}},
+			},
+			want: []map[string]any{
+				{"_id": "paid", "n": int64(3), "sum": 135.5, "avg": 135.5 / 3, "min": int64(10), "max": int64(100), "ids": []any{"o1", "o3", "o4"}},
+				{"_id": "new", "n": int64(2), "sum": int64(40), "avg": 40.0, "min": int64(40), "max": "n/a", "ids": []any{"o2", "o5"}},
+			},
+		},
+		{
+			name: "match, group by nested fields, sort",
+			stages: []Stage{
+				MatchStage{Filter: Filter{"total": Filter{"$gte": 10}}},
+				GroupStage{By: []string{"status", "address.city"}, Fields: map[string]Accumulator{"n": {Op: AccumulatorCount}}},
+				SortStage{Fields: []SortField{{Field: "n", Desc: true}, {Field: "_id.status"}}},
+			},
+			want: []map[string]any{
+				{"_id": map[string]any{"status": "paid", "address.city": "Kyiv"}, "n": int64(2)},
+				{"_id": map[string]any{"status": "new", "address.city": "Lviv"}, "n": int64(1)},
+				{"_id": map[string]any{"status": "paid", "address.city": "Lviv"}, "n": int64(1)},
+			},
+		},
+		{
+			name: "group without keys",
+			stages: []Stage{
+				GroupStage{Fields: map[string]Accumulator{"n": {Op: AccumulatorCount}}},
+			},
+			want: []map[string]any{{"n": int64(5)}},
+		},
+		{
+			name: "unwind and count tags",
+			stages: []Stage{
+				UnwindStage{Field: "tags"},
+				GroupStage{By: []string{"tags"}, Fields: map[string]Accumulator{"orders": {Op: AccumulatorPush, Field: "id"}}},
+				SortStage{Fields: []SortField{{Field: "_id"}}},
+			},
+			want: []map[string]any{
+				{"_id": "gift", "orders": []any{"o1", "o5"}},
+				{"_id": "promo", "orders": []any{"o1", "o3"}},
+			},
+		},
+		{
+			name: "unwind preserving empty, skip, limit, project",
+			stages: []Stage{
+				UnwindStage{Field: "tags", PreserveEmpty: true},
+				SkipStage{N: 1},
+				LimitStage{N: 4},
+				ProjectStage{Projection: Projection{Include: []string{"tags"}}},
+			},
+			want: []map[string]any{
+				{"id": "o1", "tags": "promo"},
+				{"id": "o2", "tags": []any{}},
+				{"id": "o3", "tags": "promo"},
+				{"id": "o4"},
+			},
+		},
+		{
+			name: "unwind keeps value that is not an array",
+			stages: []Stage{
+				MatchStage{Filter: Filter{"id": "o1"}},
+				ProjectStage{Projection: Projection{Include: []string{"address"}}},
+				UnwindStage{Field: "address.city"},
+			},
+			want: []map[string]any{{"id": "o1", "address": map[string]any{"city": "Kyiv"}}},
+		},
+		{
+			name:    "unknown accumulator",
+			stages:  []Stage{GroupStage{Fields: map[string]Accumulator{"x": {Op: "median", Field: "total"}}}},
+			wantErr: err.ErrInvalidPipeline,
+		},
+		{
+			name:    "accumulator without field",
+			stages:  []Stage{GroupStage{Fields: map[string]Accumulator{"x": {Op: AccumulatorSum}}}},
+			wantErr: err.ErrInvalidPipeline,
+		},
+		{
+			name:    "accumulator overwrites group key",
+			stages:  []Stage{GroupStage{By: []string{"status"}, Fields: map[string]Accumulator{"_id": {Op: AccumulatorCount}}}},
+			wantErr: err.ErrInvalidPipeline,
+		},
+		{
+			name:    "accumulator inside group key",
+			stages:  []Stage{GroupStage{By: []string{"status", "address.city"}, Fields: map[string]Accumulator{"_id.status": {Op: AccumulatorSum, Field: "total"}}}},
+			wantErr: err.ErrInvalidPipeline,
+		},
+		{
+			name:    "invalid filter in later stage",
+			stages:  []Stage{LimitStage{N: 1}, MatchStage{Filter: Filter{"$xor": nil}}},
+			wantErr: err.ErrInvalidFilter,
+		},
+		{
+			name:    "zero limit",
+			stages:  []Stage{LimitStage{}},
+			wantErr: err.ErrInvalidPipeline,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, aggregateTestDocuments)
+			got, er := s.Aggregate(tt.stages...)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("Aggregate() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if values := aggregateTestValues(got); !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("Aggregate() = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollection_AggregateDoesNotChangeDocuments(t *testing.T) {
+	s := testCollection(t, aggregateTestDocuments)
+	if _, er := s.Aggregate(UnwindStage{Field: "tags"}, UnwindStage{Field: "address.city"}); er != nil {
+		t.Fatal(er)
+	}
+	doc, _ := s.Get("o1")
+	if !reflect.DeepEqual(doc.Fields["tags"].Value, []any{"gift", "promo"}) {
+		t.Errorf("tags = %v after unwind", doc.Fields["tags"].Value)
+	}
+}
@@ -0,0 +1,272 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"lesson4/pkg/err"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// CappedOptions обмежує розмір колекції. Коли запис перевищує обмеження, витісняються найстаріші
+// за часом вставки документи; заміна документа не змінює його місця в черзі.
+type CappedOptions struct {
+	MaxDocuments int   `json:"max_documents,omitempty"` // 0 - кількість не обмежена
+	MaxBytes     int64 `json:"max_bytes,omitempty"`     // сумарний розмір полів документів у JSON; 0 - не обмежений
+}
+
+// cappedState - черга вставки capped колекції
+type cappedState struct {
+	entries map[string]cappedEntry
+	order   []orderEntry // за зростанням seq; записи видалених ключів лишаються до ущільнення
+	head    int          // усі записи order до head належать видаленим ключам
+	nextSeq uint64
+	bytes   int64 // сумарний розмір документів
+}
+
+type cappedEntry struct {
+	seq  uint64 // номер вставки
+	size int64
+}
+
+type orderEntry struct {
+	seq uint64
+	key string
+}
+
+func newCappedState() *cappedState {
+	return &cappedState{entries: map[string]cappedEntry{}, nextSeq: 1}
+}
+
+// documentSize повертає розмір полів документа в JSON, як їх запише дамп
+func documentSize(doc Document) (int64, error) {
+	data, er := json.Marshal(doc.Fields)
+	if er != nil {
+		return 0, er
+	}
+	return int64(len(data)), nil
+}
+
+// add ставить новий ключ у кінець черги, а для наявного лише оновлює розмір
+func (c *cappedState) add(key string, size int64) {
+	entry, exists := c.entries[key]
+	if !exists {
+		entry.seq = c.nextSeq
+		c.nextSeq++
+		c.order = append(c.order, orderEntry{seq: entry.seq, key: key})
+	}
+	c.bytes += size - entry.size
+	entry.size = size
+	c.entries[key] = entry
+}
+
+func (c *cappedState) remove(key string) {
+	entry, exists := c.entries[key]
+	if !exists {
+		return
+	}
+	delete(c.entries, key)
+	c.bytes -= entry.size
+	// Витісняються найстаріші, тож початок черги пропускаємо одразу, а решту видалених
+	// записів прибираємо, коли їх стає більше, ніж живих
+	for c.head < len(c.order) && !c.live(c.order[c.head]) {
+		c.head++
+	}
+	if len(c.order) > 2*len(c.entries)+64 {
+		live := c.order[:0]
+		for _, e := range c.order[c.head:] {
+			if c.live(e) {
+				live = append(live, e)
+			}
+		}
+		clear(c.order[len(live):])
+		c.order = live
+		c.head = 0
+	}
+}
+
+// reposition повертає ключу попередній номер вставки, зокрема коли відкат транзакції відновлює витіснений документ
+func (c *cappedState) reposition(key string, seq uint64) {
+	entry, exists := c.entries[key]
+	if !exists || seq == 0 || entry.seq == seq {
+		return
+	}
+	entry.seq = seq
+	c.entries[key] = entry
+	i := sort.Search(len(c.order), func(i int) bool { return c.order[i].seq >= seq })
+	c.head = min(c.head, i)
+	if i < len(c.order) && c.order[i].seq == seq {
+		// Запис черги ще не ущільнено, він знову стає живим
+		return
+	}
+	c.order = append(c.order, orderEntry{})
+	copy(c.order[i+1:], c.order[i:])
+	c.order[i] = orderEntry{seq: seq, key: key}
+}
+
+func (c *cappedState) seqOf(key string) uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.entries[key].seq
+}
+
+func (c *cappedState) live(e orderEntry) bool {
+	entry, exists := c.entries[e.key]
+	return exists && entry.seq == e.seq
+}
+
+// track оновлює чергу вставки та час застарівання після запису документа
+func (s *Collection) track(key string, doc Document) {
+	s.trackExpiry(key, doc.ExpiresAt)
+	if s.config.Capped == nil {
+		return
+	}
+	if s.capped == nil {
+		s.capped = newCappedState()
+	}
+	size, _ := documentSize(doc) // запис уже перевірив, що документ серіалізується
+	s.capped.add(key, size)
+}
+
+// evictions повертає найстаріші документи, які треба витіснити, щоб після запису doc під ключем key
+// колекція не перевищувала обмежень. Сам key не витісняється.
+func (s *Collection) evictions(key string, doc Document) ([]string, error) {
+	limits := s.config.Capped
+	if limits == nil {
+		return nil, nil
+	}
+	size, er := documentSize(doc)
+	if er != nil {
+		return nil, er
+	}
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, capped collection allows %d", err.ErrDocumentTooLarge, size, limits.MaxBytes)
+	}
+	if s.capped == nil {
+		return nil, nil
+	}
+	count, bytes := len(s.capped.entries), s.capped.bytes+size
+	if entry, exists := s.capped.entries[key]; exists {
+		bytes -= entry.size
+	} else {
+		count++
+	}
+	var evicted []string
+	for _, e := range s.capped.order[s.capped.head:] {
+		over := limits.MaxDocuments > 0 && count > limits.MaxDocuments || limits.MaxBytes > 0 && bytes > limits.MaxBytes
+		if !over {
+			break
+		}
+		if !s.capped.live(e) || e.key == key {
+			continue
+		}
+		evicted = append(evicted, e.key)
+		count--
+		bytes -= s.capped.entries[e.key].size
+	}
+	return evicted, nil
+}
+
+// withEvictions додає до запису документа видалення витіснених; у журнал вони потрапляють одним записом
+func (s *Collection) withEvictions(rec walRecord, evicted []string) walRecord {
+	if len(evicted) == 0 {
+		return rec
+	}
+	rec.Collection = s.name
+	batch := []walRecord{rec}
+	for _, key := range evicted {
+		batch = append(batch, walRecord{Op: walOpDelete, Collection: s.name, Key: key})
+	}
+	return walRecord{Op: walOpTx, Batch: batch}
+}
+
+func (s *Collection) evict(evicted []string) error {
+	for _, key := range evicted {
+		if _, er := s.delete(key); er != nil {
+			return er
+		}
+	}
+	if len(evicted) > 0 {
+		slog.Info("documents evicted from capped collection", slog.String("collection", s.name), slog.Int("count", len(evicted)))
+	}
+	return nil
+}
+
+// ListInsertionOrder повертає документи capped колекції в порядку вставки, а якщо reverse - від найновіших.
+// limit обмежує кількість документів, 0 - без обмеження. Для звичайної колекції повертає err.ErrNotCapped.
+func (s *Collection) ListInsertionOrder(reverse bool, limit int) ([]Document, error) {
+	if s.config.Capped == nil {
+		return nil, err.ErrNotCapped
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	docs := []Document{}
+	if s.capped == nil {
+		return docs, nil
+	}
+	now := time.Now()
+	order := s.capped.order[s.capped.head:]
+	n := len(order)
+	for i := 0; i < n && (limit <= 0 || len(docs) < limit); i++ {
+		e := order[i]
+		if reverse {
+			e = order[n-1-i]
+		}
+		if !s.capped.live(e) {
+			continue
+		}
+		doc, exists, er := s.current(e.key, now)
+		if er != nil {
+			return nil, er
+		}
+		if exists {
+			docs = append(docs, doc.clone())
+		}
+	}
+	return docs, nil
+}
+
+// syncCapped узгоджує чергу вставки з документами рушія, яких колекція не читала з дампу чи журналу:
+// оновлює розміри, ключі без документів прибирає, а ключі, яких у черзі немає, ставить у кінець у порядку ключів.
+// Capped колекція обмежена, тож повний обхід рушія тут недорогий.
+func (s *Collection) syncCapped() error {
+	if s.config.Capped == nil {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	er := s.storage().Scan("", func(key string, doc Document) bool {
+		seen[key] = struct{}{}
+		s.track(key, doc)
+		return true
+	})
+	if er != nil || s.capped == nil {
+		return er
+	}
+	for key := range s.capped.entries {
+		if _, ok := seen[key]; !ok {
+			s.capped.remove(key)
+		}
+	}
+	return nil
+}
+
+// insertionOrder повертає ключі в порядку вставки для дампу; nil для звичайної колекції
+func (s *Collection) insertionOrder() []string {
+	if s.config.Capped == nil {
+		return nil
+	}
+	keys := []string{}
+	if s.capped == nil {
+		return keys
+	}
+	for _, e := range s.capped.order[s.capped.head:] {
+		if s.capped.live(e) {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,211 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+)
+
+func cappedTestStore(t *testing.T, opts CappedOptions) (*Store, *Collection) {
+	t.Helper()
+	s := NewStore()
+	er, events := s.CreateCollectionWithConfig("events", CollectionConfig{PrimaryKey: "id", Capped: &opts})
+	if er != nil {
+		t.Fatal(er)
+	}
+	return s, events
+}
+
+func cappedTestOrder(t *testing.T, coll *Collection, reverse bool, limit int) []string {
+	t.Helper()
+	docs, er := coll.ListInsertionOrder(reverse, limit)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return indexTestIDs(docs)
+}
+
+func TestCollection_CappedMaxDocuments(t *testing.T) {
+	_, events := cappedTestStore(t, CappedOptions{MaxDocuments: 3})
+	for _, id := range []string{"e5", "e1", "e4", "e2", "e3"} {
+		if er := events.Put(walTestDocument(id, "event")); er != nil {
+			t.Fatal(er)
+		}
+	}
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e4", "e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder() = %v, want %v", got, want)
+	}
+	if got, want := cappedTestOrder(t, events, true, 2), []string{"e3", "e2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder(reverse, 2) = %v, want %v", got, want)
+	}
+
+	// Заміна не змінює місця документа і нічого не витісняє
+	events.Put(walTestDocument("e4", "changed"))
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e4", "e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder() after replace = %v, want %v", got, want)
+	}
+	events.Delete("e2")
+	events.Put(walTestDocument("e6", "event"))
+	events.Put(walTestDocument("e7", "event"))
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e3", "e6", "e7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder() after delete = %v, want %v", got, want)
+	}
+	if _, er := events.Get("e4"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Get() of evicted document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+}
+
+func TestCollection_CappedManyEvictions(t *testing.T) {
+	_, events := cappedTestStore(t, CappedOptions{MaxDocuments: 5})
+	for i := 0; i < 1000; i++ {
+		events.Put(walTestDocument(fmt.Sprintf("e%04d", i), "event"))
+		if i%7 == 0 {
+			events.Delete(fmt.Sprintf("e%04d", i-1))
+		}
+	}
+	if got, want := cappedTestOrder(t, events, true, 3), []string{"e0999", "e0998", "e0997"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder(reverse, 3) = %v, want %v", got, want)
+	}
+	if got := events.engine.Len(); got != 5 {
+		t.Errorf("collection has %d documents, want 5", got)
+	}
+	if got := len(events.capped.order) - events.capped.head; got > 2*5+64 {
+		t.Errorf("insertion queue keeps %d entries for 5 documents", got)
+	}
+}
+
+func TestCollection_CappedMaxBytes(t *testing.T) {
+	size, _ := documentSize(walTestDocument("e1", "event"))
+	_, events := cappedTestStore(t, CappedOptions{MaxBytes: 2*size + 1})
+	events.CreateIndex("name")
+	events.Put(walTestDocument("e1", "event"))
+	events.Put(walTestDocument("e2", "event"))
+	events.Put(walTestDocument("e3", "event"))
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder() = %v, want %v", got, want)
+	}
+	docs, _ := events.Query("name", QueryParams{})
+	if got, want := indexTestIDs(docs), []string{"e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+
+	// Більший документ витісняє стільки старих, скільки потрібно
+	events.Put(walTestDocument("e4", "a much longer event"))
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInsertionOrder() after big document = %v, want %v", got, want)
+	}
+
+	big := walTestDocument("e5", string(make([]byte, 3*size)))
+	if er := events.Put(big); !errors.Is(er, err.ErrDocumentTooLarge) {
+		t.Errorf("Put() of too large document error = %v, want %v", er, err.ErrDocumentTooLarge)
+	}
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rejected document changed collection: %v", got)
+	}
+}
+
+func TestCollection_CappedConfig(t *testing.T) {
+	s := NewStore()
+	_, plain := s.CreateCollection("plain", "id")
+	if _, er := plain.ListInsertionOrder(false, 0); !errors.Is(er, err.ErrNotCapped) {
+		t.Errorf("ListInsertionOrder() of plain collection error = %v, want %v", er, err.ErrNotCapped)
+	}
+	for _, opts := range []CappedOptions{{}, {MaxDocuments: -1}, {MaxBytes: -1}} {
+		if er, _ := s.CreateCollectionWithConfig("bad", CollectionConfig{PrimaryKey: "id", Capped: &opts}); !errors.Is(er, err.ErrInvalidCollectionConfig) {
+			t.Errorf("CreateCollectionWithConfig(%+v) error = %v, want %v", opts, er, err.ErrInvalidCollectionConfig)
+		}
+	}
+}
+
+func TestCollection_CappedDumpRestore(t *testing.T) {
+	s, events := cappedTestStore(t, CappedOptions{MaxDocuments: 3})
+	for _, id := range []string{"c", "a", "d", "b"} {
+		events.Put(walTestDocument(id, "event"))
+	}
+	// Знімок, відкритий до витіснення, зберігає старий порядок
+	snap := s.Snapshot()
+	events.Put(walTestDocument("e", "event"))
+	old, _ := snap.toDto()
+	snap.Release()
+	if got, want := old.Collections["events"].Order, []string{"a", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot order = %v, want %v", got, want)
+	}
+
+	dump, er := s.Dump()
+	if er != nil {
+		t.Fatal(er)
+	}
+	restored, er := NewStoreFromDump(dump)
+	if er != nil {
+		t.Fatal(er)
+	}
+	coll, _ := restored.GetCollection("events")
+	if got, want := cappedTestOrder(t, coll, false, 0), []string{"d", "b", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored order = %v, want %v", got, want)
+	}
+	coll.Put(walTestDocument("f", "event"))
+	if got, want := cappedTestOrder(t, coll, false, 0), []string{"b", "e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order after put into restored collection = %v, want %v", got, want)
+	}
+}
+
+func TestCollection_CappedRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	s.CreateCollectionWithConfig("events", CollectionConfig{PrimaryKey: "id", Capped: &CappedOptions{MaxDocuments: 2}})
+	events, _ := s.GetCollection("events")
+	events.Put(walTestDocument("b", "event"))
+	events.Put(walTestDocument("a", "event"))
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	events.Put(walTestDocument("c", "event"))
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	coll, _ := restored.GetCollection("events")
+	if got, want := cappedTestOrder(t, coll, false, 0), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered order = %v, want %v", got, want)
+	}
+}
+
+func TestTx_CappedUndo(t *testing.T) {
+	s, events := cappedTestStore(t, CappedOptions{MaxDocuments: 2})
+	events.Put(walTestDocument("e1", "event"))
+	events.Put(walTestDocument("e2", "event"))
+	_, users := s.CreateCollection("users", "id")
+	users.CreateIndexWithOptions("name", IndexOptions{Unique: true})
+	users.Put(walTestDocument("u1", "Andrii"))
+
+	// events застосовується раніше за users, тож відкат повертає витіснений e1 на його місце
+	er := s.RunInTx(func(tx *Tx) error {
+		if er := tx.Insert("events", walTestDocument("e3", "event")); er != nil {
+			return er
+		}
+		return tx.Insert("users", walTestDocument("u2", "Andrii"))
+	})
+	if !errors.Is(er, err.ErrDuplicateKey) {
+		t.Fatalf("RunInTx() error = %v, want %v", er, err.ErrDuplicateKey)
+	}
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e1", "e2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order after failed commit = %v, want %v", got, want)
+	}
+
+	if er := s.RunInTx(func(tx *Tx) error {
+		return tx.Insert("events", walTestDocument("e3", "event"))
+	}); er != nil {
+		t.Fatal(er)
+	}
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order after commit = %v, want %v", got, want)
+	}
+}
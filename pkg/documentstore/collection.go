@@ -2,100 +2,379 @@ package documentstore
 
 import (
 	"errors"
+	"fmt"
 	"lesson4/pkg/err"
 	"log/slog"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Collection struct {
-	documents map[string]Document
-	config    CollectionConfig
-	indexes   map[string]*Index
+	mu       sync.RWMutex  // захищає engine, indexes, capped та expiry
+	engine   StorageEngine // nil у колекції, створеної літералом, доки в неї нічого не записали
+	config   CollectionConfig
+	indexes  map[string]*Index
+	pending  []IndexDefinition // індекси, які NewStoreWithWAL збудує після журналу
+	name     string
+	wal      *wal   // журнал стору, якому належить колекція
+	store    *Store // стор, якому належить колекція; потрібен для LookupStage
+	revision uint64 // остання видана ревізія документа
+
+	capped *cappedState // черга вставки; nil, доки в capped колекцію нічого не записали
+	// expiry - коли застаріють документи, що мають ExpiresAt; DeleteExpired перевіряє лише їх,
+	// тож sweeper не читає рушій колекції цілком
+	expiry map[string]time.Time
+}
+
+// noDocuments - рушій колекції без engine; у нього ніхто не пише
+var noDocuments = NewMemoryEngine()
+
+// newCollection відкриває рушій з конфігурації. Документи, які вже є в рушії (файловий рушій
+// після перезапуску), стають документами колекції; індекси для них будує CreateIndex.
+// Ревізію та порядок вставки без снапшоту та журналу взяти ніде, тож рушій обходиться повністю.
+func newCollection(name string, cfg CollectionConfig) (*Collection, error) {
+	s, er := openCollection(name, cfg)
+	if er != nil {
+		return nil, er
+	}
+	er = s.engine.Scan("", func(key string, doc Document) bool {
+		s.revision = max(s.revision, doc.Revision)
+		s.track(key, doc)
+		return true
+	})
+	if er != nil {
+		s.engine.Close()
+		return nil, fmt.Errorf("collection %s: %w", name, er)
+	}
+	return s, nil
+}
+
+// openCollection відкриває рушій, не читаючи документів: ревізію та порядок вставки
+// відновлення бере зі снапшоту та журналу
+func openCollection(name string, cfg CollectionConfig) (*Collection, error) {
+	engine, er := openEngine(cfg.Engine)
+	if er != nil {
+		return nil, fmt.Errorf("collection %s: %w", name, er)
+	}
+	return &Collection{engine: engine, config: cfg, name: name}, nil
+}
+
+func (s *Collection) storage() StorageEngine {
+	if s.engine == nil {
+		return noDocuments
+	}
+	return s.engine
 }
 
-type Index struct {
-	Field      string
-	Data       map[string]map[string]struct{} // fieldValue -> set of document IDs
-	SortedKeys []string                       // cache відсортованих ключів для швидкого запиту
+// drop видаляє дані рушія, коли колекцію видаляють зі стору; викликач тримає блокування на запис
+func (s *Collection) drop() {
+	if s.engine == nil {
+		return
+	}
+	if er := s.engine.Drop(); er != nil {
+		slog.Error("collection data not dropped", slog.String("collection", s.name), slog.String("error", er.Error()))
+	}
 }
 
+// current повертає поточний документ; застарілий вважається відсутнім
+func (s *Collection) current(key string, now time.Time) (Document, bool, error) {
+	doc, exists, er := s.storage().Get(key)
+	if er != nil || !exists || doc.expired(now) {
+		return Document{}, false, er
+	}
+	return doc, true, nil
+}
+
+// DTOCollection - колекція в дампі. Документи йдуть останніми, тож LoadFrom відкриває колекцію
+// до першого документа
 type DTOCollection struct {
-	Documents map[string]Document `json:"documents,omitempty"`
-	Config    CollectionConfig    `json:"config"`
+	Config    CollectionConfig     `json:"config"`
+	Indexes   []IndexDefinition    `json:"indexes,omitempty"`
+	Revision  uint64               `json:"revision,omitempty"` // остання видана ревізія
+	Order     []string             `json:"order,omitempty"`    // ключі capped колекції в порядку вставки
+	Stored    bool                 `json:"stored,omitempty"`   // документів немає: їх зберігає дисковий рушій (снапшот Checkpoint)
+	Expiry    map[string]time.Time `json:"expiry,omitempty"`   // для Stored: коли застаріють документи рушія
+	Documents map[string]Document  `json:"documents,omitempty"`
 }
 
 type QueryParams struct {
-	Desc     bool    // Визначає в якому порядку повертати дані
-	MinValue *string // Визначає мінімальне значення поля для фільтрації
-	MaxValue *string // Визначає максимальне значення поля для фільтрації
+	Desc     bool  // Визначає в якому порядку повертати дані
+	Equal    []any // Для складеного індексу: значення перших полів, які мають збігатися точно
+	MinValue any   // Визначає мінімальне значення поля для фільтрації, тип має відповідати типу індексу
+	MaxValue any   // Визначає максимальне значення поля для фільтрації, тип має відповідати типу індексу
+	Skip     int   // Скільки документів пропустити
+	Limit    int   // Максимальна кількість документів, 0 - без обмеження
+
+	Projection Projection // Які поля документів повертати, порожня - всі
 }
 
-func (s *Collection) Query(fieldName string, params QueryParams) ([]Document, error) {
-	index, ok := s.indexes[fieldName]
+// Query повертає документи за індексом з іменем indexName (поле або поля складеного індексу через кому).
+// Для складеного індексу MinValue та MaxValue застосовуються до поля, що йде одразу після полів з Equal.
+func (s *Collection) Query(indexName string, params QueryParams) ([]Document, error) {
+	proj, er := compileProjection(params.Projection)
+	if er != nil {
+		return nil, er
+	}
+
+	// Під блокуванням лише збираємо ключі з індексу, а документи копіюємо зі знімка,
+	// тож довгий запит бачить колекцію на один момент і не зупиняє записи
+	keys, snap, er := s.queryKeys(indexName, params)
+	if er != nil {
+		return nil, er
+	}
+	defer snap.Release()
+
+	docs, er := snap.readAll(paginate(keys, params.Skip, params.Limit))
+	if er != nil {
+		return nil, er
+	}
+	return s.project(docs, proj), nil
+}
+
+// queryKeys повертає ключі документів з діапазону індексу та знімок, відкритий на тому ж стані колекції
+func (s *Collection) queryKeys(indexName string, params QueryParams) ([]string, *Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	index, ok := s.indexes[indexName]
 	if !ok {
-		return nil, errors.New("index does not exist")
+		return nil, nil, errors.New("index does not exist")
 	}
-	keys := index.SortedKeys
-	if params.Desc {
-		reversed := make([]string, len(keys))
-		copy(reversed, keys)
-		sort.Sort(sort.Reverse(sort.StringSlice(reversed)))
-		keys = reversed
+	lo, hi, er := index.rangeOf(params)
+	if er != nil {
+		return nil, nil, er
 	}
 
-	var result []Document
+	var keys []string
+	now := time.Now()
 
-	for _, key := range keys {
-		if params.MinValue != nil && key < *params.MinValue {
-			continue
-		}
-		if params.MaxValue != nil && key > *params.MaxValue {
-			continue
+	for i := lo; i < hi; i++ {
+		entry := index.Entries[i]
+		if params.Desc {
+			entry = index.Entries[hi-1-(i-lo)]
 		}
 
-		for id := range index.Data[key] {
-			if doc, ok := s.documents[id]; ok {
-				result = append(result, doc)
+		// Документи з однаковим значенням впорядковані за первинним ключем
+		ids := sortedIDs(entry.IDs)
+		if params.Desc {
+			slices.Reverse(ids)
+		}
+		for _, id := range ids {
+			_, exists, er := s.current(id, now)
+			if er != nil {
+				return nil, nil, er
+			}
+			if exists {
+				keys = append(keys, id)
 			}
 		}
 	}
-	return result, nil
+	return keys, s.openSnapshot(), nil
+}
+
+// paginate відкидає перші skip ключів і залишає не більше limit
+func paginate(keys []string, skip, limit int) []string {
+	keys = keys[min(max(skip, 0), len(keys)):]
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
 }
 
 func (s *Collection) CreateIndex(fieldName string) error {
+	return s.CreateIndexWithOptions(fieldName, IndexOptions{})
+}
+
+func (s *Collection) CreateIndexWithOptions(fieldName string, opts IndexOptions) error {
+	return s.CreateCompoundIndex([]string{fieldName}, opts)
+}
+
+// CreateCompoundIndex створює індекс по кількох полях; порядок полів визначає порядок сортування
+func (s *Collection) CreateCompoundIndex(fields []string, opts IndexOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Індекс читає лише поля верхнього рівня, тож індекс на вкладений шлях на кшталт
+	// address.city, який розуміють фільтри, був би завжди порожнім
+	for _, field := range fields {
+		if strings.Contains(field, ".") {
+			return fmt.Errorf("%w: index field %s is a nested path", err.ErrInvalidCollectionConfig, field)
+		}
+	}
+	def := IndexDefinition{Fields: fields, IndexOptions: opts}
+	if _, exists := s.indexes[indexName(fields)]; exists {
+		return errors.New("index already exists")
+	}
+	index, er := s.buildIndex(def)
+	if er != nil {
+		return er
+	}
+	if er := s.log(walRecord{Op: walOpCreateIndex, Index: &def}); er != nil {
+		return er
+	}
+	s.addIndex(index)
+	return nil
+}
 
-	if _, exists := s.indexes[fieldName]; exists {
+// createIndexes будує індекси за один обхід рушія і реєструє їх
+func (s *Collection) createIndexes(defs []IndexDefinition) error {
+	names := map[string]struct{}{}
+	for _, def := range defs {
+		name := indexName(def.Fields)
+		_, registered := s.indexes[name]
+		_, repeated := names[name]
+		if registered || repeated {
+			return fmt.Errorf("index %s: index already exists", name)
+		}
+		names[name] = struct{}{}
+	}
+	indexes, er := s.buildIndexes(defs)
+	if er != nil {
+		return er
+	}
+	for _, index := range indexes {
+		s.addIndex(index)
+	}
+	return nil
+}
+
+// deferIndex запам'ятовує індекс, прочитаний під час відновлення; buildPending збудує його
+// за станом рушія після журналу, тож записи журналу не оновлюють індексів, які потім видалять
+func (s *Collection) deferIndex(def IndexDefinition) error {
+	name := indexName(def.Fields)
+	pending := slices.ContainsFunc(s.pending, func(d IndexDefinition) bool { return indexName(d.Fields) == name })
+	if _, exists := s.indexes[name]; exists || pending {
 		return errors.New("index already exists")
 	}
-	index := &Index{
-		Field:      fieldName,
-		Data:       make(map[string]map[string]struct{}),
-		SortedKeys: []string{},
+	s.pending = append(s.pending, def)
+	return nil
+}
+
+// undeferIndex видаляє індекс, який ще чекає на побудову; false, якщо такого немає
+func (s *Collection) undeferIndex(name string) bool {
+	i := slices.IndexFunc(s.pending, func(d IndexDefinition) bool { return indexName(d.Fields) == name })
+	if i < 0 {
+		return false
+	}
+	s.pending = slices.Delete(s.pending, i, i+1)
+	return true
+}
+
+// buildPending будує індекси, відкладені під час відновлення
+func (s *Collection) buildPending() error {
+	pending := s.pending
+	s.pending = nil
+	return s.createIndexes(pending)
+}
+
+// buildIndex будує індекс по всіх документах колекції, не реєструючи його
+func (s *Collection) buildIndex(def IndexDefinition) (*Index, error) {
+	indexes, er := s.buildIndexes([]IndexDefinition{def})
+	if er != nil {
+		return nil, er
 	}
+	return indexes[0], nil
+}
 
-	for id, doc := range s.documents {
-		field, ok := doc.Fields[fieldName]
-		if !ok || field.Type != DocumentFieldTypeString {
-			continue
+// buildIndexes будує кілька індексів за один обхід рушія, не реєструючи їх
+func (s *Collection) buildIndexes(defs []IndexDefinition) ([]*Index, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+	type keyed struct {
+		key []any
+		id  string
+	}
+	indexes := make([]*Index, len(defs))
+	all := make([][]keyed, len(defs))
+	for i, def := range defs {
+		index, er := newIndex(def)
+		if er != nil {
+			return nil, er
 		}
-		val := field.Value.(string)
-		if _, exists := index.Data[val]; !exists {
-			index.Data[val] = map[string]struct{}{}
-			index.SortedKeys = append(index.SortedKeys, val)
+		indexes[i] = index
+	}
+	var keyErr error
+	er := s.storage().Scan("", func(id string, doc Document) bool {
+		for i, index := range indexes {
+			key, ok, er := index.key(doc)
+			if er != nil {
+				keyErr = fmt.Errorf("document %s: %w", id, er)
+				return false
+			}
+			if ok {
+				all[i] = append(all[i], keyed{key: key, id: id})
+			} else if _, exists := doc.Fields[index.Fields[0]]; exists {
+				index.Uncovered[id] = struct{}{}
+			}
 		}
-		index.Data[val][id] = struct{}{}
+		return true
+	})
+	if er != nil {
+		return nil, er
+	}
+	if keyErr != nil {
+		return nil, keyErr
 	}
 
-	sort.Strings((index.SortedKeys))
+	for i, index := range indexes {
+		keys := all[i]
+		sort.Slice(keys, func(i, j int) bool {
+			if c := comparePrefix(keys[i].key, keys[j].key); c != 0 {
+				return c < 0
+			}
+			return keys[i].id < keys[j].id
+		})
+		for _, k := range keys {
+			last := len(index.Entries) - 1
+			if last < 0 || comparePrefix(index.Entries[last].Key, k.key) != 0 {
+				index.Entries = append(index.Entries, IndexEntry{Key: k.key, IDs: map[string]struct{}{}})
+				last++
+			} else if index.Unique {
+				for other := range index.Entries[last].IDs {
+					return nil, &err.DuplicateKeyError{Index: index.Name, Value: displayKey(k.key), DocumentID: other}
+				}
+			}
+			index.Entries[last].IDs[k.id] = struct{}{}
+		}
+	}
+	return indexes, nil
+}
 
+// sortedIndexes повертає індекси колекції в порядку імен, щоб вибір плану був детермінованим
+func (s *Collection) sortedIndexes() []*Index {
+	indexes := make([]*Index, 0, len(s.indexes))
+	for _, index := range s.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes
+}
+
+func (s *Collection) addIndex(index *Index) {
 	if s.indexes == nil {
 		s.indexes = map[string]*Index{}
 	}
-	s.indexes[fieldName] = index
-	return nil
+	s.indexes[index.Name] = index
 }
 
 func (s *Collection) DeleteIndex(fieldName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.indexes[fieldName]; !exists {
+		return errors.New("index does not exist")
+	}
+	if er := s.log(walRecord{Op: walOpDeleteIndex, Field: fieldName}); er != nil {
+		return er
+	}
+	return s.deleteIndex(fieldName)
+}
+
+func (s *Collection) deleteIndex(fieldName string) error {
 	if _, exists := s.indexes[fieldName]; !exists {
 		return errors.New("index does not exist")
 	}
@@ -103,45 +382,262 @@ func (s *Collection) DeleteIndex(fieldName string) error {
 	return nil
 }
 
+// log записує зміну в журнал стору; колекції без журналу нічого не пишуть
+func (s *Collection) log(rec walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	rec.Collection = s.name
+	if er := s.wal.append(rec); er != nil {
+		slog.Error("wal append failed", slog.String("error", er.Error()))
+		return er
+	}
+	return nil
+}
+
+// applied повертає помилку зміни, яку вже записано в журнал; така помилка ламає журнал
+func (s *Collection) applied(er error) error {
+	if er == nil || s.wal == nil {
+		return er
+	}
+	return s.wal.abandon(er)
+}
+
+// ToDto повертає DTO колекції; документи читаються зі знімка, тож записи на цей час не зупиняються
 func (s *Collection) ToDto() DTOCollection {
-	return DTOCollection{
-		Documents: s.documents,
-		Config:    s.config,
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	dto, _ := snap.toDto() // знімок ще не закритий, тож помилки бути не може
+	return dto
+}
+
+func (s *Collection) indexDefinitions() []IndexDefinition {
+	indexes := make([]IndexDefinition, 0, len(s.indexes))
+	for _, index := range s.indexes {
+		indexes = append(indexes, index.definition())
 	}
+	sort.Slice(indexes, func(i, j int) bool { return indexName(indexes[i].Fields) < indexName(indexes[j].Fields) })
+	return indexes
 }
 
 type CollectionConfig struct {
 	PrimaryKey string `json:"cgg"`
+	// TTL - скільки живе документ: від часу в полі ExpireField, а якщо поле не задано - від останнього запису
+	TTL time.Duration `json:"ttl,omitempty"`
+	// ExpireField - шлях до поля з часом (time.Time або рядок RFC 3339); без TTL це сам час закінчення.
+	// Документ без цього поля чи з іншим типом значення не застаріває.
+	ExpireField string `json:"expire_field,omitempty"`
+	// Capped обмежує кількість чи розмір документів; nil - колекція без обмежень
+	Capped *CappedOptions `json:"capped,omitempty"`
+	// Engine - де зберігаються документи; нульове значення - у пам'яті
+	Engine EngineOptions `json:"engine,omitzero"`
+}
+
+func (c CollectionConfig) validate() error {
+	if er := c.Engine.validate(); er != nil {
+		return er
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("%w: negative ttl %s", err.ErrInvalidCollectionConfig, c.TTL)
+	}
+	if c.Capped != nil {
+		if c.Capped.MaxDocuments < 0 || c.Capped.MaxBytes < 0 {
+			return fmt.Errorf("%w: negative capped limit", err.ErrInvalidCollectionConfig)
+		}
+		if c.Capped.MaxDocuments == 0 && c.Capped.MaxBytes == 0 {
+			return fmt.Errorf("%w: capped collection needs max documents or max bytes", err.ErrInvalidCollectionConfig)
+		}
+	}
+	return nil
 }
 
+// Put записує документ, замінюючи наявний з тим самим ключем; див. також Insert, Replace та Upsert
 func (s *Collection) Put(doc Document) error {
+	_, er := s.write(doc, writeUpsert, 0)
+	return er
+}
+
+// WriteResult описує, що зробили Insert, Replace, Upsert чи PutIfRevision
+type WriteResult struct {
+	Key      string // первинний ключ документа
+	Inserted bool   // документа з таким ключем не було, його створено
+	Replaced bool   // наявний документ замінено
+	Revision uint64 // нова ревізія документа
+}
+
+type writeMode int
+
+const (
+	writeUpsert     writeMode = iota // створити або замінити
+	writeInsert                      // лише створити
+	writeReplace                     // лише замінити
+	writeIfRevision                  // створити або замінити, якщо ревізія збігається
+)
+
+// Insert додає новий документ; якщо ключ зайнятий, повертає *err.DuplicateKeyError
+func (s *Collection) Insert(doc Document) (*WriteResult, error) {
+	return s.write(doc, writeInsert, 0)
+}
+
+// Replace замінює наявний документ; якщо документа з таким ключем немає, повертає err.ErrDocumentNotFound
+func (s *Collection) Replace(doc Document) (*WriteResult, error) {
+	return s.write(doc, writeReplace, 0)
+}
+
+// Upsert замінює документ з таким ключем або додає новий
+func (s *Collection) Upsert(doc Document) (*WriteResult, error) {
+	return s.write(doc, writeUpsert, 0)
+}
+
+// PutIfRevision записує документ, лише якщо поточна ревізія документа з тим самим ключем
+// дорівнює revision; revision == 0 означає, що документа ще не повинно бути.
+// Інакше повертає *err.RevisionConflictError.
+func (s *Collection) PutIfRevision(doc Document, revision uint64) (*WriteResult, error) {
+	return s.write(doc, writeIfRevision, revision)
+}
+
+// documentKey повертає первинний ключ документа
+func (s *Collection) documentKey(doc Document) (string, error) {
 	// Потрібно перевірити що документ містить поле `{cfg.PrimaryKey}` типу `string`
 
 	keyFilds, ok := doc.Fields[s.config.PrimaryKey]
 	if !ok {
 		slog.Error("error: Document must contain a key field")
-		return err.ErrUnsupportedDocumentField
+		return "", err.ErrUnsupportedDocumentField
 	}
 
 	if keyFilds.Type != DocumentFieldTypeString {
 		slog.Error("error: Key field must be of type string")
-		return err.ErrUnsupportedDocumentField
+		return "", err.ErrUnsupportedDocumentField
 	}
 	keyValue, ok := keyFilds.Value.(string)
 	if !ok {
 		slog.Error("Error: Key field value is not a string")
-		return err.ErrUnsupportedDocumentField
+		return "", err.ErrUnsupportedDocumentField
 	}
-	if s.documents == nil {
-		s.documents = map[string]Document{}
+	// Файловий рушій не прийме задовгого ключа; це видно ще до запису в журнал
+	if s.config.Engine.Type == EngineFile {
+		if er := checkFileEngineKey(keyValue); er != nil {
+			return "", er
+		}
+	}
+	return keyValue, nil
+}
+
+// write перевіряє наявність ключа і записує документ під одним блокуванням,
+// тож між перевіркою та записом інший запис з тим самим ключем вклинитися не може
+func (s *Collection) write(doc Document, mode writeMode, revision uint64) (*WriteResult, error) {
+	keyValue, er := s.documentKey(doc)
+	if er != nil {
+		return nil, er
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, er := s.current(keyValue, now)
+	if er != nil {
+		return nil, er
+	}
+	switch {
+	case mode == writeIfRevision && current.Revision != revision:
+		return nil, &err.RevisionConflictError{Key: keyValue, Expected: revision, Actual: current.Revision}
+	case exists && mode == writeInsert:
+		return nil, &err.DuplicateKeyError{Index: s.config.PrimaryKey, Value: keyValue, DocumentID: keyValue}
+	case !exists && mode == writeReplace:
+		return nil, fmt.Errorf("%w: %s", err.ErrDocumentNotFound, keyValue)
+	}
+
+	doc = doc.clone()
+	doc.Revision = s.revision + 1
+	doc.ExpiresAt = s.config.expiresAt(doc, now)
+	if er := s.checkIndexes(keyValue, doc, now); er != nil {
+		slog.Error("document rejected by index", slog.String("error", er.Error()))
+		return nil, er
+	}
+	evicted, er := s.evictions(keyValue, doc)
+	if er != nil {
+		return nil, er
+	}
+	if er := s.log(s.withEvictions(walRecord{Op: walOpPut, Key: keyValue, Document: &doc}, evicted)); er != nil {
+		return nil, er
+	}
+	if er := s.put(keyValue, doc); er != nil {
+		return nil, s.applied(er)
+	}
+	if er := s.evict(evicted); er != nil {
+		return nil, s.applied(er)
 	}
-	s.documents[keyValue] = doc
 	slog.Info("document added")
+	return &WriteResult{Key: keyValue, Inserted: !exists, Replaced: exists, Revision: doc.Revision}, nil
+}
+
+// checkIndexes перевіряє унікальні індекси. Значення, зайняте застарілим документом, вважається вільним:
+// такий документ видаляється одразу, не чекаючи на sweeper.
+func (s *Collection) checkIndexes(key string, doc Document, now time.Time) error {
+	for _, index := range s.indexes {
+		er := index.check(key, doc)
+		var dup *err.DuplicateKeyError
+		for errors.As(er, &dup) && dup.DocumentID != key {
+			_, live, cer := s.current(dup.DocumentID, now)
+			if cer != nil {
+				return cer
+			}
+			if live {
+				break
+			}
+			if er := s.expire(dup.DocumentID); er != nil {
+				return er
+			}
+			er = index.check(key, doc)
+		}
+		if er != nil {
+			return er
+		}
+	}
+	return nil
+}
+
+// put записує документ без журналу. Документ без ревізії (зі старого дампу) отримує нову,
+// а ревізія з журналу чи дампу зсуває лічильник, щоб наступні записи не повторили її.
+// Якщо рушій не записав документ, колекція лишається без змін.
+func (s *Collection) put(key string, doc Document) error {
+	if s.engine == nil {
+		s.engine = NewMemoryEngine()
+	}
+	old, replaced, er := s.engine.Get(key)
+	if er != nil {
+		return er
+	}
+	if doc.Revision == 0 {
+		doc.Revision = s.revision + 1
+	}
+	if er := s.engine.Put(key, doc); er != nil {
+		return er
+	}
+	s.revision = max(s.revision, doc.Revision)
+	for _, index := range s.indexes {
+		if replaced {
+			index.remove(key, old)
+		}
+		index.add(key, doc)
+	}
+	s.track(key, doc)
 	return nil
 }
 
 func (s *Collection) Get(key string) (*Document, error) {
-	if doc, exists := s.documents[key]; exists {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists, er := s.current(key, time.Now())
+	if er != nil {
+		return nil, er
+	}
+	if exists {
+		doc = doc.clone()
 		return &doc, nil
 	}
 	slog.Info("document not found")
@@ -149,18 +645,78 @@ func (s *Collection) Get(key string) (*Document, error) {
 }
 
 func (s *Collection) Delete(key string) bool {
-	if _, exists := s.documents[key]; exists {
-		delete(s.documents, key)
-		slog.Info("document delete")
-		return true
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Застарілий документ уже не існує для читачів, тож і видаляти нічого; його прибере sweeper
+	if _, exists, er := s.current(key, time.Now()); er != nil || !exists {
+		return false
+	}
+	if er := s.log(walRecord{Op: walOpDelete, Key: key}); er != nil {
+		return false
+	}
+	if _, er := s.delete(key); er != nil {
+		slog.Error("document not deleted", slog.String("error", s.applied(er).Error()))
+		return false
 	}
-	return false
+	slog.Info("document delete")
+	return true
 }
 
+// DeleteIfRevision видаляє документ, лише якщо його поточна ревізія дорівнює revision.
+// Інакше, зокрема коли документа вже немає, повертає *err.RevisionConflictError.
+func (s *Collection) DeleteIfRevision(key string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, er := s.current(key, time.Now())
+	if er != nil {
+		return er
+	}
+	if !exists || current.Revision != revision {
+		return &err.RevisionConflictError{Key: key, Expected: revision, Actual: current.Revision}
+	}
+	if er := s.log(walRecord{Op: walOpDelete, Key: key}); er != nil {
+		return er
+	}
+	if _, er := s.delete(key); er != nil {
+		return s.applied(er)
+	}
+	slog.Info("document delete")
+	return nil
+}
+
+// delete видаляє документ без журналу; false, якщо документа не було
+func (s *Collection) delete(key string) (bool, error) {
+	doc, exists, er := s.storage().Get(key)
+	if er != nil || !exists {
+		return false, er
+	}
+	if er := s.engine.Delete(key); er != nil {
+		return false, er
+	}
+	for _, index := range s.indexes {
+		index.remove(key, doc)
+	}
+	// Видалення теж займає ревізію, тож документ, створений знову з тим самим ключем,
+	// не отримає ревізію, яку ще пам'ятає хтось, хто читав видалений
+	s.revision++
+	if s.capped != nil {
+		s.capped.remove(key)
+	}
+	delete(s.expiry, key)
+	return true, nil
+}
+
+// List повертає всі документи в порядку первинного ключа; для сторінок див. ListPage
+// Документи копіюються зі знімка порціями, тож великий список не зупиняє записи.
 func (s *Collection) List() []Document {
-	sList := make([]Document, 0, len(s.documents))
-	for _, v := range s.documents {
-		sList = append(sList, v)
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	docs, er := snap.List()
+	if er != nil {
+		slog.Error("documents not listed", slog.String("error", er.Error()))
 	}
-	return sList
+	return docs
 }
@@ -1,7 +1,11 @@
 package documentstore
 
 import (
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -81,8 +85,8 @@ func TestCollection_Put(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Collection{
-				documents: tt.fields.documents,
-				config:    tt.fields.config,
+				engine: memoryTestEngine(tt.fields.documents),
+				config: tt.fields.config,
 			}
 			if err := s.Put(tt.args.doc); (err != nil) != tt.wantErr {
 				t.Errorf("Put() error = %v, wantErr %v", err, tt.wantErr)
@@ -169,8 +173,8 @@ func TestCollection_Get(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Collection{
-				documents: tt.fields.Documents,
-				config:    tt.fields.Config,
+				engine: memoryTestEngine(tt.fields.Documents),
+				config: tt.fields.Config,
 			}
 			if err := s.Put(tt.args.doc); (err != nil) != tt.wantErr {
 				t.Errorf("Put() error = %v, wantErr %v", err, tt.wantErr)
@@ -179,6 +183,47 @@ func TestCollection_Get(t *testing.T) {
 	}
 }
 
+func TestCollection_NestedValuesIsolated(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	address := map[string]any{"city": "Kyiv"}
+	tags := []any{"a", map[string]any{"x": int64(1)}}
+	s.Put(Document{Fields: map[string]DocumentField{
+		"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+		"address": {Type: DocumentFieldTypeObject, Value: address},
+		"tags":    {Type: DocumentFieldTypeArray, Value: tags},
+	}})
+	// Ні документ, переданий у Put, ні повернуті читаннями не ділять вкладених значень з колекцією
+	address["city"] = "Lviv"
+	tags[0] = "b"
+	mutate := func(doc Document) {
+		doc.Fields["address"].Value.(map[string]any)["city"] = "Odesa"
+		list := doc.Fields["tags"].Value.([]any)
+		list[0] = "c"
+		list[1].(map[string]any)["x"] = int64(2)
+	}
+	got, _ := s.Get("u1")
+	mutate(*got)
+	mutate(s.List()[0])
+	found, _ := s.Find(Filter{"address.city": "Kyiv"})
+	mutate(found[0])
+	snap := s.Snapshot()
+	fromSnapshot, _ := snap.Get("u1")
+	mutate(*fromSnapshot)
+	snap.Release()
+
+	got, _ = s.Get("u1")
+	want := map[string]any{"city": "Kyiv"}
+	if !reflect.DeepEqual(got.Fields["address"].Value, want) {
+		t.Errorf("address = %v, want %v", got.Fields["address"].Value, want)
+	}
+	if wantTags := []any{"a", map[string]any{"x": int64(1)}}; !reflect.DeepEqual(got.Fields["tags"].Value, wantTags) {
+		t.Errorf("tags = %v, want %v", got.Fields["tags"].Value, wantTags)
+	}
+	if docs, _ := s.Find(Filter{"address.city": "Kyiv"}); len(docs) != 1 {
+		t.Errorf("Find() by unchanged nested value returned %d documents, want 1", len(docs))
+	}
+}
+
 func TestCollection_Delete(t *testing.T) {
 	docs := map[string]Document{}
 	docs["id"] = GetTestDocuments(GetTestFields("id", DocumentFieldTypeNumber))
@@ -224,8 +269,8 @@ func TestCollection_Delete(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Collection{
-				documents: tt.fields.Documents,
-				config:    tt.fields.Config,
+				engine: memoryTestEngine(tt.fields.Documents),
+				config: tt.fields.Config,
 			}
 			if got := s.Delete(tt.args.key); got != tt.want {
 				t.Errorf("Delete() = %v, want %v", got, tt.want)
@@ -246,7 +291,7 @@ func TestCollection_List(t *testing.T) {
 	}{
 		{name: "valid List with correct documnet",
 			s: &Collection{
-				documents: map[string]Document{},
+				engine: memoryTestEngine(nil),
 				config: CollectionConfig{
 					PrimaryKey: "id-1",
 				},
@@ -257,13 +302,13 @@ func TestCollection_List(t *testing.T) {
 		{
 			name: "collection with one document",
 			s: &Collection{
-				documents: map[string]Document{
+				engine: memoryTestEngine(map[string]Document{
 					"doc1": {
 						Fields: map[string]DocumentField{
 							"id": {Type: DocumentFieldTypeString, Value: "123"},
 						},
 					},
-				},
+				}),
 				config: CollectionConfig{
 					PrimaryKey: "id",
 				},
@@ -306,3 +351,336 @@ func GetTestDocuments(fields ...map[string]DocumentField) Document {
 	}
 	return document
 }
+
+// testCollection створює колекцію з документами docs та індексами indexes;
+// Put копіює значення, тож таблиці документів можна спільно використовувати між тестами
+func testCollection(t *testing.T, docs []map[string]DocumentField, indexes ...IndexDefinition) *Collection {
+	t.Helper()
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	for _, fields := range docs {
+		if er := s.Put(GetTestDocuments(fields)); er != nil {
+			t.Fatal(er)
+		}
+	}
+	for _, def := range indexes {
+		if er := s.CreateCompoundIndex(def.Fields, def.IndexOptions); er != nil {
+			t.Fatal(er)
+		}
+	}
+	return s
+}
+
+func TestCollection_ConcurrentAccess(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	if err := s.CreateIndex("name"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := fmt.Sprintf("w%d-%d", w, i)
+				doc := Document{Fields: map[string]DocumentField{
+					"id":   {Type: DocumentFieldTypeString, Value: id},
+					"name": {Type: DocumentFieldTypeString, Value: id},
+				}}
+				if err := s.Put(doc); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.Get(id); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%3 == 0 {
+					s.Delete(id)
+				}
+			}
+		}(w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s.List()
+				if _, err := s.Query("name", QueryParams{}); err != nil {
+					t.Error(err)
+					return
+				}
+				s.ToDto()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := len(s.List()), 8*66; got != want {
+		t.Errorf("List() returned %d documents, want %d", got, want)
+	}
+}
+
+func TestCollection_IndexMaintenance(t *testing.T) {
+	user := func(id, name string) Document {
+		return Document{Fields: map[string]DocumentField{
+			"id":   {Type: DocumentFieldTypeString, Value: id},
+			"name": {Type: DocumentFieldTypeString, Value: name},
+		}}
+	}
+	tests := []struct {
+		name   string
+		change func(s *Collection)
+		params QueryParams
+		want   []string
+	}{
+		{
+			name:   "documents put after CreateIndex are queryable",
+			change: func(s *Collection) { s.Put(user("u4", "Stepan")) },
+			want:   []string{"u1", "u3", "u4", "u2"},
+		},
+		{
+			name:   "overwrite removes old value",
+			change: func(s *Collection) { s.Put(user("u1", "Zenon")) },
+			params: QueryParams{MaxValue: "Roman"},
+			want:   []string{"u3"},
+		},
+		{
+			name:   "delete removes value",
+			change: func(s *Collection) { s.Delete("u3") },
+			params: QueryParams{MinValue: "Roman"},
+			want:   []string{"u2"},
+		},
+		{
+			name: "non string values are not indexed",
+			change: func(s *Collection) {
+				s.Put(Document{Fields: map[string]DocumentField{
+					"id":   {Type: DocumentFieldTypeString, Value: "u5"},
+					"name": {Type: DocumentFieldTypeNumber, Value: 5},
+				}})
+			},
+			want: []string{"u1", "u3", "u2"},
+		},
+		{
+			name:   "descending order",
+			change: func(s *Collection) {},
+			params: QueryParams{Desc: true},
+			want:   []string{"u2", "u3", "u1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+			s.Put(user("u1", "Andrii"))
+			s.Put(user("u2", "Taras"))
+			s.Put(user("u3", "Roman"))
+			if err := s.CreateIndex("name"); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(s)
+
+			docs, err := s.Query("name", tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(docs))
+			for _, doc := range docs {
+				got = append(got, doc.Fields["id"].Value.(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollection_InsertReplaceUpsert(t *testing.T) {
+	doc := func(id, name string) Document {
+		return Document{Fields: map[string]DocumentField{
+			"id":   {Type: DocumentFieldTypeString, Value: id},
+			"name": {Type: DocumentFieldTypeString, Value: name},
+		}}
+	}
+	tests := []struct {
+		name     string
+		write    func(s *Collection, doc Document) (*WriteResult, error)
+		doc      Document
+		want     *WriteResult
+		wantErr  error
+		wantName string
+	}{
+		{name: "insert new", write: (*Collection).Insert, doc: doc("u2", "Taras"),
+			want: &WriteResult{Key: "u2", Inserted: true, Revision: 2}, wantName: "Taras"},
+		{name: "insert existing", write: (*Collection).Insert, doc: doc("u1", "Taras"),
+			wantErr: err.ErrDuplicateKey, wantName: "Andrii"},
+		{name: "replace existing", write: (*Collection).Replace, doc: doc("u1", "Taras"),
+			want: &WriteResult{Key: "u1", Replaced: true, Revision: 2}, wantName: "Taras"},
+		{name: "replace missing", write: (*Collection).Replace, doc: doc("u2", "Taras"),
+			wantErr: err.ErrDocumentNotFound},
+		{name: "upsert existing", write: (*Collection).Upsert, doc: doc("u1", "Taras"),
+			want: &WriteResult{Key: "u1", Replaced: true, Revision: 2}, wantName: "Taras"},
+		{name: "upsert new", write: (*Collection).Upsert, doc: doc("u2", "Taras"),
+			want: &WriteResult{Key: "u2", Inserted: true, Revision: 2}, wantName: "Taras"},
+		{name: "invalid document", write: (*Collection).Insert, doc: GetTestDocuments(GetTestFields("x", DocumentFieldTypeString)),
+			wantErr: err.ErrUnsupportedDocumentField},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+			s.Put(doc("u1", "Andrii"))
+
+			got, er := tt.write(s, tt.doc)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+			if tt.wantName == "" {
+				return
+			}
+			key := tt.doc.Fields["id"].Value.(string)
+			stored, _ := s.Get(key)
+			if stored == nil || stored.Fields["name"].Value != tt.wantName {
+				t.Errorf("stored document %s = %v, want name %s", key, stored, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestCollection_InsertDuplicateKeyError(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	doc := GetTestDocuments(map[string]DocumentField{"id": {Type: DocumentFieldTypeString, Value: "u1"}})
+	s.Insert(doc)
+
+	_, er := s.Insert(doc)
+	var dup *err.DuplicateKeyError
+	if !errors.As(er, &dup) {
+		t.Fatalf("Insert() error = %v, want *DuplicateKeyError", er)
+	}
+	if dup.Index != "id" || dup.Value != "u1" || dup.DocumentID != "u1" {
+		t.Errorf("Insert() error = %+v", dup)
+	}
+}
+
+func TestCollection_ConcurrentInsert(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inserted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, er := s.Insert(Document{Fields: map[string]DocumentField{
+				"id":     {Type: DocumentFieldTypeString, Value: "u1"},
+				"writer": {Type: DocumentFieldTypeNumber, Value: i},
+			}})
+			switch {
+			case er == nil:
+				mu.Lock()
+				inserted++
+				mu.Unlock()
+			case !errors.Is(er, err.ErrDuplicateKey):
+				t.Error(er)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if inserted != 1 {
+		t.Errorf("%d concurrent inserts of one key succeeded, want 1", inserted)
+	}
+}
+
+func TestCollection_Revisions(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	doc := func(name string) Document {
+		return Document{Fields: map[string]DocumentField{
+			"id":   {Type: DocumentFieldTypeString, Value: "u1"},
+			"name": {Type: DocumentFieldTypeString, Value: name},
+		}, Revision: 100} // ревізію викликача колекція ігнорує
+	}
+	revision := func() uint64 {
+		t.Helper()
+		got, er := s.Get("u1")
+		if er != nil {
+			t.Fatal(er)
+		}
+		return got.Revision
+	}
+
+	s.Put(doc("Andrii"))
+	if got := revision(); got != 1 {
+		t.Fatalf("revision after Put = %d, want 1", got)
+	}
+
+	if _, er := s.PutIfRevision(doc("Taras"), 0); !errors.Is(er, err.ErrRevisionConflict) {
+		t.Errorf("PutIfRevision(0) of existing document error = %v, want conflict", er)
+	}
+	res, er := s.PutIfRevision(doc("Taras"), 1)
+	if er != nil || res.Revision != 2 || revision() != 2 {
+		t.Fatalf("PutIfRevision(1) = %+v, %v; want revision 2", res, er)
+	}
+	var conflict *err.RevisionConflictError
+	if _, er := s.PutIfRevision(doc("Roman"), 1); !errors.As(er, &conflict) || conflict.Expected != 1 || conflict.Actual != 2 {
+		t.Errorf("PutIfRevision(1) with stale revision error = %v", er)
+	}
+	if got, _ := s.Get("u1"); got.Fields["name"].Value != "Taras" {
+		t.Errorf("rejected write changed document: %v", got.Fields)
+	}
+
+	upd, _ := s.Update("u1", Update{"$set": map[string]any{"name": "Taras"}})
+	if upd.Modified || upd.Revision != 2 {
+		t.Errorf("no-op Update() = %+v, want revision 2", *upd)
+	}
+	upd, _ = s.Update("u1", Update{"$set": map[string]any{"name": "Roman"}})
+	if upd.Revision != 3 || revision() != 3 {
+		t.Errorf("Update() revision = %d, want 3", upd.Revision)
+	}
+
+	if er := s.DeleteIfRevision("u1", 2); !errors.Is(er, err.ErrRevisionConflict) {
+		t.Errorf("DeleteIfRevision(2) error = %v, want conflict", er)
+	}
+	if er := s.DeleteIfRevision("u1", 3); er != nil {
+		t.Fatal(er)
+	}
+	if er := s.DeleteIfRevision("u1", 3); !errors.As(er, &conflict) || conflict.Actual != 0 {
+		t.Errorf("DeleteIfRevision() of deleted document error = %v, want conflict with actual 0", er)
+	}
+
+	// Новий документ з тим самим ключем не повинен отримати ревізію видаленого
+	res, er = s.PutIfRevision(doc("Stepan"), 0)
+	if er != nil || res.Revision <= 3 {
+		t.Errorf("PutIfRevision(0) after delete = %+v, %v; want revision above 3", res, er)
+	}
+}
+
+func TestCollection_ConcurrentPutIfRevision(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	s.Put(GetTestDocuments(map[string]DocumentField{"id": {Type: DocumentFieldTypeString, Value: "u1"}}))
+	read, _ := s.Get("u1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc := read.clone()
+			doc.Fields["writer"] = DocumentField{Type: DocumentFieldTypeNumber, Value: i}
+			_, er := s.PutIfRevision(doc, read.Revision)
+			switch {
+			case er == nil:
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			case !errors.Is(er, err.ErrRevisionConflict):
+				t.Error(er)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Errorf("%d writers with the same revision succeeded, want 1", succeeded)
+	}
+}
@@ -1,8 +1,12 @@
 package documentstore
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 )
 
 type DocumentFieldType string
@@ -20,8 +24,110 @@ type DocumentField struct {
 	Value any               `json:"value"`
 }
 
+// UnmarshalJSON зберігає цілі числа як int64, а не float64, щоб значення після дампу не змінювали тип
+func (f *DocumentField) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type  DocumentFieldType `json:"type"`
+		Value json.RawMessage   `json:"value"`
+	}
+	if er := json.Unmarshal(data, &raw); er != nil {
+		return er
+	}
+	var value any
+	if len(raw.Value) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw.Value))
+		dec.UseNumber()
+		if er := dec.Decode(&value); er != nil {
+			return er
+		}
+	}
+	f.Type = raw.Type
+	f.Value = normalizeNumbers(value)
+	return nil
+}
+
+func normalizeNumbers(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		if i, er := val.Int64(); er == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case []any:
+		for i := range val {
+			val[i] = normalizeNumbers(val[i])
+		}
+	case map[string]any:
+		for k := range val {
+			val[k] = normalizeNumbers(val[k])
+		}
+	}
+	return v
+}
+
 type Document struct {
 	Fields map[string]DocumentField `json:"fields"`
+	// Revision призначає колекція при кожному записі документа; значення, передане в Put, ігнорується.
+	// Використовується для умовних записів, див. PutIfRevision та DeleteIfRevision.
+	Revision uint64 `json:"revision,omitempty"`
+	// ExpiresAt теж призначає колекція, якщо в її конфігурації задано TTL чи ExpireField;
+	// нульовий час означає, що документ не застаріває. Застарілий документ не повертає жодне читання.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// expired перевіряє, чи документ застарів на момент now
+func (d Document) expired(now time.Time) bool {
+	return !d.ExpiresAt.IsZero() && !now.Before(d.ExpiresAt)
+}
+
+// clone повертає копію документа з власною мапою полів та власними вкладеними об'єктами і масивами,
+// щоб зміни у викликача не потрапляли в колекцію і навпаки
+func (d Document) clone() Document {
+	fields := make(map[string]DocumentField, len(d.Fields))
+	for k, v := range d.Fields {
+		fields[k] = DocumentField{Type: v.Type, Value: cloneValue(v.Value)}
+	}
+	return Document{Fields: fields, Revision: d.Revision, ExpiresAt: d.ExpiresAt}
+}
+
+// cloneValue копіює мапи та зрізи значення поля на всю глибину; решта значень копіюється присвоєнням
+func cloneValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		if val == nil {
+			return val
+		}
+		out := make(map[string]any, len(val))
+		for k, elem := range val {
+			out[k] = cloneValue(elem)
+		}
+		return out
+	case []any:
+		if val == nil {
+			return val
+		}
+		out := make([]any, len(val))
+		for i, elem := range val {
+			out[i] = cloneValue(elem)
+		}
+		return out
+	}
+	// Інші зрізи та мапи, як-от []string з MarshalDocument, мають елементи конкретного типу
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() == reflect.Slice && !rv.IsNil():
+		out := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		reflect.Copy(out, rv)
+		return out.Interface()
+	case rv.Kind() == reflect.Map && !rv.IsNil():
+		out := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			out.SetMapIndex(it.Key(), it.Value())
+		}
+		return out.Interface()
+	}
+	return v
 }
 
 type MyStruct struct {
@@ -92,18 +198,42 @@ func UnmarshalDocument(doc *Document, output any) error {
 		if !fValue.CanSet() {
 			continue
 		}
-		jsonTag := f.Tag.Get("json")
+		jsonTag := strings.Split(f.Tag.Get("json"), ",")[0]
 		if jsonTag == "" {
 			jsonTag = f.Name
 		}
-		if val, ok := doc.Fields[jsonTag]; ok {
-			valR := reflect.ValueOf(val.Value)
-			if valR.Type().AssignableTo(fValue.Type()) {
-				fValue.Set(valR)
-			} else {
-				return fmt.Errorf("type mismatch for field %s: expected %s but got %s", f.Name, fValue.Type(), valR.Type())
+		// Поля, яких немає в документі (наприклад, після проекції), залишаються нульовими
+		if val, ok := doc.Fields[jsonTag]; ok && val.Value != nil {
+			if er := assignValue(fValue, val.Value); er != nil {
+				return fmt.Errorf("type mismatch for field %s: expected %s but got %T", f.Name, fValue.Type(), val.Value)
 			}
 		}
 	}
 	return nil
 }
+
+// assignValue записує значення поля документа в поле структури. Числа конвертуються між
+// типами Go (після дампу цілі числа стають int64), а вкладені об'єкти та масиви,
+// що після проекції чи дампу є map[string]any та []any, переносяться через JSON.
+func assignValue(dst reflect.Value, v any) error {
+	src := reflect.ValueOf(v)
+	switch {
+	case src.Type().AssignableTo(dst.Type()):
+		dst.Set(src)
+		return nil
+	case isNumberKind(src.Kind()) && isNumberKind(dst.Kind()):
+		dst.Set(src.Convert(dst.Type()))
+		return nil
+	case src.Kind() == reflect.String || src.Kind() == reflect.Bool || isNumberKind(src.Kind()):
+		return fmt.Errorf("can not assign %s to %s", src.Type(), dst.Type())
+	}
+	data, er := json.Marshal(v)
+	if er != nil {
+		return er
+	}
+	return json.Unmarshal(data, dst.Addr().Interface())
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
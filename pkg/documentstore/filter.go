@@ -0,0 +1,519 @@
+package documentstore
+
+import (
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Filter - умова в стилі MongoDB, наприклад
+//
+//	Filter{"age": Filter{"$gte": 18}, "address.city": "Kyiv", "$or": []Filter{{"admin": true}, {"tags": "vip"}}}
+//
+// Ключі - шляхи до полів через крапку або логічні оператори $and, $or, $nor, $not.
+// Значення поля - саме значення (неявний $eq) або мапа операторів
+// $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex (з $options), $not.
+// Якщо поле - масив, умова виконується, коли їй відповідає хоча б один елемент.
+type Filter map[string]any
+
+// predicate перевіряє документ на відповідність скомпільованому фільтру
+type predicate func(doc Document) bool
+
+// valuePredicate перевіряє значення поля; exists == false, якщо шляху в документі немає
+type valuePredicate func(v any, exists bool) bool
+
+// Find повертає документи, що відповідають фільтру, в порядку первинного ключа.
+// Планувальник обирає між повним переглядом колекції та одним з індексів, див. Explain.
+func (s *Collection) Find(filter Filter) ([]Document, error) {
+	match, er := compileFilter(filter)
+	if er != nil {
+		return nil, er
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched, _, er := s.execute(s.planQuery(filter), match)
+	if er != nil {
+		return nil, er
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].key < matched[j].key })
+	docs := make([]Document, len(matched))
+	for i, f := range matched {
+		docs[i] = f.doc.clone()
+	}
+	return docs, nil
+}
+
+// filterRanges перетворює умову на поле в діапазони індексу; межі включні,
+// точну перевірку ($gt проти $gte) все одно робить сам фільтр
+func filterRanges(cond any) ([]QueryParams, bool) {
+	ops, isOps := operatorMap(cond)
+	if !isOps {
+		if !isIndexable(cond) {
+			return nil, false
+		}
+		return []QueryParams{{MinValue: cond, MaxValue: cond}}, true
+	}
+	var params QueryParams
+	var in []any
+	for op, operand := range ops {
+		switch op {
+		case "$eq":
+			if !isIndexable(operand) {
+				return nil, false
+			}
+			params.MinValue, params.MaxValue = operand, operand
+		case "$gt", "$gte":
+			if !isIndexable(operand) {
+				return nil, false
+			}
+			params.MinValue = operand
+		case "$lt", "$lte":
+			if !isIndexable(operand) {
+				return nil, false
+			}
+			params.MaxValue = operand
+		case "$in":
+			values, ok := sliceValues(operand)
+			if !ok {
+				return nil, false
+			}
+			for _, v := range values {
+				if !isIndexable(v) {
+					return nil, false
+				}
+			}
+			in = values
+		}
+	}
+	if in != nil {
+		if params.MinValue != nil || params.MaxValue != nil {
+			return nil, false
+		}
+		ranges := make([]QueryParams, 0, len(in))
+		for _, v := range in {
+			ranges = append(ranges, QueryParams{MinValue: v, MaxValue: v})
+		}
+		return ranges, true
+	}
+	if params.MinValue == nil && params.MaxValue == nil {
+		return nil, false
+	}
+	return []QueryParams{params}, true
+}
+
+func isIndexable(v any) bool {
+	switch normalizeValue(v).(type) {
+	case string, bool, int64, float64:
+		return true
+	}
+	return false
+}
+
+func compileFilter(filter Filter) (predicate, error) {
+	preds := make([]predicate, 0, len(filter))
+	for key, cond := range filter {
+		var pred predicate
+		var er error
+		switch key {
+		case "$and", "$or", "$nor":
+			pred, er = compileLogical(key, cond)
+		case "$not":
+			sub, ok := asMap(cond)
+			if !ok {
+				return nil, fmt.Errorf("%w: $not expects a filter", err.ErrInvalidFilter)
+			}
+			var inner predicate
+			if inner, er = compileFilter(sub); er == nil {
+				pred = func(doc Document) bool { return !inner(doc) }
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("%w: unknown operator %s", err.ErrInvalidFilter, key)
+			}
+			var vp valuePredicate
+			if vp, er = compileCondition(cond); er == nil {
+				path := key
+				pred = func(doc Document) bool {
+					v, exists := lookupPath(doc, path)
+					return vp(v, exists)
+				}
+			}
+		}
+		if er != nil {
+			return nil, er
+		}
+		preds = append(preds, pred)
+	}
+	return func(doc Document) bool {
+		for _, pred := range preds {
+			if !pred(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, cond any) (predicate, error) {
+	items, ok := sliceValues(cond)
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("%w: %s expects a non-empty list of filters", err.ErrInvalidFilter, op)
+	}
+	preds := make([]predicate, 0, len(items))
+	for _, item := range items {
+		sub, ok := asMap(item)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s expects a list of filters", err.ErrInvalidFilter, op)
+		}
+		pred, er := compileFilter(sub)
+		if er != nil {
+			return nil, er
+		}
+		preds = append(preds, pred)
+	}
+	return func(doc Document) bool {
+		for _, pred := range preds {
+			matched := pred(doc)
+			switch {
+			case op == "$and" && !matched:
+				return false
+			case op == "$or" && matched:
+				return true
+			case op == "$nor" && matched:
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+// compileCondition компілює умову на одне поле: значення або мапу операторів
+func compileCondition(cond any) (valuePredicate, error) {
+	ops, ok := operatorMap(cond)
+	if !ok {
+		return eqPredicate(cond), nil
+	}
+	preds := make([]valuePredicate, 0, len(ops))
+	for op, operand := range ops {
+		var pred valuePredicate
+		switch op {
+		case "$eq":
+			pred = eqPredicate(operand)
+		case "$ne":
+			eq := eqPredicate(operand)
+			pred = func(v any, exists bool) bool { return !eq(v, exists) }
+		case "$gt", "$gte", "$lt", "$lte":
+			pred = comparePredicate(op, operand)
+		case "$in", "$nin":
+			values, ok := sliceValues(operand)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s expects a list", err.ErrInvalidFilter, op)
+			}
+			eqs := make([]valuePredicate, 0, len(values))
+			for _, value := range values {
+				eqs = append(eqs, eqPredicate(value))
+			}
+			in := func(v any, exists bool) bool {
+				for _, eq := range eqs {
+					if eq(v, exists) {
+						return true
+					}
+				}
+				return false
+			}
+			pred = in
+			if op == "$nin" {
+				pred = func(v any, exists bool) bool { return !in(v, exists) }
+			}
+		case "$exists":
+			want, ok := operand.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%w: $exists expects a bool", err.ErrInvalidFilter)
+			}
+			pred = func(_ any, exists bool) bool { return exists == want }
+		case "$regex":
+			re, er := compileRegex(operand, ops["$options"])
+			if er != nil {
+				return nil, er
+			}
+			pred = func(v any, exists bool) bool {
+				return exists && anyElement(v, func(elem any) bool {
+					str, ok := elem.(string)
+					return ok && re.MatchString(str)
+				})
+			}
+		case "$options":
+			if _, ok := ops["$regex"]; !ok {
+				return nil, fmt.Errorf("%w: $options without $regex", err.ErrInvalidFilter)
+			}
+			continue
+		case "$not":
+			inner, er := compileCondition(operand)
+			if er != nil {
+				return nil, er
+			}
+			pred = func(v any, exists bool) bool { return !inner(v, exists) }
+		default:
+			return nil, fmt.Errorf("%w: unknown operator %s", err.ErrInvalidFilter, op)
+		}
+		preds = append(preds, pred)
+	}
+	return func(v any, exists bool) bool {
+		for _, pred := range preds {
+			if !pred(v, exists) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func eqPredicate(operand any) valuePredicate {
+	if re, ok := operand.(*regexp.Regexp); ok {
+		return func(v any, exists bool) bool {
+			return exists && anyElement(v, func(elem any) bool {
+				str, ok := elem.(string)
+				return ok && re.MatchString(str)
+			})
+		}
+	}
+	want := normalizeValue(operand)
+	if want == nil {
+		// Як і в MongoDB, {"field": nil} відповідає також документам без поля
+		return func(v any, exists bool) bool { return !exists || v == nil }
+	}
+	return func(v any, exists bool) bool {
+		if !exists {
+			return false
+		}
+		if valuesEqual(v, want) {
+			return true
+		}
+		return anyElement(v, func(elem any) bool { return valuesEqual(elem, want) })
+	}
+}
+
+func comparePredicate(op string, operand any) valuePredicate {
+	want := normalizeValue(operand)
+	return func(v any, exists bool) bool {
+		return exists && anyElement(v, func(elem any) bool {
+			elem = normalizeValue(elem)
+			if !isScalar(elem) || valueRank(elem) != valueRank(want) {
+				return false
+			}
+			c := compareValues(elem, want)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		})
+	}
+}
+
+func compileRegex(pattern, options any) (*regexp.Regexp, error) {
+	if re, ok := pattern.(*regexp.Regexp); ok {
+		return re, nil
+	}
+	expr, ok := pattern.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: $regex expects a string", err.ErrInvalidFilter)
+	}
+	if options != nil {
+		flags, ok := options.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: $options expects a string", err.ErrInvalidFilter)
+		}
+		if flags != "" {
+			expr = "(?" + flags + ")" + expr
+		}
+	}
+	re, er := regexp.Compile(expr)
+	if er != nil {
+		return nil, fmt.Errorf("%w: %v", err.ErrInvalidFilter, er)
+	}
+	return re, nil
+}
+
+// operatorMap повертає умову як мапу операторів, якщо всі її ключі починаються з "$"
+func operatorMap(cond any) (map[string]any, bool) {
+	m, ok := asMap(cond)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func asMap(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case Filter:
+		return m, true
+	case map[string]any:
+		return m, true
+	}
+	return nil, false
+}
+
+// sliceValues повертає елементи будь-якого зрізу чи масиву як []any
+func sliceValues(v any) ([]any, bool) {
+	if list, ok := v.([]any); ok {
+		return list, true
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+		return nil, false
+	}
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
+
+// anyElement застосовує fn до значення, а якщо це масив - до кожного його елемента
+func anyElement(v any, fn func(any) bool) bool {
+	if _, isBytes := v.([]byte); !isBytes {
+		if list, ok := sliceValues(v); ok {
+			for _, elem := range list {
+				if fn(elem) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return fn(v)
+}
+
+// lookupPath повертає значення за шляхом через крапку, заходячи у вкладені об'єкти та масиви
+func lookupPath(doc Document, path string) (any, bool) {
+	segments := strings.Split(path, ".")
+	field, ok := doc.Fields[segments[0]]
+	if !ok {
+		return nil, false
+	}
+	cur := field.Value
+	for _, segment := range segments[1:] {
+		if cur, ok = child(cur, segment); !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func child(v any, name string) (any, bool) {
+	switch val := v.(type) {
+	case nil:
+		return nil, false
+	case map[string]any:
+		c, ok := val[name]
+		return c, ok
+	case map[string]DocumentField:
+		c, ok := val[name]
+		return c.Value, ok
+	case DocumentField:
+		return child(val.Value, name)
+	case Document:
+		c, ok := val.Fields[name]
+		return c.Value, ok
+	case *Document:
+		if val == nil {
+			return nil, false
+		}
+		c, ok := val.Fields[name]
+		return c.Value, ok
+	}
+	if list, ok := sliceValues(v); ok {
+		if i, er := strconv.Atoi(name); er == nil {
+			if i < 0 || i >= len(list) {
+				return nil, false
+			}
+			return list[i], true
+		}
+		// Шлях через масив об'єктів збирає значення з кожного елемента
+		var values []any
+		for _, elem := range list {
+			if c, ok := child(elem, name); ok {
+				values = append(values, c)
+			}
+		}
+		return values, len(values) > 0
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.Name == name || tag == name {
+				return rv.Field(i).Interface(), true
+			}
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			c := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+			if c.IsValid() {
+				return c.Interface(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// normalizeValue приводить числа до int64/float64, щоб 5, int64(5) і 5.0 вважались рівними
+func normalizeValue(v any) any {
+	if n, ok := normalizeNumber(v); ok {
+		return n
+	}
+	return v
+}
+
+func isScalar(v any) bool {
+	r := valueRank(v)
+	return r >= 1 && r <= 3
+}
+
+func valuesEqual(a, b any) bool {
+	a, b = normalizeValue(a), normalizeValue(b)
+	if isScalar(a) || isScalar(b) {
+		return valueRank(a) == valueRank(b) && compareValues(a, b) == 0
+	}
+	if la, ok := sliceValues(a); ok {
+		lb, ok := sliceValues(b)
+		if !ok || len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !valuesEqual(la[i], lb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
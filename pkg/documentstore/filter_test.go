@@ -0,0 +1,119 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+type filterTestAddress struct {
+	City string `json:"city"`
+	Zip  int
+}
+
+var filterTestDocuments = []map[string]DocumentField{
+	{
+		"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+		"name":    {Type: DocumentFieldTypeString, Value: "Andrii"},
+		"age":     {Type: DocumentFieldTypeNumber, Value: 32},
+		"admin":   {Type: DocumentFieldTypeBool, Value: true},
+		"tags":    {Type: DocumentFieldTypeArray, Value: []string{"go", "vip"}},
+		"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv", "zip": int64(1001)}},
+	},
+	{
+		"id":      {Type: DocumentFieldTypeString, Value: "u2"},
+		"name":    {Type: DocumentFieldTypeString, Value: "Taras"},
+		"age":     {Type: DocumentFieldTypeNumber, Value: int64(17)},
+		"admin":   {Type: DocumentFieldTypeBool, Value: false},
+		"tags":    {Type: DocumentFieldTypeArray, Value: []any{"rust"}},
+		"address": {Type: DocumentFieldTypeObject, Value: filterTestAddress{City: "Lviv", Zip: 79000}},
+	},
+	{
+		"id":   {Type: DocumentFieldTypeString, Value: "u3"},
+		"name": {Type: DocumentFieldTypeString, Value: "Roman"},
+		"age":  {Type: DocumentFieldTypeNumber, Value: 45.5},
+		"orders": {Type: DocumentFieldTypeArray, Value: []any{
+			map[string]any{"sku": "a1", "qty": int64(2)},
+			map[string]any{"sku": "b7", "qty": int64(5)},
+		}},
+	},
+	{
+		"id":   {Type: DocumentFieldTypeString, Value: "u4"},
+		"name": {Type: DocumentFieldTypeString, Value: "stepan"},
+		"age":  {Type: DocumentFieldTypeString, Value: "unknown"},
+	},
+}
+
+func filterTestIDs(docs []Document) []string {
+	ids := indexTestIDs(docs)
+	sort.Strings(ids)
+	return ids
+}
+
+func TestCollection_Find(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		want    []string
+		wantErr error
+	}{
+		{name: "empty filter", filter: Filter{}, want: []string{"u1", "u2", "u3", "u4"}},
+		{name: "implicit eq", filter: Filter{"name": "Taras"}, want: []string{"u2"}},
+		{name: "eq number of other go type", filter: Filter{"age": Filter{"$eq": 32.0}}, want: []string{"u1"}},
+		{name: "ne", filter: Filter{"admin": Filter{"$ne": true}}, want: []string{"u2", "u3", "u4"}},
+		{name: "gt and lte", filter: Filter{"age": Filter{"$gt": 17, "$lte": 45.5}}, want: []string{"u1", "u3"}},
+		{name: "comparison ignores other types", filter: Filter{"age": Filter{"$gte": 0}}, want: []string{"u1", "u2", "u3"}},
+		{name: "lt on strings", filter: Filter{"name": Filter{"$lt": "S"}}, want: []string{"u1", "u3"}},
+		{name: "in", filter: Filter{"name": Filter{"$in": []string{"Roman", "Taras", "Nobody"}}}, want: []string{"u2", "u3"}},
+		{name: "nin", filter: Filter{"name": Filter{"$nin": []any{"Roman", "Taras"}}}, want: []string{"u1", "u4"}},
+		{name: "exists", filter: Filter{"admin": Filter{"$exists": true}}, want: []string{"u1", "u2"}},
+		{name: "not exists", filter: Filter{"admin": Filter{"$exists": false}}, want: []string{"u3", "u4"}},
+		{name: "eq nil matches missing", filter: Filter{"tags": nil}, want: []string{"u3", "u4"}},
+		{name: "array contains", filter: Filter{"tags": "vip"}, want: []string{"u1"}},
+		{name: "whole array", filter: Filter{"tags": []string{"rust"}}, want: []string{"u2"}},
+		{name: "array element by position", filter: Filter{"tags.1": "vip"}, want: []string{"u1"}},
+		{name: "nested map", filter: Filter{"address.city": "Kyiv"}, want: []string{"u1"}},
+		{name: "nested struct by json tag", filter: Filter{"address.city": "Lviv"}, want: []string{"u2"}},
+		{name: "nested struct by field name", filter: Filter{"address.Zip": Filter{"$gt": 2000}}, want: []string{"u2"}},
+		{name: "array of objects", filter: Filter{"orders.sku": "b7"}, want: []string{"u3"}},
+		{name: "array of objects range", filter: Filter{"orders.qty": Filter{"$gte": 5}}, want: []string{"u3"}},
+		{name: "regex", filter: Filter{"name": Filter{"$regex": "^[RS]"}}, want: []string{"u3"}},
+		{name: "regex with options", filter: Filter{"name": Filter{"$regex": "^s", "$options": "i"}}, want: []string{"u4"}},
+		{name: "regexp value", filter: Filter{"tags": regexp.MustCompile("^ru")}, want: []string{"u2"}},
+		{name: "and", filter: Filter{"$and": []Filter{{"age": Filter{"$gt": 20}}, {"admin": true}}}, want: []string{"u1"}},
+		{name: "or", filter: Filter{"$or": []any{map[string]any{"name": "Taras"}, Filter{"address.city": "Kyiv"}}}, want: []string{"u1", "u2"}},
+		{name: "nor", filter: Filter{"$nor": []Filter{{"name": "Taras"}, {"admin": true}}}, want: []string{"u3", "u4"}},
+		{name: "not filter", filter: Filter{"$not": Filter{"age": Filter{"$lt": 40}}}, want: []string{"u3", "u4"}},
+		{name: "not operator", filter: Filter{"age": Filter{"$not": Filter{"$lt": 40}}}, want: []string{"u3", "u4"}},
+		{name: "unknown operator", filter: Filter{"age": Filter{"$near": 1}}, wantErr: err.ErrInvalidFilter},
+		{name: "unknown logical operator", filter: Filter{"$xor": []Filter{}}, wantErr: err.ErrInvalidFilter},
+		{name: "bad regex", filter: Filter{"name": Filter{"$regex": "("}}, wantErr: err.ErrInvalidFilter},
+		{name: "in without list", filter: Filter{"name": Filter{"$in": "Taras"}}, wantErr: err.ErrInvalidFilter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scan := testCollection(t, filterTestDocuments)
+			indexed := testCollection(t, filterTestDocuments,
+				IndexDefinition{Fields: []string{"name"}},
+				IndexDefinition{Fields: []string{"age"}, IndexOptions: IndexOptions{Type: DocumentFieldTypeNumber}},
+				IndexDefinition{Fields: []string{"admin"}, IndexOptions: IndexOptions{Type: DocumentFieldTypeBool}},
+			)
+
+			for name, s := range map[string]*Collection{"scan": scan, "index": indexed} {
+				docs, er := s.Find(tt.filter)
+				if !errors.Is(er, tt.wantErr) {
+					t.Fatalf("%s: Find() error = %v, wantErr %v", name, er, tt.wantErr)
+				}
+				if tt.wantErr != nil {
+					continue
+				}
+				if got := filterTestIDs(docs); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: Find() = %v, want %v", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
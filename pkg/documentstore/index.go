@@ -0,0 +1,424 @@
+package documentstore
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"math"
+	"sort"
+	"strings"
+)
+
+type TypeMismatchPolicy int
+
+const (
+	TypeMismatchSkip  TypeMismatchPolicy = iota // документ з полем іншого типу просто не потрапляє в індекс
+	TypeMismatchError                           // Put такого документа завершується помилкою
+)
+
+type IndexOptions struct {
+	Type           DocumentFieldType   `json:"type,omitempty"`             // Тип значень індексу, за замовчуванням string
+	Types          []DocumentFieldType `json:"types,omitempty"`            // Типи кожного поля складеного індексу, якщо вони різні
+	OnTypeMismatch TypeMismatchPolicy  `json:"on_type_mismatch,omitempty"` // Що робити з документом, поле якого має інший тип
+	Unique         bool                `json:"unique,omitempty"`           // Значення не можуть повторюватись; документи без поля не перевіряються
+}
+
+// IndexDefinition описує індекс у дампі та журналі; самі дані індексу перебудовуються при завантаженні
+type IndexDefinition struct {
+	Fields []string `json:"fields"`
+	IndexOptions
+}
+
+// UnmarshalJSON приймає також визначення з дампів версії 1, де індекс мав лише одне поле "field"
+func (d *IndexDefinition) UnmarshalJSON(data []byte) error {
+	type definition IndexDefinition
+	var raw struct {
+		definition
+		Field string `json:"field"`
+	}
+	if er := json.Unmarshal(data, &raw); er != nil {
+		return er
+	}
+	*d = IndexDefinition(raw.definition)
+	if len(d.Fields) == 0 && raw.Field != "" {
+		d.Fields = []string{raw.Field}
+	}
+	return nil
+}
+
+// indexName - ім'я індексу, під яким його шукають Query та DeleteIndex: поле або поля через кому
+func indexName(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+type Index struct {
+	Name           string
+	Fields         []string
+	Types          []DocumentFieldType
+	OnTypeMismatch TypeMismatchPolicy
+	Unique         bool
+	Entries        []IndexEntry        // відсортовані за ключем для швидкого запиту
+	Uncovered      map[string]struct{} // документи з першим полем індексу, які не потрапили в Entries через тип чи відсутні поля
+}
+
+type IndexEntry struct {
+	Key []any               // значення полів індексу в порядку Fields
+	IDs map[string]struct{} // set of document IDs
+}
+
+func newIndex(def IndexDefinition) (*Index, error) {
+	if len(def.Fields) == 0 {
+		return nil, errors.New("index must have at least one field")
+	}
+	types := def.Types
+	if len(types) == 0 {
+		t := def.Type
+		if t == "" {
+			t = DocumentFieldTypeString
+		}
+		types = make([]DocumentFieldType, len(def.Fields))
+		for i := range types {
+			types[i] = t
+		}
+	}
+	if len(types) != len(def.Fields) {
+		return nil, fmt.Errorf("index on %d fields has %d types", len(def.Fields), len(types))
+	}
+	for _, t := range types {
+		switch t {
+		case DocumentFieldTypeString, DocumentFieldTypeNumber, DocumentFieldTypeBool:
+		default:
+			return nil, fmt.Errorf("%w: %s", err.ErrUnsupportedIndexType, t)
+		}
+	}
+	return &Index{
+		Name:           indexName(def.Fields),
+		Fields:         append([]string(nil), def.Fields...),
+		Types:          types,
+		OnTypeMismatch: def.OnTypeMismatch,
+		Unique:         def.Unique,
+		Entries:        []IndexEntry{},
+		Uncovered:      map[string]struct{}{},
+	}, nil
+}
+
+func (idx *Index) definition() IndexDefinition {
+	return IndexDefinition{
+		Fields: append([]string(nil), idx.Fields...),
+		IndexOptions: IndexOptions{
+			Types:          append([]DocumentFieldType(nil), idx.Types...),
+			OnTypeMismatch: idx.OnTypeMismatch,
+			Unique:         idx.Unique,
+		},
+	}
+}
+
+// key повертає нормалізовані значення полів документа, за якими будується індекс.
+// ok == false означає, що документ в індекс не потрапляє: одного з полів немає або воно іншого типу.
+func (idx *Index) key(doc Document) ([]any, bool, error) {
+	key := make([]any, len(idx.Fields))
+	for i, name := range idx.Fields {
+		field, exists := doc.Fields[name]
+		if !exists {
+			return nil, false, nil
+		}
+		val, ok := indexValue(field.Value, idx.Types[i])
+		if field.Type != idx.Types[i] || !ok {
+			if idx.OnTypeMismatch == TypeMismatchError {
+				return nil, false, fmt.Errorf("%w: field %s must be %s, got %s", err.ErrIndexTypeMismatch, name, idx.Types[i], field.Type)
+			}
+			return nil, false, nil
+		}
+		key[i] = val
+	}
+	return key, true, nil
+}
+
+// check перевіряє, що документ з ключем id можна записати в індекс:
+// тип полів відповідає індексу, а для унікального індексу значення не зайняте іншим документом
+func (idx *Index) check(id string, doc Document) error {
+	key, ok, er := idx.key(doc)
+	if er != nil || !ok || !idx.Unique {
+		return er
+	}
+	pos, exists := idx.find(key)
+	if !exists {
+		return nil
+	}
+	for other := range idx.Entries[pos].IDs {
+		if other != id {
+			return &err.DuplicateKeyError{Index: idx.Name, Value: displayKey(key), DocumentID: other}
+		}
+	}
+	return nil
+}
+
+// displayKey повертає ключ індексу для повідомлень: саме значення для індексу по одному полю
+func displayKey(key []any) any {
+	if len(key) == 1 {
+		return key[0]
+	}
+	return key
+}
+
+// bound перевіряє, що значення з запиту має тип i-го поля індексу
+func (idx *Index) bound(i int, v any) (any, error) {
+	val, ok := indexValue(v, idx.Types[i])
+	if !ok {
+		return nil, fmt.Errorf("%w: bound %v (%T) for %s field %s of index %s", err.ErrIndexTypeMismatch, v, v, idx.Types[i], idx.Fields[i], idx.Name)
+	}
+	return val, nil
+}
+
+// lowerBound повертає позицію першого запису, префікс ключа якого не менший за bound
+func (idx *Index) lowerBound(bound []any) int {
+	return sort.Search(len(idx.Entries), func(i int) bool { return comparePrefix(idx.Entries[i].Key, bound) >= 0 })
+}
+
+// upperBound повертає позицію першого запису, префікс ключа якого більший за bound
+func (idx *Index) upperBound(bound []any) int {
+	return sort.Search(len(idx.Entries), func(i int) bool { return comparePrefix(idx.Entries[i].Key, bound) > 0 })
+}
+
+// find повертає позицію запису з ключем key та чи існує він
+func (idx *Index) find(key []any) (int, bool) {
+	pos := idx.lowerBound(key)
+	return pos, pos < len(idx.Entries) && comparePrefix(idx.Entries[pos].Key, key) == 0
+}
+
+// add додає документ в індекс, вставляючи новий ключ бінарним пошуком
+func (idx *Index) add(id string, doc Document) {
+	key, ok, _ := idx.key(doc)
+	if !ok {
+		if _, exists := doc.Fields[idx.Fields[0]]; exists {
+			idx.Uncovered[id] = struct{}{}
+		}
+		return
+	}
+	pos, exists := idx.find(key)
+	if !exists {
+		idx.Entries = append(idx.Entries, IndexEntry{})
+		copy(idx.Entries[pos+1:], idx.Entries[pos:])
+		idx.Entries[pos] = IndexEntry{Key: key, IDs: map[string]struct{}{}}
+	}
+	idx.Entries[pos].IDs[id] = struct{}{}
+}
+
+// remove прибирає документ з індексу; записи без документів видаляються
+func (idx *Index) remove(id string, doc Document) {
+	delete(idx.Uncovered, id)
+	key, ok, _ := idx.key(doc)
+	if !ok {
+		return
+	}
+	pos, exists := idx.find(key)
+	if !exists {
+		return
+	}
+	delete(idx.Entries[pos].IDs, id)
+	if len(idx.Entries[pos].IDs) == 0 {
+		idx.Entries = append(idx.Entries[:pos], idx.Entries[pos+1:]...)
+	}
+}
+
+// rangeOf повертає межі [lo, hi) записів, що відповідають параметрам запиту
+func (idx *Index) rangeOf(params QueryParams) (int, int, error) {
+	if len(params.Equal) > len(idx.Fields) {
+		return 0, 0, fmt.Errorf("index %s has %d fields, got %d equality values", idx.Name, len(idx.Fields), len(params.Equal))
+	}
+	prefix := make([]any, 0, len(params.Equal)+1)
+	for i, v := range params.Equal {
+		val, er := idx.bound(i, v)
+		if er != nil {
+			return 0, 0, er
+		}
+		prefix = append(prefix, val)
+	}
+	if (params.MinValue != nil || params.MaxValue != nil) && len(prefix) == len(idx.Fields) {
+		return 0, 0, fmt.Errorf("index %s has no field left for a range after %d equality values", idx.Name, len(prefix))
+	}
+
+	// Межі діапазону знаходимо бінарним пошуком по відсортованих ключах
+	lo, hi := idx.lowerBound(prefix), idx.upperBound(prefix)
+	if params.MinValue != nil {
+		min, er := idx.bound(len(prefix), params.MinValue)
+		if er != nil {
+			return 0, 0, er
+		}
+		lo = idx.lowerBound(append(prefix[:len(prefix):len(prefix)], min))
+	}
+	if params.MaxValue != nil {
+		max, er := idx.bound(len(prefix), params.MaxValue)
+		if er != nil {
+			return 0, 0, er
+		}
+		hi = idx.upperBound(append(prefix[:len(prefix):len(prefix)], max))
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi, nil
+}
+
+// comparePrefix порівнює перші len(bound) значень ключа з bound
+func comparePrefix(key, bound []any) int {
+	for i := range bound {
+		if c := compareValues(key[i], bound[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// indexValue приводить значення до канонічного вигляду для індексу заданого типу:
+// рядки - string, булеві - bool, числа - int64 для цілих і float64 для дробових,
+// щоб однакові числа різних Go-типів давали однаковий ключ індексу.
+func indexValue(v any, t DocumentFieldType) (any, bool) {
+	switch t {
+	case DocumentFieldTypeString:
+		s, ok := v.(string)
+		return s, ok
+	case DocumentFieldTypeBool:
+		b, ok := v.(bool)
+		return b, ok
+	case DocumentFieldTypeNumber:
+		return normalizeNumber(v)
+	}
+	return nil, false
+}
+
+func normalizeNumber(v any) (any, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return normalizeFloat(float64(n), n <= math.MaxInt64, int64(n))
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return normalizeFloat(float64(n), n <= math.MaxInt64, int64(n))
+	case float32:
+		return normalizeFloat(float64(n), false, 0)
+	case float64:
+		return normalizeFloat(n, false, 0)
+	}
+	return nil, false
+}
+
+func normalizeFloat(f float64, isInt bool, i int64) (any, bool) {
+	if isInt {
+		return i, true
+	}
+	if math.IsNaN(f) {
+		return nil, false
+	}
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f), true
+	}
+	return f, true
+}
+
+// compareValues порівнює нормалізовані значення: спершу за типом (bool < число < рядок), потім за значенням
+func compareValues(a, b any) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(av, b.(string))
+	case int64:
+		if bv, ok := b.(int64); ok {
+			switch {
+			case av < bv:
+				return -1
+			case av > bv:
+				return 1
+			}
+			return 0
+		}
+		if bv, ok := b.(float64); ok {
+			return compareIntFloat(av, bv)
+		}
+	case float64:
+		if bv, ok := b.(int64); ok {
+			return -compareIntFloat(bv, av)
+		}
+	}
+	return compareFloats(toFloat(a), toFloat(b))
+}
+
+// compareIntFloat порівнює int64 з float64 точно: через float64 цілі, більші за 2^53, втрачали б молодші біти
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return compareFloats(float64(i), f)
+	case f >= 0x1p63:
+		return -1
+	case f < -0x1p63:
+		return 1
+	}
+	// Тут f в межах int64, тож його ціла частина точно стає int64
+	whole := math.Trunc(f)
+	if c := cmp.Compare(i, int64(whole)); c != 0 {
+		return c
+	}
+	return compareFloats(whole, f)
+}
+
+func valueRank(v any) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int64, float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+func toFloat(v any) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
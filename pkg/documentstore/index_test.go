@@ -0,0 +1,420 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"errors"
+	"lesson4/pkg/err"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// indexTestDocuments перетворює значення поля "value" за ідентифікаторами на документи
+func indexTestDocuments(values map[string]DocumentField) []map[string]DocumentField {
+	docs := make([]map[string]DocumentField, 0, len(values))
+	for id, field := range values {
+		docs = append(docs, map[string]DocumentField{
+			"id":    {Type: DocumentFieldTypeString, Value: id},
+			"value": field,
+		})
+	}
+	return docs
+}
+
+func indexTestIDs(docs []Document) []string {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.Fields["id"].Value.(string))
+	}
+	return ids
+}
+
+func TestCollection_QueryTypedIndex(t *testing.T) {
+	numbers := map[string]DocumentField{
+		"a": {Type: DocumentFieldTypeNumber, Value: 10},
+		"b": {Type: DocumentFieldTypeNumber, Value: int64(9)},
+		"c": {Type: DocumentFieldTypeNumber, Value: 100.5},
+		"d": {Type: DocumentFieldTypeNumber, Value: -3},
+		"e": {Type: DocumentFieldTypeString, Value: "11"},
+	}
+	big := map[string]DocumentField{
+		"a": {Type: DocumentFieldTypeNumber, Value: int64(math.MaxInt64)},
+		"b": {Type: DocumentFieldTypeNumber, Value: int64(1<<53 + 1)},
+		"c": {Type: DocumentFieldTypeNumber, Value: 0.5},
+	}
+	bools := map[string]DocumentField{
+		"a": {Type: DocumentFieldTypeBool, Value: true},
+		"b": {Type: DocumentFieldTypeBool, Value: false},
+	}
+	tests := []struct {
+		name    string
+		values  map[string]DocumentField
+		opts    IndexOptions
+		params  QueryParams
+		want    []string
+		wantErr error
+	}{
+		{
+			name:   "numbers are ordered numerically",
+			values: numbers,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+			want:   []string{"d", "b", "a", "c"},
+		},
+		{
+			name:   "number range with bounds of different numeric types",
+			values: numbers,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+			params: QueryParams{MinValue: 9.5, MaxValue: int64(100)},
+			want:   []string{"a"},
+		},
+		{
+			name:   "number range descending",
+			values: numbers,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+			params: QueryParams{MinValue: 0, Desc: true},
+			want:   []string{"c", "a", "b"},
+		},
+		{
+			name:   "float bound beyond int64 range",
+			values: big,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+			params: QueryParams{MinValue: 0x1p63},
+			want:   []string{},
+		},
+		{
+			name:   "large integers with float bounds",
+			values: big,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+			params: QueryParams{MinValue: 0.25, MaxValue: 1e300},
+			want:   []string{"c", "b", "a"},
+		},
+		{
+			name:   "bools are ordered false first",
+			values: bools,
+			opts:   IndexOptions{Type: DocumentFieldTypeBool},
+			want:   []string{"b", "a"},
+		},
+		{
+			name:   "bool equality",
+			values: bools,
+			opts:   IndexOptions{Type: DocumentFieldTypeBool},
+			params: QueryParams{MinValue: true, MaxValue: true},
+			want:   []string{"a"},
+		},
+		{
+			name:    "bound of wrong type",
+			values:  numbers,
+			opts:    IndexOptions{Type: DocumentFieldTypeNumber},
+			params:  QueryParams{MinValue: "10"},
+			wantErr: err.ErrIndexTypeMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, indexTestDocuments(tt.values))
+			if er := s.CreateIndexWithOptions("value", tt.opts); er != nil {
+				t.Fatal(er)
+			}
+			docs, er := s.Query("value", tt.params)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("Query() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got := indexTestIDs(docs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareValues_IntFloat(t *testing.T) {
+	tests := []struct {
+		a, b any
+		want int
+	}{
+		{int64(1<<53 + 1), float64(1 << 53), 1},
+		{float64(1 << 53), int64(1<<53 + 1), -1},
+		{int64(1 << 53), float64(1 << 53), 0},
+		{int64(math.MaxInt64), 0x1p63, -1},
+		{int64(math.MinInt64), -0x1p63, 0},
+		{int64(math.MinInt64), math.Inf(-1), 1},
+		{int64(2), 2.5, -1},
+		{int64(-2), -2.5, 1},
+		{int64(-3), -2.5, -1},
+	}
+	for _, tt := range tests {
+		if got := compareValues(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCollection_IndexTypeMismatchPolicy(t *testing.T) {
+	mixed := map[string]DocumentField{
+		"a": {Type: DocumentFieldTypeNumber, Value: 1},
+		"b": {Type: DocumentFieldTypeString, Value: "two"},
+	}
+	tests := []struct {
+		name    string
+		values  map[string]DocumentField
+		opts    IndexOptions
+		wantErr error
+	}{
+		{
+			name:   "skip policy ignores documents of other types",
+			values: mixed,
+			opts:   IndexOptions{Type: DocumentFieldTypeNumber},
+		},
+		{
+			name:    "error policy rejects existing documents",
+			values:  mixed,
+			opts:    IndexOptions{Type: DocumentFieldTypeNumber, OnTypeMismatch: TypeMismatchError},
+			wantErr: err.ErrIndexTypeMismatch,
+		},
+		{
+			name:    "arrays can not be indexed",
+			opts:    IndexOptions{Type: DocumentFieldTypeArray},
+			wantErr: err.ErrUnsupportedIndexType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, indexTestDocuments(tt.values))
+			if er := s.CreateIndexWithOptions("value", tt.opts); !errors.Is(er, tt.wantErr) {
+				t.Errorf("CreateIndexWithOptions() error = %v, wantErr %v", er, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("error policy rejects Put", func(t *testing.T) {
+		s := testCollection(t, indexTestDocuments(nil))
+		s.CreateIndexWithOptions("value", IndexOptions{Type: DocumentFieldTypeNumber, OnTypeMismatch: TypeMismatchError})
+		er := s.Put(Document{Fields: map[string]DocumentField{
+			"id":    {Type: DocumentFieldTypeString, Value: "x"},
+			"value": {Type: DocumentFieldTypeBool, Value: true},
+		}})
+		if !errors.Is(er, err.ErrIndexTypeMismatch) {
+			t.Errorf("Put() error = %v, want %v", er, err.ErrIndexTypeMismatch)
+		}
+		if _, er := s.Get("x"); er == nil {
+			t.Errorf("rejected document was stored")
+		}
+	})
+}
+
+func TestCollection_QueryCompoundIndex(t *testing.T) {
+	order := func(id, status string, created int) Document {
+		return Document{Fields: map[string]DocumentField{
+			"id":      {Type: DocumentFieldTypeString, Value: id},
+			"status":  {Type: DocumentFieldTypeString, Value: status},
+			"created": {Type: DocumentFieldTypeNumber, Value: created},
+		}}
+	}
+	tests := []struct {
+		name    string
+		params  QueryParams
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "whole index in key order",
+			want: []string{"o5", "o1", "o3", "o2", "o4"},
+		},
+		{
+			name:   "equality on leading field",
+			params: QueryParams{Equal: []any{"active"}},
+			want:   []string{"o1", "o3", "o2"},
+		},
+		{
+			name:   "equality plus range on next field",
+			params: QueryParams{Equal: []any{"active"}, MinValue: 15, MaxValue: 30},
+			want:   []string{"o3", "o2"},
+		},
+		{
+			name:   "equality plus range descending",
+			params: QueryParams{Equal: []any{"active"}, MaxValue: 20, Desc: true},
+			want:   []string{"o3", "o1"},
+		},
+		{
+			name:   "equality on all fields",
+			params: QueryParams{Equal: []any{"closed", 5}},
+			want:   []string{"o4"},
+		},
+		{
+			name:   "range on leading field",
+			params: QueryParams{MinValue: "b"},
+			want:   []string{"o4"},
+		},
+		{
+			name:    "equality value of wrong type",
+			params:  QueryParams{Equal: []any{"active", "20"}},
+			wantErr: true,
+		},
+		{
+			name:    "range after all fields",
+			params:  QueryParams{Equal: []any{"active", 20}, MinValue: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+			s.Put(order("o1", "active", 10))
+			s.Put(order("o2", "active", 30))
+			s.Put(order("o4", "closed", 5))
+			if er := s.CreateCompoundIndex([]string{"status", "created"}, IndexOptions{
+				Types: []DocumentFieldType{DocumentFieldTypeString, DocumentFieldTypeNumber},
+			}); er != nil {
+				t.Fatal(er)
+			}
+			// Документи, додані після створення індексу, теж мають бути в ньому
+			s.Put(order("o3", "active", 20))
+			s.Put(order("o5", "abandoned", 1))
+			s.Put(order("o6", "closed", 7))
+			s.Delete("o6")
+
+			docs, er := s.Query("status,created", tt.params)
+			if (er != nil) != tt.wantErr {
+				t.Fatalf("Query() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := indexTestIDs(docs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexDefinition_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want IndexDefinition
+	}{
+		{
+			name: "version 1 single field",
+			data: `{"field":"age","type":"int"}`,
+			want: IndexDefinition{Fields: []string{"age"}, IndexOptions: IndexOptions{Type: DocumentFieldTypeNumber}},
+		},
+		{
+			name: "compound",
+			data: `{"fields":["status","created"],"types":["string","int"]}`,
+			want: IndexDefinition{Fields: []string{"status", "created"}, IndexOptions: IndexOptions{
+				Types: []DocumentFieldType{DocumentFieldTypeString, DocumentFieldTypeNumber},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got IndexDefinition
+			if er := json.Unmarshal([]byte(tt.data), &got); er != nil {
+				t.Fatal(er)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshalJSON() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollection_UniqueIndex(t *testing.T) {
+	user := func(id, email string) Document {
+		return Document{Fields: map[string]DocumentField{
+			"id":    {Type: DocumentFieldTypeString, Value: id},
+			"email": {Type: DocumentFieldTypeString, Value: email},
+		}}
+	}
+	tests := []struct {
+		name      string
+		existing  []Document
+		put       Document
+		wantErr   error
+		wantOwner string
+	}{
+		{
+			name:     "new value",
+			existing: []Document{user("u1", "a@x.com")},
+			put:      user("u2", "b@x.com"),
+		},
+		{
+			name:      "value used by another document",
+			existing:  []Document{user("u1", "a@x.com")},
+			put:       user("u2", "a@x.com"),
+			wantErr:   err.ErrDuplicateKey,
+			wantOwner: "u1",
+		},
+		{
+			name:     "overwrite of the same document keeps its value",
+			existing: []Document{user("u1", "a@x.com")},
+			put:      user("u1", "a@x.com"),
+		},
+		{
+			name:     "document without the field",
+			existing: []Document{{Fields: map[string]DocumentField{"id": {Type: DocumentFieldTypeString, Value: "u1"}}}},
+			put:      Document{Fields: map[string]DocumentField{"id": {Type: DocumentFieldTypeString, Value: "u2"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+			for _, doc := range tt.existing {
+				s.Put(doc)
+			}
+			if er := s.CreateIndexWithOptions("email", IndexOptions{Unique: true}); er != nil {
+				t.Fatal(er)
+			}
+			er := s.Put(tt.put)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("Put() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			var dup *err.DuplicateKeyError
+			if !errors.As(er, &dup) || dup.DocumentID != tt.wantOwner || dup.Index != "email" {
+				t.Errorf("Put() error = %#v, want conflict with %s", er, tt.wantOwner)
+			}
+			if doc, _ := s.Get(tt.put.Fields["id"].Value.(string)); doc != nil {
+				t.Errorf("conflicting document was stored")
+			}
+		})
+	}
+
+	t.Run("create over existing duplicates", func(t *testing.T) {
+		s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+		s.Put(user("u1", "a@x.com"))
+		s.Put(user("u2", "a@x.com"))
+		er := s.CreateIndexWithOptions("email", IndexOptions{Unique: true})
+		var dup *err.DuplicateKeyError
+		if !errors.As(er, &dup) || dup.DocumentID != "u1" {
+			t.Fatalf("CreateIndexWithOptions() error = %v, want duplicate of u1", er)
+		}
+		if _, er := s.Query("email", QueryParams{}); er == nil {
+			t.Errorf("failed unique index was registered")
+		}
+	})
+
+	t.Run("value is released after delete", func(t *testing.T) {
+		s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+		s.CreateIndexWithOptions("email", IndexOptions{Unique: true})
+		s.Put(user("u1", "a@x.com"))
+		s.Delete("u1")
+		if er := s.Put(user("u2", "a@x.com")); er != nil {
+			t.Errorf("Put() error = %v", er)
+		}
+	})
+}
+
+func TestCollection_CreateIndexNestedPath(t *testing.T) {
+	s := testCollection(t, indexTestDocuments(map[string]DocumentField{"u1": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv"}}}))
+	if er := s.CreateIndex("value.city"); !errors.Is(er, err.ErrInvalidCollectionConfig) {
+		t.Errorf("CreateIndex() on nested path error = %v, want %v", er, err.ErrInvalidCollectionConfig)
+	}
+	if er := s.CreateCompoundIndex([]string{"id", "value.city"}, IndexOptions{}); !errors.Is(er, err.ErrInvalidCollectionConfig) {
+		t.Errorf("CreateCompoundIndex() on nested path error = %v, want %v", er, err.ErrInvalidCollectionConfig)
+	}
+}
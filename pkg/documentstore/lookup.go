@@ -0,0 +1,74 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"lesson4/pkg/err"
+)
+
+// LookupStage додає до кожного документа поле As з масивом документів колекції From
+// того ж стору, у яких ForeignField дорівнює LocalField. Якщо LocalField - масив, підходить
+// будь-який його елемент; якщо поля немає - документи, де немає ForeignField.
+// Документи From шукаються через Find, тож індекс на ForeignField буде використано.
+type LookupStage struct {
+	From         string
+	LocalField   string
+	ForeignField string
+	As           string
+}
+
+func (l LookupStage) run(docs []Document, coll *Collection) ([]Document, error) {
+	if l.From == "" || l.LocalField == "" || l.ForeignField == "" || l.As == "" {
+		return nil, fmt.Errorf("%w: lookup needs from, local field, foreign field and as", err.ErrInvalidPipeline)
+	}
+	coll.mu.RLock()
+	store := coll.store
+	coll.mu.RUnlock()
+	if store == nil {
+		return nil, fmt.Errorf("%w: collection %q does not belong to a store", err.ErrCollectionNotFound, coll.name)
+	}
+	foreign, er := store.GetCollection(l.From)
+	if er != nil {
+		return nil, fmt.Errorf("lookup %s: %w", l.From, er)
+	}
+
+	// Багато документів посилаються на ті самі значення, тож кожне шукаємо один раз
+	found := map[string][]Document{}
+	out := make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		values := l.localValues(doc)
+		key, er := json.Marshal(values)
+		if er != nil {
+			return nil, fmt.Errorf("%w: lookup value: %v", err.ErrInvalidPipeline, er)
+		}
+		matches, ok := found[string(key)]
+		if !ok {
+			if matches, er = foreign.Find(l.foreignFilter(values)); er != nil {
+				return nil, er
+			}
+			found[string(key)] = matches
+		}
+		embedded := make([]any, 0, len(matches))
+		for _, m := range matches {
+			embedded = append(embedded, documentFields(m.Fields))
+		}
+		out = append(out, withPath(doc, l.As, embedded))
+	}
+	return out, nil
+}
+
+func (l LookupStage) localValues(doc Document) []any {
+	v, ok := lookupPath(doc, l.LocalField)
+	if list, isList := sliceValues(v); ok && isList {
+		values := make([]any, len(list))
+		for i, elem := range list {
+			values[i] = normalizeValue(elem)
+		}
+		return values
+	}
+	return []any{normalizeValue(v)}
+}
+
+func (l LookupStage) foreignFilter(values []any) Filter {
+	return Filter{l.ForeignField: Filter{"$in": values}}
+}
@@ -0,0 +1,145 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+)
+
+func lookupTestStore(t *testing.T, indexed bool) *Store {
+	t.Helper()
+	s := NewStore()
+	_, users := s.CreateCollection("users", "id")
+	_, orders := s.CreateCollection("orders", "id")
+	_, products := s.CreateCollection("products", "sku")
+	put := func(c *Collection, fields map[string]DocumentField) {
+		if er := c.Put(Document{Fields: fields}); er != nil {
+			t.Fatal(er)
+		}
+	}
+	str := func(v string) DocumentField { return DocumentField{Type: DocumentFieldTypeString, Value: v} }
+
+	put(users, map[string]DocumentField{"id": str("u1"), "name": str("Andrii")})
+	put(users, map[string]DocumentField{"id": str("u2"), "name": str("Taras")})
+	put(users, map[string]DocumentField{"id": str("u3"), "name": str("Roman")})
+	put(orders, map[string]DocumentField{"id": str("o1"), "user": str("u1"),
+		"items": {Type: DocumentFieldTypeArray, Value: []any{"p1", "p2"}}})
+	put(orders, map[string]DocumentField{"id": str("o2"), "user": str("u2"),
+		"items": {Type: DocumentFieldTypeArray, Value: []any{"p2"}}})
+	put(orders, map[string]DocumentField{"id": str("o3"), "user": str("u1"),
+		"items": {Type: DocumentFieldTypeArray, Value: []any{}}})
+	put(products, map[string]DocumentField{"sku": str("p1"), "price": {Type: DocumentFieldTypeNumber, Value: int64(10)}})
+	put(products, map[string]DocumentField{"sku": str("p2"), "price": {Type: DocumentFieldTypeNumber, Value: int64(25)}})
+
+	if indexed {
+		orders.CreateIndex("user")
+	}
+	return s
+}
+
+func TestCollection_AggregateLookup(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection string
+		stages     []Stage
+		want       []map[string]any
+		wantErr    error
+	}{
+		{
+			name:       "one to many",
+			collection: "users",
+			stages: []Stage{
+				LookupStage{From: "orders", LocalField: "id", ForeignField: "user", As: "orders"},
+				ProjectStage{Projection: Projection{Include: []string{"orders.id"}}},
+			},
+			want: []map[string]any{
+				{"id": "u1", "orders": []any{map[string]any{"id": "o1"}, map[string]any{"id": "o3"}}},
+				{"id": "u2", "orders": []any{map[string]any{"id": "o2"}}},
+				{"id": "u3", "orders": []any{}},
+			},
+		},
+		{
+			name:       "local array field",
+			collection: "orders",
+			stages: []Stage{
+				LookupStage{From: "products", LocalField: "items", ForeignField: "sku", As: "products"},
+				GroupStage{By: []string{"id"}, Fields: map[string]Accumulator{"prices": {Op: AccumulatorPush, Field: "products.price"}}},
+			},
+			want: []map[string]any{
+				{"_id": "o1", "prices": []any{[]any{int64(10), int64(25)}}},
+				{"_id": "o2", "prices": []any{[]any{int64(25)}}},
+				{"_id": "o3", "prices": []any{}},
+			},
+		},
+		{
+			name:       "lookup into nested field and filter on it",
+			collection: "orders",
+			stages: []Stage{
+				LookupStage{From: "users", LocalField: "user", ForeignField: "id", As: "meta.user"},
+				MatchStage{Filter: Filter{"meta.user.name": "Andrii"}},
+				ProjectStage{Projection: Projection{Include: []string{"meta"}}},
+			},
+			want: []map[string]any{
+				{"id": "o1", "meta": map[string]any{"user": []any{map[string]any{"id": "u1", "name": "Andrii"}}}},
+				{"id": "o3", "meta": map[string]any{"user": []any{map[string]any{"id": "u1", "name": "Andrii"}}}},
+			},
+		},
+		{
+			name:       "unknown collection",
+			collection: "users",
+			stages:     []Stage{LookupStage{From: "nope", LocalField: "id", ForeignField: "user", As: "x"}},
+			wantErr:    err.ErrCollectionNotFound,
+		},
+		{
+			name:       "missing field names",
+			collection: "users",
+			stages:     []Stage{LookupStage{From: "orders"}},
+			wantErr:    err.ErrInvalidPipeline,
+		},
+	}
+	for _, tt := range tests {
+		for _, indexed := range []bool{false, true} {
+			t.Run(tt.name, func(t *testing.T) {
+				coll, _ := lookupTestStore(t, indexed).GetCollection(tt.collection)
+				got, er := coll.Aggregate(tt.stages...)
+				if !errors.Is(er, tt.wantErr) {
+					t.Fatalf("Aggregate() error = %v, wantErr %v", er, tt.wantErr)
+				}
+				if tt.wantErr != nil {
+					return
+				}
+				if values := aggregateTestValues(got); !reflect.DeepEqual(values, tt.want) {
+					t.Errorf("Aggregate() = %v, want %v", values, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestLookupStage_UsesForeignIndex(t *testing.T) {
+	s := lookupTestStore(t, true)
+	users, _ := s.GetCollection("users")
+	orders, _ := s.GetCollection("orders")
+	doc, _ := users.Get("u2")
+
+	l := LookupStage{From: "orders", LocalField: "id", ForeignField: "user", As: "orders"}
+	got, er := orders.Explain(l.foreignFilter(l.localValues(*doc)))
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got.Stage != PlanIndexScan || got.Index != "user" || got.DocsExamined != 1 {
+		t.Errorf("Explain() = %s %q, examined %d; want IXSCAN on user, examined 1", got.Stage, got.Index, got.DocsExamined)
+	}
+}
+
+func TestLookupStage_DeletedCollection(t *testing.T) {
+	s := lookupTestStore(t, false)
+	users, _ := s.GetCollection("users")
+	s.DeleteCollection("users")
+
+	_, er := users.Aggregate(LookupStage{From: "orders", LocalField: "id", ForeignField: "user", As: "orders"})
+	if !errors.Is(er, err.ErrCollectionNotFound) {
+		t.Errorf("Aggregate() error = %v, want %v", er, err.ErrCollectionNotFound)
+	}
+}
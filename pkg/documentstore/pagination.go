@@ -0,0 +1,174 @@
+package documentstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"sort"
+)
+
+// SortField задає поле сортування; шлях може бути вкладеним, як у Filter
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+type FindOptions struct {
+	Sort   []SortField // порядок результатів; первинний ключ завжди останній критерій
+	Skip   int         // скільки документів пропустити (після курсора, якщо він є)
+	Limit  int         // 0 - без обмеження
+	Cursor string      // Page.NextCursor попередньої сторінки
+
+	Projection Projection // які поля документів повертати, порожня - всі
+}
+
+// Page - сторінка результатів; NextCursor порожній, якщо далі документів немає
+type Page struct {
+	Documents  []Document
+	NextCursor string
+}
+
+// cursor запам'ятовує позицію останнього документа сторінки, а не його номер,
+// тому вставки та видалення не зсувають наступні сторінки
+type cursor struct {
+	Sort   []SortField `json:"s,omitempty"`
+	Values []any       `json:"v,omitempty"`
+	Key    string      `json:"k"`
+}
+
+// FindPage повертає сторінку документів, що відповідають фільтру, в порядку opts.Sort
+func (s *Collection) FindPage(filter Filter, opts FindOptions) (*Page, error) {
+	match, er := compileFilter(filter)
+	if er != nil {
+		return nil, er
+	}
+	proj, er := compileProjection(opts.Projection)
+	if er != nil {
+		return nil, er
+	}
+	var after *cursor
+	if opts.Cursor != "" {
+		if after, er = decodeCursor(opts.Cursor, opts.Sort); er != nil {
+			return nil, er
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched, _, er := s.execute(s.planQuery(filter), match)
+	if er != nil {
+		return nil, er
+	}
+	rows := make([]cursor, len(matched))
+	docs := make(map[string]Document, len(matched))
+	for i, f := range matched {
+		rows[i] = cursor{Values: documentSortValues(f.doc, opts.Sort), Key: f.key}
+		docs[f.key] = f.doc
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compareRows(rows[i], rows[j], opts.Sort) < 0
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(rows), func(i int) bool {
+			return compareRows(rows[i], *after, opts.Sort) > 0
+		})
+	}
+	start = min(start+max(opts.Skip, 0), len(rows))
+	end := len(rows)
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, len(rows))
+	}
+
+	page := &Page{Documents: make([]Document, 0, end-start)}
+	for _, row := range rows[start:end] {
+		page.Documents = append(page.Documents, proj.apply(docs[row.Key], s.config.PrimaryKey))
+	}
+	if end < len(rows) {
+		last := rows[end-1]
+		last.Sort = opts.Sort
+		page.NextCursor = encodeCursor(last)
+	}
+	return page, nil
+}
+
+// ListPage повертає сторінку всіх документів колекції
+func (s *Collection) ListPage(opts FindOptions) (*Page, error) {
+	return s.FindPage(Filter{}, opts)
+}
+
+// compareRows порівнює документи за полями сортування, а при рівності - за первинним ключем.
+// Відсутнє поле вважається nil і йде першим, як і в індексах.
+func compareRows(a, b cursor, fields []SortField) int {
+	if c := compareSortValues(a.Values, b.Values, fields); c != 0 {
+		return c
+	}
+	switch {
+	case a.Key < b.Key:
+		return -1
+	case a.Key > b.Key:
+		return 1
+	}
+	return 0
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor перевіряє, що курсор створено для того самого сортування
+func decodeCursor(s string, fields []SortField) (*cursor, error) {
+	data, er := base64.RawURLEncoding.DecodeString(s)
+	if er != nil {
+		return nil, fmt.Errorf("%w: %v", err.ErrInvalidCursor, er)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var c cursor
+	if er := decoder.Decode(&c); er != nil {
+		return nil, fmt.Errorf("%w: %v", err.ErrInvalidCursor, er)
+	}
+	if len(c.Sort) != len(fields) || (len(fields) > 0 && !reflect.DeepEqual(c.Sort, fields)) {
+		return nil, fmt.Errorf("%w: cursor was created for another sort order", err.ErrInvalidCursor)
+	}
+	if len(c.Values) != len(fields) {
+		return nil, fmt.Errorf("%w: expected %d sort values, got %d", err.ErrInvalidCursor, len(fields), len(c.Values))
+	}
+	for i, v := range c.Values {
+		c.Values[i] = normalizeValue(normalizeNumbers(v))
+	}
+	return &c, nil
+}
+
+func compareSortValues(a, b []any, fields []SortField) int {
+	for i, f := range fields {
+		c := compareValues(a[i], b[i])
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// documentSortValues повертає значення полів сортування документа; відсутні поля - nil
+func documentSortValues(doc Document, fields []SortField) []any {
+	if len(fields) == 0 {
+		return nil
+	}
+	values := make([]any, len(fields))
+	for i, f := range fields {
+		if v, ok := lookupPath(doc, f.Field); ok {
+			values[i] = normalizeValue(v)
+		}
+	}
+	return values
+}
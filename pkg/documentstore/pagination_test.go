@@ -0,0 +1,181 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+)
+
+var paginationTestDocuments = func() []map[string]DocumentField {
+	docs := make([]map[string]DocumentField, 0, 10)
+	for i := 0; i < 10; i++ {
+		fields := map[string]DocumentField{
+			"id":    {Type: DocumentFieldTypeString, Value: fmt.Sprintf("d%d", i)},
+			"group": {Type: DocumentFieldTypeNumber, Value: i % 3},
+		}
+		if i%4 != 0 {
+			fields["name"] = DocumentField{Type: DocumentFieldTypeString, Value: fmt.Sprintf("n%d", 9-i)}
+		}
+		docs = append(docs, fields)
+	}
+	return docs
+}()
+
+// paginationTestAll проходить усі сторінки за курсорами, викликаючи between між сторінками
+func paginationTestAll(t *testing.T, s *Collection, filter Filter, opts FindOptions, between func()) [][]string {
+	t.Helper()
+	var pages [][]string
+	for i := 0; i < 20; i++ {
+		page, er := s.FindPage(filter, opts)
+		if er != nil {
+			t.Fatal(er)
+		}
+		pages = append(pages, indexTestIDs(page.Documents))
+		if page.NextCursor == "" {
+			return pages
+		}
+		// Як і клієнт API, Skip передаємо лише для першої сторінки
+		opts.Cursor, opts.Skip = page.NextCursor, 0
+		if between != nil {
+			between()
+		}
+	}
+	t.Fatal("FindPage() does not stop returning cursors")
+	return nil
+}
+
+func TestCollection_FindPage(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		opts   FindOptions
+		want   [][]string
+	}{
+		{
+			name: "primary key order by default",
+			opts: FindOptions{Limit: 4},
+			want: [][]string{{"d0", "d1", "d2", "d3"}, {"d4", "d5", "d6", "d7"}, {"d8", "d9"}},
+		},
+		{
+			name: "exact last page has no cursor",
+			opts: FindOptions{Limit: 5},
+			want: [][]string{{"d0", "d1", "d2", "d3", "d4"}, {"d5", "d6", "d7", "d8", "d9"}},
+		},
+		{
+			name: "ties are broken by primary key",
+			opts: FindOptions{Sort: []SortField{{Field: "group"}}, Limit: 3},
+			want: [][]string{{"d0", "d3", "d6"}, {"d9", "d1", "d4"}, {"d7", "d2", "d5"}, {"d8"}},
+		},
+		{
+			name: "descending sort",
+			opts: FindOptions{Sort: []SortField{{Field: "group", Desc: true}}, Limit: 4},
+			want: [][]string{{"d2", "d5", "d8", "d1"}, {"d4", "d7", "d0", "d3"}, {"d6", "d9"}},
+		},
+		{
+			name: "missing field goes first",
+			opts: FindOptions{Sort: []SortField{{Field: "name"}}, Limit: 5},
+			want: [][]string{{"d0", "d4", "d8", "d9", "d7"}, {"d6", "d5", "d3", "d2", "d1"}},
+		},
+		{
+			name:   "filter with skip",
+			filter: Filter{"group": 1},
+			opts:   FindOptions{Skip: 1, Limit: 1},
+			want:   [][]string{{"d4"}, {"d7"}},
+		},
+		{
+			name: "skip past the end",
+			opts: FindOptions{Skip: 20, Limit: 5},
+			want: [][]string{{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginationTestAll(t, testCollection(t, paginationTestDocuments), tt.filter, tt.opts, nil)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindPage() pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollection_FindPageCursorStability(t *testing.T) {
+	s := testCollection(t, paginationTestDocuments)
+	opts := FindOptions{Sort: []SortField{{Field: "group"}}, Limit: 3}
+
+	step := 0
+	got := paginationTestAll(t, s, Filter{}, opts, func() {
+		step++
+		if step != 1 {
+			return
+		}
+		// Видалення вже повернутого та ще не повернутого документа і вставки з обох боків курсора
+		s.Delete("d3")
+		s.Delete("d4")
+		for _, doc := range []struct {
+			id    string
+			group int
+		}{{"a0", 0}, {"z1", 1}} {
+			s.Put(Document{Fields: map[string]DocumentField{
+				"id":    {Type: DocumentFieldTypeString, Value: doc.id},
+				"group": {Type: DocumentFieldTypeNumber, Value: doc.group},
+			}})
+		}
+	})
+	want := [][]string{{"d0", "d3", "d6"}, {"d9", "d1", "d7"}, {"z1", "d2", "d5"}, {"d8"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindPage() pages = %v, want %v", got, want)
+	}
+}
+
+func TestCollection_FindPageInvalidCursor(t *testing.T) {
+	s := testCollection(t, paginationTestDocuments)
+	page, er := s.FindPage(Filter{}, FindOptions{Sort: []SortField{{Field: "group"}}, Limit: 2})
+	if er != nil {
+		t.Fatal(er)
+	}
+
+	tests := []struct {
+		name string
+		opts FindOptions
+	}{
+		{name: "not base64", opts: FindOptions{Cursor: "***"}},
+		{name: "not json", opts: FindOptions{Cursor: "bm90IGpzb24"}},
+		{name: "other sort order", opts: FindOptions{Cursor: page.NextCursor, Sort: []SortField{{Field: "group", Desc: true}}}},
+		{name: "sort order dropped", opts: FindOptions{Cursor: page.NextCursor}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, er := s.FindPage(Filter{}, tt.opts); !errors.Is(er, err.ErrInvalidCursor) {
+				t.Errorf("FindPage() error = %v, want %v", er, err.ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestCollection_QueryLimit(t *testing.T) {
+	s := testCollection(t, paginationTestDocuments)
+	s.CreateIndexWithOptions("group", IndexOptions{Type: DocumentFieldTypeNumber})
+
+	tests := []struct {
+		name   string
+		params QueryParams
+		want   []string
+	}{
+		{name: "equal values by primary key", params: QueryParams{Limit: 5}, want: []string{"d0", "d3", "d6", "d9", "d1"}},
+		{name: "skip", params: QueryParams{Skip: 8}, want: []string{"d5", "d8"}},
+		{name: "desc", params: QueryParams{Desc: true, Limit: 4}, want: []string{"d8", "d5", "d2", "d7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, er := s.Query("group", tt.params)
+			if er != nil {
+				t.Fatal(er)
+			}
+			if got := indexTestIDs(docs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
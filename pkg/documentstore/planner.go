@@ -0,0 +1,288 @@
+package documentstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PlanStage string
+
+const (
+	PlanCollectionScan PlanStage = "COLLSCAN" // перегляд усіх документів колекції
+	PlanIndexScan      PlanStage = "IXSCAN"   // перегляд діапазонів індексу
+)
+
+// indexScanThreshold - якщо індекс відбирає більшу частку колекції, повний перегляд дешевший,
+// бо кожен кандидат з індексу - це ще й окремий пошук документа
+const indexScanThreshold = 0.7
+
+type PlanCandidate struct {
+	Index         string // ім'я індексу
+	EstimatedDocs int    // скільки документів, за оцінкою, доведеться перевірити через цей індекс
+}
+
+// Explanation описує обраний план запиту та статистику його виконання
+type Explanation struct {
+	Stage        PlanStage
+	Index        string          // індекс обраного плану, порожній для COLLSCAN
+	Reason       string          // чому обрано саме цей план
+	Candidates   []PlanCandidate // індекси, які розглядав планувальник
+	KeysExamined int             // переглянуті ключі індексу
+	DocsExamined int             // документи, перевірені фільтром
+	DocsReturned int
+}
+
+type queryPlan struct {
+	stage      PlanStage
+	index      *Index
+	ranges     []QueryParams
+	reason     string
+	candidates []PlanCandidate
+}
+
+// Explain виконує запит і повертає обраний план разом зі статистикою виконання
+func (s *Collection) Explain(filter Filter) (*Explanation, error) {
+	match, er := compileFilter(filter)
+	if er != nil {
+		return nil, er
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, explanation, er := s.execute(s.planQuery(filter), match)
+	if er != nil {
+		return nil, er
+	}
+	return &explanation, nil
+}
+
+// planQuery оцінює кожен індекс, придатний для фільтру, і обирає найвибірковіший;
+// якщо навіть він відбирає більшу частину колекції, обирається повний перегляд
+func (s *Collection) planQuery(filter Filter) queryPlan {
+	conds := fieldConditions(filter)
+	total := s.storage().Len()
+
+	var best *queryPlan
+	var bestEstimate int
+	var candidates []PlanCandidate
+	for _, index := range s.sortedIndexes() {
+		ranges, ok := indexRanges(index, conds)
+		if !ok {
+			continue
+		}
+		estimate, ok := index.estimate(ranges)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, PlanCandidate{Index: index.Name, EstimatedDocs: estimate})
+		if best == nil || estimate < bestEstimate {
+			best = &queryPlan{stage: PlanIndexScan, index: index, ranges: ranges}
+			bestEstimate = estimate
+		}
+	}
+
+	switch {
+	case best == nil:
+		return queryPlan{stage: PlanCollectionScan, reason: "no index matches the filter"}
+	case float64(bestEstimate) > indexScanThreshold*float64(total):
+		return queryPlan{
+			stage:      PlanCollectionScan,
+			reason:     fmt.Sprintf("best index %s selects %d of %d documents, full scan is cheaper", best.index.Name, bestEstimate, total),
+			candidates: candidates,
+		}
+	}
+	best.reason = fmt.Sprintf("index %s selects %d of %d documents", best.index.Name, bestEstimate, total)
+	best.candidates = candidates
+	return *best
+}
+
+// found - документ, відібраний планом запиту; doc ще не скопійований
+type found struct {
+	key string
+	doc Document
+}
+
+// execute виконує план і повертає відповідні документи;
+// документи з індексу все одно перевіряються повним фільтром
+func (s *Collection) execute(plan queryPlan, match predicate) ([]found, Explanation, error) {
+	explanation := Explanation{
+		Stage:      plan.stage,
+		Reason:     plan.reason,
+		Candidates: plan.candidates,
+	}
+	var result []found
+	now := time.Now()
+	examine := func(id string, doc Document) {
+		if doc.expired(now) {
+			return
+		}
+		explanation.DocsExamined++
+		if match(doc) {
+			result = append(result, found{key: id, doc: doc})
+		}
+	}
+
+	if plan.stage == PlanCollectionScan {
+		er := s.storage().Scan("", func(id string, doc Document) bool {
+			examine(id, doc)
+			return true
+		})
+		if er != nil {
+			return nil, Explanation{}, er
+		}
+		explanation.DocsReturned = len(result)
+		return result, explanation, nil
+	}
+
+	var readErr error
+	check := func(id string) {
+		doc, exists, er := s.storage().Get(id)
+		if er != nil {
+			readErr = er
+		} else if exists {
+			examine(id, doc)
+		}
+	}
+
+	explanation.Index = plan.index.Name
+	seen := map[string]struct{}{}
+	for _, params := range plan.ranges {
+		lo, hi, _ := plan.index.rangeOf(params)
+		for i := lo; i < hi; i++ {
+			explanation.KeysExamined++
+			for _, id := range sortedIDs(plan.index.Entries[i].IDs) {
+				if _, dup := seen[id]; !dup {
+					seen[id] = struct{}{}
+					check(id)
+				}
+			}
+		}
+	}
+	// Документи, що не потрапили в індекс через тип поля, теж можуть відповідати фільтру
+	for _, id := range sortedIDs(plan.index.Uncovered) {
+		if _, dup := seen[id]; !dup {
+			check(id)
+		}
+	}
+	if readErr != nil {
+		return nil, Explanation{}, readErr
+	}
+	explanation.DocsReturned = len(result)
+	return result, explanation, nil
+}
+
+// estimate рахує документи в діапазонах індексу разом з Uncovered.
+// ok == false, якщо межі не мають типу індексу і індекс використати не можна.
+func (idx *Index) estimate(ranges []QueryParams) (int, bool) {
+	count := len(idx.Uncovered)
+	for _, params := range ranges {
+		lo, hi, er := idx.rangeOf(params)
+		if er != nil {
+			return 0, false
+		}
+		for i := lo; i < hi; i++ {
+			count += len(idx.Entries[i].IDs)
+		}
+	}
+	return count, true
+}
+
+func sortedIDs(set map[string]struct{}) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fieldConditions збирає умови на поля верхнього рівня, зокрема з гілок $and,
+// бо кожна з них обмежує результат і може бути звужена індексом
+func fieldConditions(filter Filter) map[string][]any {
+	conds := map[string][]any{}
+	var walk func(f map[string]any)
+	walk = func(f map[string]any) {
+		for key, cond := range f {
+			switch {
+			case key == "$and":
+				items, _ := sliceValues(cond)
+				for _, item := range items {
+					if sub, ok := asMap(item); ok {
+						walk(sub)
+					}
+				}
+			case strings.HasPrefix(key, "$"):
+			default:
+				conds[key] = append(conds[key], cond)
+			}
+		}
+	}
+	walk(filter)
+	return conds
+}
+
+// indexRanges будує діапазони індексу з умов фільтру: точні значення на перших полях
+// і діапазон або $in на наступному. ok == false, якщо на першому полі індексу умов немає.
+func indexRanges(index *Index, conds map[string][]any) ([]QueryParams, bool) {
+	var prefix []any
+	for i, field := range index.Fields {
+		var point any
+		var ranges []QueryParams
+		for _, cond := range conds[field] {
+			r, ok := filterRanges(cond)
+			if !ok || !boundsMatch(index, i, r) {
+				continue
+			}
+			if len(r) == 1 && isPoint(r[0]) {
+				point = r[0].MinValue
+				break
+			}
+			if ranges == nil {
+				ranges = r
+			}
+		}
+		if point != nil {
+			prefix = append(prefix, point)
+			continue
+		}
+		if ranges == nil {
+			break
+		}
+		out := make([]QueryParams, 0, len(ranges))
+		for _, r := range ranges {
+			equal := append([]any(nil), prefix...)
+			if isPoint(r) {
+				out = append(out, QueryParams{Equal: append(equal, r.MinValue)})
+				continue
+			}
+			out = append(out, QueryParams{Equal: equal, MinValue: r.MinValue, MaxValue: r.MaxValue})
+		}
+		return out, true
+	}
+	if len(prefix) == 0 {
+		return nil, false
+	}
+	return []QueryParams{{Equal: prefix}}, true
+}
+
+func isPoint(r QueryParams) bool {
+	return r.MinValue != nil && r.MaxValue != nil && valuesEqual(r.MinValue, r.MaxValue)
+}
+
+// boundsMatch перевіряє, що всі межі мають тип i-го поля індексу
+func boundsMatch(index *Index, i int, ranges []QueryParams) bool {
+	for _, r := range ranges {
+		for _, v := range []any{r.MinValue, r.MaxValue} {
+			if v == nil {
+				continue
+			}
+			if _, er := index.bound(i, v); er != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
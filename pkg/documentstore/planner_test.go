@@ -0,0 +1,138 @@
+package documentstore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var plannerTestDocuments = func() []map[string]DocumentField {
+	docs := make([]map[string]DocumentField, 0, 100)
+	for i := 0; i < 100; i++ {
+		docs = append(docs, map[string]DocumentField{
+			"id":     {Type: DocumentFieldTypeString, Value: fmt.Sprintf("d%03d", i)},
+			"age":    {Type: DocumentFieldTypeNumber, Value: i},
+			"status": {Type: DocumentFieldTypeString, Value: fmt.Sprintf("s%d", i%5)},
+		})
+	}
+	return docs
+}()
+
+var plannerTestIndexes = []IndexDefinition{
+	{Fields: []string{"age"}, IndexOptions: IndexOptions{Type: DocumentFieldTypeNumber}},
+	{Fields: []string{"status"}},
+	{Fields: []string{"status", "age"}, IndexOptions: IndexOptions{
+		Types: []DocumentFieldType{DocumentFieldTypeString, DocumentFieldTypeNumber},
+	}},
+}
+
+func TestCollection_Explain(t *testing.T) {
+	tests := []struct {
+		name             string
+		filter           Filter
+		wantStage        PlanStage
+		wantIndex        string
+		wantKeys         int
+		wantDocsExamined int
+		wantReturned     int
+	}{
+		{
+			name:             "no index on field",
+			filter:           Filter{"id": "d001"},
+			wantStage:        PlanCollectionScan,
+			wantDocsExamined: 100,
+			wantReturned:     1,
+		},
+		{
+			name:             "selective range",
+			filter:           Filter{"age": Filter{"$gt": 95}},
+			wantStage:        PlanIndexScan,
+			wantIndex:        "age",
+			wantKeys:         5,
+			wantDocsExamined: 5,
+			wantReturned:     4,
+		},
+		{
+			name:             "unselective range falls back to scan",
+			filter:           Filter{"age": Filter{"$gte": 10}},
+			wantStage:        PlanCollectionScan,
+			wantDocsExamined: 100,
+			wantReturned:     90,
+		},
+		{
+			name:             "compound index beats single field indexes",
+			filter:           Filter{"status": "s1", "age": Filter{"$lt": 20}},
+			wantStage:        PlanIndexScan,
+			wantIndex:        "status,age",
+			wantKeys:         4,
+			wantDocsExamined: 4,
+			wantReturned:     4,
+		},
+		{
+			name:             "conditions inside $and",
+			filter:           Filter{"$and": []Filter{{"status": "s2"}, {"age": Filter{"$in": []int{2, 3, 7, 12}}}}},
+			wantStage:        PlanIndexScan,
+			wantIndex:        "status,age",
+			wantKeys:         3,
+			wantDocsExamined: 3,
+			wantReturned:     3,
+		},
+		{
+			name:             "in on single field",
+			filter:           Filter{"age": Filter{"$in": []any{1, 50, 500}}},
+			wantStage:        PlanIndexScan,
+			wantIndex:        "age",
+			wantKeys:         2,
+			wantDocsExamined: 2,
+			wantReturned:     2,
+		},
+		{
+			name:             "bound of other type can not use index",
+			filter:           Filter{"age": "10"},
+			wantStage:        PlanCollectionScan,
+			wantDocsExamined: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, plannerTestDocuments, plannerTestIndexes...)
+			got, er := s.Explain(tt.filter)
+			if er != nil {
+				t.Fatal(er)
+			}
+			if got.Stage != tt.wantStage || got.Index != tt.wantIndex {
+				t.Errorf("Explain() plan = %s %q, want %s %q (%s)", got.Stage, got.Index, tt.wantStage, tt.wantIndex, got.Reason)
+			}
+			if got.KeysExamined != tt.wantKeys || got.DocsExamined != tt.wantDocsExamined || got.DocsReturned != tt.wantReturned {
+				t.Errorf("Explain() keys/examined/returned = %d/%d/%d, want %d/%d/%d",
+					got.KeysExamined, got.DocsExamined, got.DocsReturned, tt.wantKeys, tt.wantDocsExamined, tt.wantReturned)
+			}
+			if got.Reason == "" {
+				t.Errorf("Explain() has no reason")
+			}
+
+			// План не повинен змінювати результат запиту
+			docs, _ := s.Find(tt.filter)
+			want, _ := testCollection(t, plannerTestDocuments).Find(tt.filter)
+			if !reflect.DeepEqual(filterTestIDs(docs), filterTestIDs(want)) {
+				t.Errorf("Find() = %v, want %v", filterTestIDs(docs), filterTestIDs(want))
+			}
+		})
+	}
+}
+
+func TestCollection_ExplainCandidates(t *testing.T) {
+	s := testCollection(t, plannerTestDocuments, plannerTestIndexes...)
+	got, er := s.Explain(Filter{"status": "s1", "age": Filter{"$lt": 20}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	want := []PlanCandidate{
+		{Index: "age", EstimatedDocs: 21},
+		{Index: "status", EstimatedDocs: 20},
+		{Index: "status,age", EstimatedDocs: 4},
+	}
+	if !reflect.DeepEqual(got.Candidates, want) {
+		t.Errorf("Explain() candidates = %v, want %v", got.Candidates, want)
+	}
+}
@@ -0,0 +1,271 @@
+package documentstore
+
+import (
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Projection визначає, які поля документа повертати. Шляхи можуть бути вкладеними ("address.city").
+// Include залишає лише перелічені поля і первинний ключ, Exclude прибирає перелічені поля.
+// Порожня проекція повертає документ повністю; задати обидва списки одночасно не можна.
+type Projection struct {
+	Include []string
+	Exclude []string
+}
+
+// projectionNode - дерево шляхів проекції; nil означає поле цілком
+type projectionNode map[string]projectionNode
+
+type projection struct {
+	include bool
+	fields  projectionNode // nil, якщо проекція порожня
+}
+
+// GetWithProjection повертає документ за ключем лише з полями проекції
+func (s *Collection) GetWithProjection(key string, p Projection) (*Document, error) {
+	proj, er := compileProjection(p)
+	if er != nil {
+		return nil, er
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists, er := s.current(key, time.Now())
+	if er != nil {
+		return nil, er
+	}
+	if !exists {
+		return nil, err.ErrDocumentNotFound
+	}
+	doc = proj.apply(doc, s.config.PrimaryKey)
+	return &doc, nil
+}
+
+// ListWithProjection повертає всі документи в порядку первинного ключа лише з полями проекції
+func (s *Collection) ListWithProjection(p Projection) ([]Document, error) {
+	proj, er := compileProjection(p)
+	if er != nil {
+		return nil, er
+	}
+	return s.project(s.List(), proj), nil
+}
+
+// project застосовує проекцію до вже скопійованих документів
+func (s *Collection) project(docs []Document, proj *projection) []Document {
+	if proj.fields == nil {
+		return docs
+	}
+	for i, doc := range docs {
+		docs[i] = proj.apply(doc, s.config.PrimaryKey)
+	}
+	return docs
+}
+
+func compileProjection(p Projection) (*projection, error) {
+	if len(p.Include) > 0 && len(p.Exclude) > 0 {
+		return nil, fmt.Errorf("%w: include and exclude can not be combined", err.ErrInvalidProjection)
+	}
+	proj := &projection{include: len(p.Include) > 0}
+	paths := p.Exclude
+	if proj.include {
+		paths = p.Include
+	}
+	for _, path := range paths {
+		if proj.fields == nil {
+			proj.fields = projectionNode{}
+		}
+		if er := proj.fields.add(path); er != nil {
+			return nil, er
+		}
+	}
+	return proj, nil
+}
+
+// add додає шлях до дерева; якщо батьківське поле вже взято цілком, вкладений шлях нічого не змінює
+func (n projectionNode) add(path string) error {
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		if segment == "" {
+			return fmt.Errorf("%w: empty segment in path %q", err.ErrInvalidProjection, path)
+		}
+		if i == len(segments)-1 {
+			n[segment] = nil
+			return nil
+		}
+		next, exists := n[segment]
+		if exists && next == nil {
+			return nil
+		}
+		if !exists {
+			next = projectionNode{}
+			n[segment] = next
+		}
+		n = next
+	}
+	return nil
+}
+
+// apply повертає новий документ; вкладені значення копіюються лише там, де їх обрізано
+func (p *projection) apply(doc Document, primaryKey string) Document {
+	if p.fields == nil {
+		return doc.clone()
+	}
+	fields := map[string]DocumentField{}
+	if p.include {
+		if pk, ok := doc.Fields[primaryKey]; ok {
+			fields[primaryKey] = pk
+		}
+		for name, sub := range p.fields {
+			field, ok := doc.Fields[name]
+			if !ok {
+				continue
+			}
+			if sub != nil {
+				if field.Value, ok = includeValue(field.Value, sub); !ok {
+					continue
+				}
+			}
+			fields[name] = field
+		}
+		return Document{Fields: fields, Revision: doc.Revision, ExpiresAt: doc.ExpiresAt}
+	}
+	for name, field := range doc.Fields {
+		sub, hit := p.fields[name]
+		if hit && sub == nil {
+			continue
+		}
+		if hit {
+			field.Value = excludeValue(field.Value, sub)
+		}
+		fields[name] = field
+	}
+	return Document{Fields: fields, Revision: doc.Revision, ExpiresAt: doc.ExpiresAt}
+}
+
+// includeValue залишає в об'єкті лише поля з n; у масиві обробляється кожен елемент-об'єкт
+func includeValue(v any, n projectionNode) (any, bool) {
+	if list, ok := sliceValues(v); ok {
+		out := make([]any, 0, len(list))
+		for _, elem := range list {
+			if projected, ok := includeValue(elem, n); ok {
+				out = append(out, projected)
+			}
+		}
+		return out, true
+	}
+	fields, ok := objectFields(v)
+	if !ok {
+		return nil, false
+	}
+	out := map[string]any{}
+	for name, sub := range n {
+		c, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if sub != nil {
+			if c, ok = includeValue(c, sub); !ok {
+				continue
+			}
+		}
+		out[name] = c
+	}
+	return out, true
+}
+
+// excludeValue прибирає з об'єкта поля з n; значення інших типів повертаються без змін
+func excludeValue(v any, n projectionNode) any {
+	if list, ok := sliceValues(v); ok {
+		out := make([]any, len(list))
+		for i, elem := range list {
+			out[i] = excludeValue(elem, n)
+		}
+		return out
+	}
+	fields, ok := objectFields(v)
+	if !ok {
+		return v
+	}
+	out := make(map[string]any, len(fields))
+	for name, c := range fields {
+		sub, hit := n[name]
+		switch {
+		case !hit:
+			out[name] = c
+		case sub != nil:
+			out[name] = excludeValue(c, sub)
+		}
+	}
+	return out
+}
+
+// objectFields повертає поля об'єкта за тими ж іменами, за якими їх знаходить lookupPath
+func objectFields(v any) (map[string]any, bool) {
+	switch val := v.(type) {
+	case nil:
+		return nil, false
+	case map[string]any:
+		return val, true
+	case map[string]DocumentField:
+		return documentFields(val), true
+	case DocumentField:
+		return objectFields(val.Value)
+	case Document:
+		return documentFields(val.Fields), true
+	case *Document:
+		if val == nil {
+			return nil, false
+		}
+		return documentFields(val.Fields), true
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		rt := rv.Type()
+		fields := map[string]any{}
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = rv.Field(i).Interface()
+		}
+		return fields, true
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		fields := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			fields[iter.Key().String()] = iter.Value().Interface()
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+func documentFields(fields map[string]DocumentField) map[string]any {
+	out := make(map[string]any, len(fields))
+	for name, field := range fields {
+		out[name] = field.Value
+	}
+	return out
+}
@@ -0,0 +1,216 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+)
+
+var projectionTestDocuments = []map[string]DocumentField{
+	{
+		"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+		"name":    {Type: DocumentFieldTypeString, Value: "Andrii"},
+		"age":     {Type: DocumentFieldTypeNumber, Value: int64(32)},
+		"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv", "zip": int64(1001)}},
+		"orders": {Type: DocumentFieldTypeArray, Value: []any{
+			map[string]any{"sku": "a1", "qty": int64(2)},
+			map[string]any{"sku": "b7", "qty": int64(5)},
+		}},
+	},
+	{
+		"id":      {Type: DocumentFieldTypeString, Value: "u2"},
+		"name":    {Type: DocumentFieldTypeString, Value: "Taras"},
+		"age":     {Type: DocumentFieldTypeNumber, Value: int64(17)},
+		"address": {Type: DocumentFieldTypeObject, Value: filterTestAddress{City: "Lviv", Zip: 79000}},
+	},
+}
+
+func TestCollection_GetWithProjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		proj    Projection
+		want    map[string]DocumentField
+		wantErr error
+	}{
+		{
+			name: "include keeps primary key",
+			key:  "u1",
+			proj: Projection{Include: []string{"name", "missing"}},
+			want: map[string]DocumentField{
+				"id":   {Type: DocumentFieldTypeString, Value: "u1"},
+				"name": {Type: DocumentFieldTypeString, Value: "Andrii"},
+			},
+		},
+		{
+			name: "include nested path",
+			key:  "u1",
+			proj: Projection{Include: []string{"address.city", "orders.sku"}},
+			want: map[string]DocumentField{
+				"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+				"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv"}},
+				"orders":  {Type: DocumentFieldTypeArray, Value: []any{map[string]any{"sku": "a1"}, map[string]any{"sku": "b7"}}},
+			},
+		},
+		{
+			name: "include nested struct field by json tag",
+			key:  "u2",
+			proj: Projection{Include: []string{"address.city"}},
+			want: map[string]DocumentField{
+				"id":      {Type: DocumentFieldTypeString, Value: "u2"},
+				"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Lviv"}},
+			},
+		},
+		{
+			name: "parent path wins over nested",
+			key:  "u1",
+			proj: Projection{Include: []string{"address.city", "address"}},
+			want: map[string]DocumentField{
+				"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+				"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv", "zip": int64(1001)}},
+			},
+		},
+		{
+			name: "exclude",
+			key:  "u2",
+			proj: Projection{Exclude: []string{"id", "age", "address.Zip"}},
+			want: map[string]DocumentField{
+				"name":    {Type: DocumentFieldTypeString, Value: "Taras"},
+				"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Lviv"}},
+			},
+		},
+		{
+			name: "exclude inside array of objects",
+			key:  "u1",
+			proj: Projection{Exclude: []string{"name", "age", "address", "orders.qty"}},
+			want: map[string]DocumentField{
+				"id":     {Type: DocumentFieldTypeString, Value: "u1"},
+				"orders": {Type: DocumentFieldTypeArray, Value: []any{map[string]any{"sku": "a1"}, map[string]any{"sku": "b7"}}},
+			},
+		},
+		{
+			name:    "include and exclude",
+			key:     "u1",
+			proj:    Projection{Include: []string{"name"}, Exclude: []string{"age"}},
+			wantErr: err.ErrInvalidProjection,
+		},
+		{
+			name:    "empty path segment",
+			key:     "u1",
+			proj:    Projection{Include: []string{"address..city"}},
+			wantErr: err.ErrInvalidProjection,
+		},
+		{
+			name:    "missing document",
+			key:     "u9",
+			proj:    Projection{Include: []string{"name"}},
+			wantErr: err.ErrDocumentNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, projectionTestDocuments)
+			got, er := s.GetWithProjection(tt.key, tt.proj)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("GetWithProjection() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !reflect.DeepEqual(got.Fields, tt.want) {
+				t.Errorf("GetWithProjection() = %v, want %v", got.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollection_ProjectionDoesNotChangeStoredDocument(t *testing.T) {
+	s := testCollection(t, projectionTestDocuments)
+	got, er := s.GetWithProjection("u1", Projection{Include: []string{"address.city"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	got.Fields["address"].Value.(map[string]any)["city"] = "Odesa"
+
+	doc, _ := s.Get("u1")
+	want := map[string]any{"city": "Kyiv", "zip": int64(1001)}
+	if !reflect.DeepEqual(doc.Fields["address"].Value, want) {
+		t.Errorf("stored address = %v, want %v", doc.Fields["address"].Value, want)
+	}
+}
+
+func TestCollection_ProjectionInQueries(t *testing.T) {
+	s := testCollection(t, projectionTestDocuments)
+	s.CreateIndex("name")
+	proj := Projection{Include: []string{"name"}}
+	want := []map[string]DocumentField{
+		{"id": {Type: DocumentFieldTypeString, Value: "u1"}, "name": {Type: DocumentFieldTypeString, Value: "Andrii"}},
+		{"id": {Type: DocumentFieldTypeString, Value: "u2"}, "name": {Type: DocumentFieldTypeString, Value: "Taras"}},
+	}
+	fields := func(docs []Document) []map[string]DocumentField {
+		out := make([]map[string]DocumentField, 0, len(docs))
+		for _, doc := range docs {
+			out = append(out, doc.Fields)
+		}
+		return out
+	}
+
+	list, er := s.ListWithProjection(proj)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got := fields(list); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListWithProjection() = %v, want %v", got, want)
+	}
+
+	query, er := s.Query("name", QueryParams{Projection: proj})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got := fields(query); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+
+	page, er := s.FindPage(Filter{}, FindOptions{Projection: proj})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got := fields(page.Documents); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindPage() = %v, want %v", got, want)
+	}
+}
+
+func TestUnmarshalDocument_Projection(t *testing.T) {
+	type city struct {
+		City string `json:"city"`
+	}
+	type summary struct {
+		ID      string `json:"id"`
+		Age     int    `json:"age,omitempty"`
+		Address city   `json:"address"`
+		Orders  []struct {
+			SKU string `json:"sku"`
+		} `json:"orders"`
+		Name string `json:"name"`
+	}
+
+	s := testCollection(t, projectionTestDocuments)
+	doc, er := s.GetWithProjection("u1", Projection{Include: []string{"age", "address.city", "orders.sku"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	var got summary
+	if er := UnmarshalDocument(doc, &got); er != nil {
+		t.Fatal(er)
+	}
+	if got.ID != "u1" || got.Age != 32 || got.Address.City != "Kyiv" || got.Name != "" ||
+		len(got.Orders) != 2 || got.Orders[1].SKU != "b7" {
+		t.Errorf("UnmarshalDocument() = %+v", got)
+	}
+
+	bad := &Document{Fields: map[string]DocumentField{"age": {Type: DocumentFieldTypeString, Value: "old"}}}
+	if er := UnmarshalDocument(bad, &summary{}); er == nil {
+		t.Errorf("UnmarshalDocument() with string into int field returned no error")
+	}
+}
@@ -0,0 +1,274 @@
+package documentstore
+
+import (
+	"lesson4/pkg/err"
+	"sort"
+	"time"
+)
+
+// snapshotBatch - скільки документів знімок читає за одне блокування колекції
+const snapshotBatch = 256
+
+// Snapshot - стан колекції на момент відкриття. Поки знімок відкритий, рушій колекції зберігає
+// старі версії документів, які він може прочитати, тож записи не чекають на читача,
+// а читач не бачить записів, зроблених після відкриття. Знімок треба закрити через Release,
+// інакше старі версії накопичуватимуться.
+//
+// Snapshot не призначений для одночасного використання з кількох горутин.
+type Snapshot struct {
+	coll     *Collection
+	engine   EngineSnapshot
+	revision uint64            // остання ревізія колекції, яку бачить знімок
+	config   CollectionConfig  // конфігурація на момент відкриття
+	indexes  []IndexDefinition // індекси на момент відкриття
+	order    []string          // ключі capped колекції в порядку вставки; лише у знімків для дампу
+	keys     []string          // ключі знімка в порядку первинного ключа; nil, доки їх не прочитали
+	released bool
+}
+
+// Snapshot відкриває знімок колекції
+func (s *Collection) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := s.openSnapshot()
+	snap.order = s.insertionOrder()
+	return snap
+}
+
+// openSnapshot відкриває знімок; викликач тримає блокування колекції хоча б на читання
+func (s *Collection) openSnapshot() *Snapshot {
+	return &Snapshot{
+		coll:     s,
+		engine:   s.storage().Snapshot(),
+		revision: s.revision,
+		config:   s.config,
+		indexes:  s.indexDefinitions(),
+	}
+}
+
+// Revision повертає ревізію колекції, на якій відкрито знімок
+func (sn *Snapshot) Revision() uint64 {
+	return sn.revision
+}
+
+// Get повертає документ у стані на момент відкриття знімка
+func (sn *Snapshot) Get(key string) (*Document, error) {
+	sn.coll.mu.RLock()
+	defer sn.coll.mu.RUnlock()
+
+	if sn.released {
+		return nil, err.ErrSnapshotReleased
+	}
+	doc, exists, er := sn.engine.Get(key)
+	if er != nil {
+		return nil, er
+	}
+	if !exists || doc.expired(time.Now()) {
+		return nil, err.ErrDocumentNotFound
+	}
+	doc = doc.clone()
+	return &doc, nil
+}
+
+// Scan викликає fn для кожного документа знімка в порядку первинного ключа, доки fn не поверне false.
+// Колекція блокується лише на час читання чергової порції документів, не на весь обхід.
+func (sn *Snapshot) Scan(fn func(doc Document) bool) error {
+	keys, er := sn.sortedKeys()
+	if er != nil {
+		return er
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), snapshotBatch)
+		docs, er := sn.read(keys[:n])
+		if er != nil {
+			return er
+		}
+		for _, doc := range docs {
+			if !fn(doc) {
+				return nil
+			}
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// List повертає всі документи знімка в порядку первинного ключа
+func (sn *Snapshot) List() ([]Document, error) {
+	keys, er := sn.sortedKeys()
+	if er != nil {
+		return nil, er
+	}
+	return sn.readAll(keys)
+}
+
+// readAll копіює документи знімка за ключами порціями по snapshotBatch
+func (sn *Snapshot) readAll(keys []string) ([]Document, error) {
+	docs := make([]Document, 0, len(keys))
+	for len(keys) > 0 {
+		n := min(len(keys), snapshotBatch)
+		batch, er := sn.read(keys[:n])
+		if er != nil {
+			return nil, er
+		}
+		docs = append(docs, batch...)
+		keys = keys[n:]
+	}
+	return docs, nil
+}
+
+// Release закриває знімок і звільняє старі версії, які більше нікому не потрібні; повторний виклик нічого не робить
+func (sn *Snapshot) Release() {
+	sn.coll.mu.Lock()
+	defer sn.coll.mu.Unlock()
+
+	if sn.released {
+		return
+	}
+	sn.released = true
+	sn.keys = nil
+	sn.engine.Release()
+}
+
+// sortedKeys повертає ключі документів, що існували на момент відкриття знімка
+func (sn *Snapshot) sortedKeys() ([]string, error) {
+	if sn.keys != nil {
+		return sn.keys, nil
+	}
+	sn.coll.mu.RLock()
+	defer sn.coll.mu.RUnlock()
+
+	if sn.released {
+		return nil, err.ErrSnapshotReleased
+	}
+	keys := []string{}
+	er := sn.engine.Scan("", func(key string, _ Document) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if er != nil {
+		return nil, er
+	}
+	sn.keys = keys
+	return keys, nil
+}
+
+// read повертає копії документів знімка за ключами; відсутні на момент знімка та застарілі документи пропускаються
+func (sn *Snapshot) read(keys []string) ([]Document, error) {
+	sn.coll.mu.RLock()
+	defer sn.coll.mu.RUnlock()
+
+	if sn.released {
+		return nil, err.ErrSnapshotReleased
+	}
+	docs := make([]Document, 0, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		doc, exists, er := sn.engine.Get(key)
+		if er != nil {
+			return nil, er
+		}
+		if exists && !doc.expired(now) {
+			docs = append(docs, doc.clone())
+		}
+	}
+	return docs, nil
+}
+
+// toDto будує DTO колекції в стані знімка
+func (sn *Snapshot) toDto() (DTOCollection, error) {
+	documents := map[string]Document{}
+	er := sn.Scan(func(doc Document) bool {
+		key, _ := doc.Fields[sn.config.PrimaryKey].Value.(string)
+		documents[key] = doc
+		return true
+	})
+	if er != nil {
+		return DTOCollection{}, er
+	}
+	dto := DTOCollection{
+		Documents: documents,
+		Config:    sn.config,
+		Indexes:   sn.indexes,
+		Revision:  sn.revision,
+	}
+	if sn.config.Capped != nil {
+		// Застарілі за час дампу документи в порядок не потрапляють
+		dto.Order = make([]string, 0, len(documents))
+		for _, key := range sn.order {
+			if _, ok := documents[key]; ok {
+				dto.Order = append(dto.Order, key)
+			}
+		}
+	}
+	return dto, nil
+}
+
+// StoreSnapshot - узгоджений стан усіх колекцій стору на один момент
+type StoreSnapshot struct {
+	collections map[string]*Snapshot
+}
+
+// Snapshot відкриває знімки всіх колекцій стору одночасно: жоден запис, зокрема транзакція,
+// не потрапляє в одні знімки і не потрапляє в інші
+func (s *Store) Snapshot() *StoreSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	// Порядок блокування той самий, що й у Tx.Commit
+	sort.Strings(names)
+	for _, name := range names {
+		coll := s.collections[name]
+		coll.mu.RLock()
+		defer coll.mu.RUnlock()
+	}
+	snap := &StoreSnapshot{collections: make(map[string]*Snapshot, len(names))}
+	for _, name := range names {
+		coll := s.collections[name]
+		snap.collections[name] = coll.openSnapshot()
+		snap.collections[name].order = coll.insertionOrder()
+	}
+	return snap
+}
+
+// Collections повертає імена колекцій знімка за абеткою
+func (sn *StoreSnapshot) Collections() []string {
+	names := make([]string, 0, len(sn.collections))
+	for name := range sn.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Collection повертає знімок колекції
+func (sn *StoreSnapshot) Collection(name string) (*Snapshot, error) {
+	if coll, ok := sn.collections[name]; ok {
+		return coll, nil
+	}
+	return nil, err.ErrCollectionNotFound
+}
+
+// Release закриває знімки всіх колекцій
+func (sn *StoreSnapshot) Release() {
+	for _, coll := range sn.collections {
+		coll.Release()
+	}
+}
+
+func (sn *StoreSnapshot) toDto() (DTOStore, error) {
+	dtoCollections := make(map[string]DTOCollection, len(sn.collections))
+	for name, coll := range sn.collections {
+		dto, er := coll.toDto()
+		if er != nil {
+			return DTOStore{}, er
+		}
+		dtoCollections[name] = dto
+	}
+	return DTOStore{Version: dumpVersion, Collections: dtoCollections}, nil
+}
@@ -0,0 +1,191 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func snapshotTestNames(t *testing.T, docs []Document) []string {
+	t.Helper()
+	names := make([]string, len(docs))
+	for i, doc := range docs {
+		names[i] = doc.Fields["id"].Value.(string) + ":" + doc.Fields["name"].Value.(string)
+	}
+	return names
+}
+
+func TestSnapshot_PointInTime(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	s.Put(walTestDocument("u1", "Andrii"))
+	s.Put(walTestDocument("u2", "Taras"))
+	s.Put(walTestDocument("u3", "Olena"))
+
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	// Записи не чекають на відкритий знімок
+	s.Put(walTestDocument("u1", "Ivan"))
+	s.Put(walTestDocument("u1", "Petro"))
+	s.Delete("u2")
+	s.Put(walTestDocument("u4", "Maria"))
+	s.Delete("u3")
+	s.Put(walTestDocument("u3", "Oksana"))
+
+	docs, er := snap.List()
+	if er != nil {
+		t.Fatal(er)
+	}
+	want := []string{"u1:Andrii", "u2:Taras", "u3:Olena"}
+	if got := snapshotTestNames(t, docs); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot List() = %v, want %v", got, want)
+	}
+	if _, er := snap.Get("u4"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("snapshot Get() of later document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	doc, er := snap.Get("u2")
+	if er != nil || doc.Fields["name"].Value != "Taras" {
+		t.Errorf("snapshot Get() of deleted document = %v, %v", doc, er)
+	}
+
+	want = []string{"u1:Petro", "u3:Oksana", "u4:Maria"}
+	if got := snapshotTestNames(t, s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestSnapshot_ScanStopsEarly(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	for i := 0; i < snapshotBatch*2+10; i++ {
+		s.Put(walTestDocument(fmt.Sprintf("u%04d", i), "name"))
+	}
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	var seen []string
+	er := snap.Scan(func(doc Document) bool {
+		seen = append(seen, doc.Fields["id"].Value.(string))
+		// Запис посеред обходу не потрапляє в знімок
+		s.Delete(fmt.Sprintf("u%04d", len(seen)+snapshotBatch))
+		return len(seen) < snapshotBatch+5
+	})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(seen) != snapshotBatch+5 {
+		t.Fatalf("Scan() visited %d documents, want %d", len(seen), snapshotBatch+5)
+	}
+	for i, id := range seen {
+		if want := fmt.Sprintf("u%04d", i); id != want {
+			t.Fatalf("Scan() document %d = %s, want %s", i, id, want)
+		}
+	}
+}
+
+func TestSnapshot_Release(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	s.Put(walTestDocument("u1", "v1"))
+
+	old := s.Snapshot()
+	s.Put(walTestDocument("u1", "v2"))
+	s.Put(walTestDocument("u1", "v3")) // v2 не бачить жоден знімок
+	middle := s.Snapshot()
+	s.Put(walTestDocument("u1", "v4"))
+
+	engine := s.engine.(*versioned)
+	if got := len(engine.history["u1"]); got != 2 {
+		t.Errorf("history has %d versions, want 2", got)
+	}
+	old.Release()
+	old.Release()
+	if got := len(engine.history["u1"]); got != 1 {
+		t.Errorf("history after release has %d versions, want 1", got)
+	}
+	if _, er := old.Get("u1"); !errors.Is(er, err.ErrSnapshotReleased) {
+		t.Errorf("Get() after release error = %v, want %v", er, err.ErrSnapshotReleased)
+	}
+	doc, _ := middle.Get("u1")
+	if got := doc.Fields["name"].Value; got != "v3" {
+		t.Errorf("snapshot Get() = %v, want v3", got)
+	}
+
+	middle.Release()
+	if engine.history != nil || len(engine.snapshots) != 0 {
+		t.Errorf("after releasing all snapshots history = %v, snapshots = %v", engine.history, engine.snapshots)
+	}
+	s.Put(walTestDocument("u1", "v5"))
+	if engine.history != nil {
+		t.Errorf("write without snapshots kept history %v", engine.history)
+	}
+}
+
+func TestSnapshot_QueryDuringWrites(t *testing.T) {
+	s := &Collection{config: CollectionConfig{PrimaryKey: "id"}}
+	s.CreateIndex("name")
+	for i := 0; i < 1000; i++ {
+		s.Put(walTestDocument(fmt.Sprintf("u%04d", i), "same"))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			s.Put(walTestDocument(fmt.Sprintf("u%04d", i), "other"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		docs, er := s.Query("name", QueryParams{MinValue: "same", MaxValue: "same"})
+		if er != nil {
+			t.Fatal(er)
+		}
+		for _, doc := range docs {
+			if got := doc.Fields["name"].Value; got != "same" {
+				t.Fatalf("Query() returned document %v changed after the query started", doc.Fields["id"].Value)
+			}
+		}
+	}
+	wg.Wait()
+	if history := s.engine.(*versioned).history; history != nil {
+		t.Errorf("history after queries = %d keys, want none", len(history))
+	}
+}
+
+func TestStore_SnapshotConsistentAcrossCollections(t *testing.T) {
+	s := txTestStore(t)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.RunInTx(func(tx *Tx) error {
+				return txTestTransfer(tx, fmt.Sprintf("t%d", i), "a1", "a2", 1)
+			})
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		dto := s.ToDto()
+		accounts := dto.Collections["accounts"].Documents
+		a1 := toFloat(normalizeValue(accounts["a1"].Fields["balance"].Value))
+		a2 := toFloat(normalizeValue(accounts["a2"].Fields["balance"].Value))
+		if a1+a2 != 150 {
+			t.Fatalf("dump has total balance %v, want 150", a1+a2)
+		}
+		// Кожен переказ записується в log у тій самій транзакції
+		if transfers := len(dto.Collections["log"].Documents); float64(transfers) != 100-a1 {
+			t.Fatalf("dump has %d transfers for balance %v", transfers, a1)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
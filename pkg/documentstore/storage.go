@@ -0,0 +1,442 @@
+package documentstore
+
+import (
+	"fmt"
+	"lesson4/pkg/err"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// StorageEngine зберігає документи колекції за первинним ключем. Індекси, ревізії, TTL та журнал
+// лишаються за колекцією, рушій лише читає та пише документи. Блокує теж колекція: Put, Delete,
+// Drop та Close викликаються під блокуванням на запис, решта - під блокуванням на читання,
+// тож рушій має лише дозволяти одночасні читання.
+//
+// Індекси живуть лише в пам'яті колекції і на диск не пишуться: відкриваючи стор, колекція будує
+// всі свої індекси одним обходом рушія, тож для дискового рушія час відкриття росте з розміром колекції.
+type StorageEngine interface {
+	// Get повертає документ; exists == false, якщо документа немає
+	Get(key string) (doc Document, exists bool, er error)
+	Put(key string, doc Document) error
+	// Delete видаляє документ; відсутній документ - не помилка
+	Delete(key string) error
+	Len() int
+	// Scan викликає fn для документів з ключами від from у порядку ключів, доки fn не поверне false
+	Scan(from string, fn func(key string, doc Document) bool) error
+	// Snapshot фіксує поточний стан рушія: подальші Put та Delete знімок не бачить
+	Snapshot() EngineSnapshot
+	// Drop видаляє всі дані рушія з носія, коли колекцію видаляють зі стору
+	Drop() error
+	// Sync скидає на носій усі записи рушія; Checkpoint викликає його перед тим, як очистити журнал
+	Sync() error
+	Close() error
+}
+
+// EngineSnapshot - незмінний стан рушія; Release викликається під блокуванням колекції на запис
+type EngineSnapshot interface {
+	Get(key string) (doc Document, exists bool, er error)
+	Scan(from string, fn func(key string, doc Document) bool) error
+	Release()
+}
+
+type EngineType string
+
+const (
+	EngineMemory EngineType = "memory" // документи в пам'яті; рушій за замовчуванням
+	EngineFile   EngineType = "file"   // кожен документ в окремому файлі каталогу
+	EngineBTree  EngineType = "btree"  // B+дерево в одному файлі для колекцій, більших за пам'ять
+	EngineLog    EngineType = "log"    // сегменти, що лише дописуються, з фоновим ущільненням
+)
+
+// EngineOptions обирає рушій колекції
+type EngineOptions struct {
+	Type EngineType `json:"type,omitempty"` // порожній - EngineMemory
+	// Path - каталог EngineFile чи EngineLog або файл EngineBTree; дві колекції не можуть ділити один шлях
+	Path        string `json:"path,omitempty"`
+	Sync        bool   `json:"sync,omitempty"`         // скидати кожен запис на диск
+	CachePages  int    `json:"cache_pages,omitempty"`  // скільки вузлів EngineBTree тримати в пам'яті, 0 - за замовчуванням
+	SegmentSize int64  `json:"segment_size,omitempty"` // розмір сегмента EngineLog у байтах, 0 - за замовчуванням
+}
+
+// persistent - чи зберігає рушій документи сам, без снапшоту та журналу стору
+func (o EngineOptions) persistent() bool {
+	return o.Type != "" && o.Type != EngineMemory
+}
+
+func (o EngineOptions) validate() error {
+	switch o.Type {
+	case "", EngineMemory:
+		return nil
+	case EngineFile, EngineBTree, EngineLog:
+		if o.Path == "" {
+			return fmt.Errorf("%w: %s engine needs a path", err.ErrInvalidCollectionConfig, o.Type)
+		}
+		if o.CachePages < 0 {
+			return fmt.Errorf("%w: negative cache size", err.ErrInvalidCollectionConfig)
+		}
+		if o.SegmentSize < 0 {
+			return fmt.Errorf("%w: negative segment size", err.ErrInvalidCollectionConfig)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown engine %q", err.ErrInvalidCollectionConfig, o.Type)
+}
+
+// openEngine відкриває рушій; дискові рушії бачать документи, записані за тим самим шляхом раніше.
+// Шлях, уже відкритий іншою колекцією процесу, дає err.ErrEnginePathInUse: два рушії на одних
+// файлах переписували б дані один одного.
+func openEngine(o EngineOptions) (StorageEngine, error) {
+	if er := o.validate(); er != nil {
+		return nil, er
+	}
+	if !o.persistent() {
+		return NewMemoryEngine(), nil
+	}
+	path, er := claimPath(o.Path)
+	if er != nil {
+		return nil, er
+	}
+	var engine StorageEngine
+	switch o.Type {
+	case EngineFile:
+		engine, er = OpenFileEngine(o.Path, o.Sync)
+	case EngineBTree:
+		engine, er = OpenBTreeEngine(o.Path, o.CachePages, o.Sync)
+	case EngineLog:
+		engine, er = OpenLogEngine(o.Path, o.SegmentSize, o.Sync)
+	}
+	if er != nil {
+		releasePath(path)
+		return nil, er
+	}
+	return &claimedEngine{StorageEngine: engine, path: path}, nil
+}
+
+// openPaths - абсолютні шляхи дискових рушіїв, відкритих колекціями цього процесу
+var openPaths = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: map[string]struct{}{}}
+
+// claimPath займає шлях рушія і повертає його абсолютну форму
+func claimPath(path string) (string, error) {
+	abs, er := filepath.Abs(path)
+	if er != nil {
+		return "", er
+	}
+	openPaths.Lock()
+	defer openPaths.Unlock()
+
+	if _, open := openPaths.paths[abs]; open {
+		return "", fmt.Errorf("%w: %s", err.ErrEnginePathInUse, abs)
+	}
+	openPaths.paths[abs] = struct{}{}
+	return abs, nil
+}
+
+func releasePath(path string) {
+	openPaths.Lock()
+	defer openPaths.Unlock()
+
+	delete(openPaths.paths, path)
+}
+
+// claimedEngine звільняє шлях рушія, коли його закривають або видаляють
+type claimedEngine struct {
+	StorageEngine
+	path string
+	once sync.Once
+}
+
+func (e *claimedEngine) release() {
+	e.once.Do(func() { releasePath(e.path) })
+}
+
+func (e *claimedEngine) Drop() error {
+	defer e.release()
+	return e.StorageEngine.Drop()
+}
+
+func (e *claimedEngine) Close() error {
+	defer e.release()
+	return e.StorageEngine.Close()
+}
+
+// backend - сховище без знімків; versioned додає до нього знімки
+type backend interface {
+	Get(key string) (Document, bool, error)
+	Put(key string, doc Document) error
+	Delete(key string) error
+	Len() int
+	Scan(from string, fn func(key string, doc Document) bool) error
+	Drop() error
+	Sync() error
+	Close() error
+}
+
+// versioned дає знімки будь-якому backend: поки знімок відкритий, замінені версії документів,
+// які він може прочитати, зберігаються в пам'яті, тож записи не чекають на читача
+type versioned struct {
+	backend
+	seq       uint64               // кількість змін рушія
+	history   map[string][]version // замінені версії документів, які ще потрібні відкритим знімкам
+	snapshots map[uint64]int       // seq відкритого знімка -> кількість таких знімків
+	mu        sync.Mutex           // захищає snapshots, коли знімки відкривають під блокуванням на читання
+}
+
+// version - стара версія документа та seq рушія, на якому її замінили
+type version struct {
+	doc    Document
+	exists bool // false, якщо до запису документа не було
+	until  uint64
+}
+
+func newVersioned(b backend) *versioned {
+	return &versioned{backend: b}
+}
+
+func (e *versioned) Put(key string, doc Document) error {
+	old, existed, er := e.previous(key)
+	if er != nil {
+		return er
+	}
+	if er := e.backend.Put(key, doc); er != nil {
+		return er
+	}
+	e.seq++
+	e.retain(key, old, existed)
+	return nil
+}
+
+func (e *versioned) Delete(key string) error {
+	old, existed, er := e.previous(key)
+	if er != nil {
+		return er
+	}
+	if er := e.backend.Delete(key); er != nil {
+		return er
+	}
+	e.seq++
+	e.retain(key, old, existed)
+	return nil
+}
+
+// previous читає документ перед заміною, лише якщо його може потребувати відкритий знімок
+func (e *versioned) previous(key string) (Document, bool, error) {
+	if len(e.snapshots) == 0 {
+		return Document{}, false, nil
+	}
+	return e.backend.Get(key)
+}
+
+func (e *versioned) Snapshot() EngineSnapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.snapshots == nil {
+		e.snapshots = map[uint64]int{}
+	}
+	e.snapshots[e.seq]++
+	return &versionSnapshot{engine: e, seq: e.seq}
+}
+
+// retain зберігає версію документа, яку щойно замінили на e.seq, якщо її може прочитати хоч один знімок
+func (e *versioned) retain(key string, old Document, existed bool) {
+	if len(e.snapshots) == 0 {
+		return
+	}
+	versions := e.history[key]
+	var since uint64
+	if n := len(versions); n > 0 {
+		since = versions[n-1].until
+	}
+	if !e.snapshotBetween(since, e.seq) {
+		return
+	}
+	if e.history == nil {
+		e.history = map[string][]version{}
+	}
+	e.history[key] = append(versions, version{doc: old, exists: existed, until: e.seq})
+}
+
+// versionAt повертає версію, яку бачить знімок на seq; ok == false - знімок бачить поточний документ
+func (e *versioned) versionAt(key string, seq uint64) (version, bool) {
+	for _, v := range e.history[key] {
+		if v.until > seq {
+			return v, true
+		}
+	}
+	return version{}, false
+}
+
+// collectVersions прибирає версії, які не потрібні жодному відкритому знімку. Версію читають знімки,
+// відкриті між заміною попередньої версії та її власною заміною.
+func (e *versioned) collectVersions() {
+	if len(e.snapshots) == 0 {
+		e.history = nil
+		return
+	}
+	for key, versions := range e.history {
+		var since uint64
+		kept := versions[:0]
+		for _, v := range versions {
+			if e.snapshotBetween(since, v.until) {
+				kept = append(kept, v)
+			}
+			since = v.until
+		}
+		if len(kept) == 0 {
+			delete(e.history, key)
+			continue
+		}
+		clear(versions[len(kept):])
+		e.history[key] = kept
+	}
+}
+
+// snapshotBetween перевіряє, чи відкритий знімок з seq з проміжку [from, to)
+func (e *versioned) snapshotBetween(from, to uint64) bool {
+	for seq := range e.snapshots {
+		if seq >= from && seq < to {
+			return true
+		}
+	}
+	return false
+}
+
+type versionSnapshot struct {
+	engine   *versioned
+	seq      uint64
+	released bool
+}
+
+func (sn *versionSnapshot) Get(key string) (Document, bool, error) {
+	if v, ok := sn.engine.versionAt(key, sn.seq); ok {
+		return v.doc, v.exists, nil
+	}
+	return sn.engine.backend.Get(key)
+}
+
+// Scan зливає поточні документи з ключами, що мають збережені версії, в одному порядку ключів
+func (sn *versionSnapshot) Scan(from string, fn func(key string, doc Document) bool) error {
+	e := sn.engine
+	changed := make([]string, 0, len(e.history))
+	for key := range e.history {
+		if key >= from {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	i := 0
+	// flush віддає змінені ключі до until, яких уже немає серед поточних документів
+	flush := func(until string, all bool) bool {
+		for ; i < len(changed) && (all || changed[i] < until); i++ {
+			if v, ok := e.versionAt(changed[i], sn.seq); ok && v.exists && !fn(changed[i], v.doc) {
+				return false
+			}
+		}
+		return true
+	}
+	stopped := false
+	er := e.backend.Scan(from, func(key string, doc Document) bool {
+		if !flush(key, false) {
+			stopped = true
+			return false
+		}
+		if i < len(changed) && changed[i] == key {
+			i++
+		}
+		if v, ok := e.versionAt(key, sn.seq); ok {
+			if !v.exists {
+				return true
+			}
+			doc = v.doc
+		}
+		if !fn(key, doc) {
+			stopped = true
+			return false
+		}
+		return true
+	})
+	if er != nil || stopped {
+		return er
+	}
+	flush("", true)
+	return nil
+}
+
+func (sn *versionSnapshot) Release() {
+	e := sn.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if sn.released {
+		return
+	}
+	sn.released = true
+	if e.snapshots[sn.seq]--; e.snapshots[sn.seq] == 0 {
+		delete(e.snapshots, sn.seq)
+	}
+	e.collectVersions()
+}
+
+// memoryEngine тримає документи в мапі; порядок ключів будується під час обходу
+type memoryEngine struct {
+	docs map[string]Document
+}
+
+// NewMemoryEngine створює порожній рушій у пам'яті
+func NewMemoryEngine() StorageEngine {
+	return newVersioned(&memoryEngine{docs: map[string]Document{}})
+}
+
+func (e *memoryEngine) Get(key string) (Document, bool, error) {
+	doc, exists := e.docs[key]
+	return doc, exists, nil
+}
+
+func (e *memoryEngine) Put(key string, doc Document) error {
+	e.docs[key] = doc
+	return nil
+}
+
+func (e *memoryEngine) Delete(key string) error {
+	delete(e.docs, key)
+	return nil
+}
+
+func (e *memoryEngine) Len() int {
+	return len(e.docs)
+}
+
+func (e *memoryEngine) Scan(from string, fn func(key string, doc Document) bool) error {
+	keys := make([]string, 0, len(e.docs))
+	for key := range e.docs {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, e.docs[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Drop нічого не робить: документи звільнить збирач сміття разом з колекцією,
+// а знімки та посилання на видалену колекцію і далі бачать її документи
+func (e *memoryEngine) Drop() error {
+	return nil
+}
+
+func (e *memoryEngine) Sync() error {
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
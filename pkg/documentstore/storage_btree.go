@@ -0,0 +1,814 @@
+package documentstore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"lesson4/pkg/err"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+const (
+	btreePageSize   = 4096
+	btreeHeaderSize = 16 // тип, кількість записів, додаткові сторінки, довжина тіла, CRC32 тіла
+	btreeUsable     = btreePageSize - btreeHeaderSize
+	btreeMagic      = 0x65727462 // "btre"
+	btreeVersion    = 1
+	btreeMetaSize   = 68
+
+	// defaultCachePages - скільки вузлів тримає кеш, якщо розмір не задано
+	defaultCachePages = 1024
+	// btreeSyncPages - скільки звільнених сторінок може чекати fsync, перш ніж allocate скине файл
+	btreeSyncPages = 64
+)
+
+const (
+	pageLeaf byte = iota + 1
+	pageBranch
+	pageFreelist
+)
+
+// btreeMeta - корінь дерева та стан файлу. Дві копії на сторінках 0 і 1 пишуться по черзі,
+// тож обірваний запис meta залишає попередню цілою.
+type btreeMeta struct {
+	root          uint64
+	freelist      uint64 // 0 - вільних сторінок немає
+	freelistPages int
+	pages         uint64 // сторінок у файлі; усе далі - сміття обірваних записів
+	txid          uint64
+	count         uint64
+}
+
+// btreeNode - вузол дерева. Записаний вузол не змінюється: зміна пише нові копії вузлів
+// від листа до кореня, а старі сторінки звільняються, коли нова meta вже на диску.
+type btreeNode struct {
+	id       uint64 // 0 - вузол ще не записаний
+	pages    int
+	leaf     bool
+	keys     []string // у гілці keys[i] - найменший ключ піддерева children[i]
+	values   [][]byte
+	children []uint64
+}
+
+// btreeEngine зберігає документи у B+дереві в одному файлі. У пам'яті лишаються тільки кеш
+// вузлів та список вільних сторінок, тож колекція може бути значно більшою за пам'ять.
+type btreeEngine struct {
+	file    *os.File
+	path    string
+	sync    bool
+	meta    btreeMeta
+	free    []uint64 // вільні сторінки за зростанням
+	pending []uint64 // сторінки, звільнені поточною зміною; стануть вільними після запису meta
+	// unsynced - сторінки, звільнені meta, яку ще не скинуто на диск. Після збою файл може
+	// відкритися зі старішою meta, дерево якої їх читає, тож до fsync вони не виділяються.
+	unsynced []uint64
+	cache    *pageCache
+}
+
+// btreeEntry - записаний вузол і його найменший ключ для батьківської гілки
+type btreeEntry struct {
+	key string
+	id  uint64
+}
+
+// OpenBTreeEngine відкриває B+дерево у файлі path, створюючи його за потреби. cachePages - скільки
+// вузлів тримати в пам'яті (0 - defaultCachePages). Якщо sync, кожна зміна скидається на диск.
+func OpenBTreeEngine(path string, cachePages int, sync bool) (StorageEngine, error) {
+	if er := os.MkdirAll(filepath.Dir(path), 0755); er != nil {
+		return nil, er
+	}
+	file, er := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if er != nil {
+		return nil, er
+	}
+	if cachePages <= 0 {
+		cachePages = defaultCachePages
+	}
+	t := &btreeEngine{file: file, path: path, sync: sync, cache: newPageCache(cachePages)}
+	if er := t.load(); er != nil {
+		file.Close()
+		return nil, fmt.Errorf("btree %s: %w", path, er)
+	}
+	return newVersioned(t), nil
+}
+
+// load читає новішу цілу meta та список вільних сторінок; порожній файл отримує порожнє дерево
+func (t *btreeEngine) load() error {
+	info, er := t.file.Stat()
+	if er != nil {
+		return er
+	}
+	if info.Size() == 0 {
+		root, er := t.write(&btreeNode{leaf: true})
+		if er != nil {
+			return er
+		}
+		t.meta.root = root
+		// Обидві копії однакові, тож наступний запис може перезаписати будь-яку
+		for slot := uint64(0); slot < 2; slot++ {
+			if er := t.writeMeta(slot); er != nil {
+				return er
+			}
+		}
+		return t.file.Sync()
+	}
+
+	var found bool
+	for slot := int64(0); slot < 2; slot++ {
+		buf := make([]byte, btreeMetaSize)
+		if _, er := t.file.ReadAt(buf, slot*btreePageSize); er != nil {
+			continue
+		}
+		meta, ok := decodeMeta(buf)
+		if ok && (!found || meta.txid > t.meta.txid) {
+			t.meta, found = meta, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: no valid meta page", err.ErrStorageCorrupted)
+	}
+	// Meta, з якою відкрито файл, могла ще не дійти до диску, якщо процес упав без збою системи
+	if er := t.file.Sync(); er != nil {
+		return er
+	}
+	if t.meta.freelist == 0 {
+		return nil
+	}
+	typ, body, _, er := t.readPage(t.meta.freelist)
+	if er != nil {
+		return er
+	}
+	if typ != pageFreelist || len(body)%8 != 0 {
+		return fmt.Errorf("%w: page %d is not a freelist", err.ErrStorageCorrupted, t.meta.freelist)
+	}
+	for i := 0; i < len(body); i += 8 {
+		t.free = append(t.free, binary.LittleEndian.Uint64(body[i:]))
+	}
+	return nil
+}
+
+func (t *btreeEngine) Get(key string) (Document, bool, error) {
+	n, er := t.readNode(t.meta.root)
+	for er == nil && !n.leaf {
+		n, er = t.readNode(n.children[n.childIndex(key)])
+	}
+	if er != nil {
+		return Document{}, false, er
+	}
+	i, found := slices.BinarySearch(n.keys, key)
+	if !found {
+		return Document{}, false, nil
+	}
+	doc, er := decodeDocument(key, n.values[i])
+	return doc, er == nil, er
+}
+
+func (t *btreeEngine) Put(key string, doc Document) error {
+	value, er := json.Marshal(doc)
+	if er != nil {
+		return er
+	}
+	return t.update(func() error {
+		root, er := t.readCopy(t.meta.root)
+		if er != nil {
+			return er
+		}
+		added, er := t.putIn(root, key, value)
+		if er != nil {
+			return er
+		}
+		if added {
+			t.meta.count++
+		}
+		return t.writeRoot(root)
+	})
+}
+
+// putIn записує значення в піддерево вузла n; n - власна копія, яку змінює putIn
+func (t *btreeEngine) putIn(n *btreeNode, key string, value []byte) (bool, error) {
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if found {
+			n.values[i] = value
+			return false, nil
+		}
+		n.keys = slices.Insert(n.keys, i, key)
+		n.values = slices.Insert(n.values, i, value)
+		return true, nil
+	}
+	i := n.childIndex(key)
+	child, er := t.readCopy(n.children[i])
+	if er != nil {
+		return false, er
+	}
+	added, er := t.putIn(child, key, value)
+	if er != nil {
+		return false, er
+	}
+	entries, er := t.writeSplit(child)
+	if er != nil {
+		return false, er
+	}
+	n.replace(i, 1, entries)
+	return added, nil
+}
+
+func (t *btreeEngine) Delete(key string) error {
+	return t.update(func() error {
+		root, er := t.readCopy(t.meta.root)
+		if er != nil {
+			return er
+		}
+		found, er := t.deleteIn(root, key)
+		if er != nil || !found {
+			return er
+		}
+		t.meta.count--
+		// Гілка з одним нащадком не потрібна, корнем стає сам нащадок
+		for !root.leaf && len(root.children) <= 1 {
+			t.release(root.id, root.pages)
+			if len(root.children) == 0 {
+				root = &btreeNode{leaf: true}
+				break
+			}
+			if root, er = t.readCopy(root.children[0]); er != nil {
+				return er
+			}
+		}
+		return t.writeRoot(root)
+	})
+}
+
+// deleteIn видаляє ключ з піддерева вузла n. Нащадка, що став замалим, зливає з сусідом,
+// а порожнього - прибирає з гілки.
+func (t *btreeEngine) deleteIn(n *btreeNode, key string) (bool, error) {
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if found {
+			n.keys = slices.Delete(n.keys, i, i+1)
+			n.values = slices.Delete(n.values, i, i+1)
+		}
+		return found, nil
+	}
+	i := n.childIndex(key)
+	child, er := t.readCopy(n.children[i])
+	if er != nil {
+		return false, er
+	}
+	found, er := t.deleteIn(child, key)
+	if er != nil || !found {
+		return found, er
+	}
+	if len(child.keys) == 0 {
+		t.release(child.id, child.pages)
+		n.replace(i, 1, nil)
+		return true, nil
+	}
+	if child.size() >= btreeUsable/4 || len(n.children) == 1 {
+		entries, er := t.writeSplit(child)
+		if er != nil {
+			return false, er
+		}
+		n.replace(i, 1, entries)
+		return true, nil
+	}
+
+	j := i + 1
+	if j == len(n.children) {
+		j = i - 1
+	}
+	sibling, er := t.readCopy(n.children[j])
+	if er != nil {
+		return false, er
+	}
+	left, right := child, sibling
+	if j < i {
+		left, right = sibling, child
+	}
+	t.release(left.id, left.pages)
+	t.release(right.id, right.pages)
+	merged := &btreeNode{
+		leaf:     left.leaf,
+		keys:     append(left.keys, right.keys...),
+		values:   append(left.values, right.values...),
+		children: append(left.children, right.children...),
+	}
+	entries, er := t.writeSplit(merged)
+	if er != nil {
+		return false, er
+	}
+	n.replace(min(i, j), 2, entries)
+	return true, nil
+}
+
+func (t *btreeEngine) Len() int {
+	return int(t.meta.count)
+}
+
+func (t *btreeEngine) Scan(from string, fn func(key string, doc Document) bool) error {
+	_, er := t.scan(t.meta.root, from, fn)
+	return er
+}
+
+func (t *btreeEngine) scan(id uint64, from string, fn func(key string, doc Document) bool) (bool, error) {
+	n, er := t.readNode(id)
+	if er != nil {
+		return false, er
+	}
+	if !n.leaf {
+		for i := n.childIndex(from); i < len(n.children); i++ {
+			if more, er := t.scan(n.children[i], from, fn); er != nil || !more {
+				return false, er
+			}
+		}
+		return true, nil
+	}
+	i, _ := slices.BinarySearch(n.keys, from)
+	for ; i < len(n.keys); i++ {
+		doc, er := decodeDocument(n.keys[i], n.values[i])
+		if er != nil {
+			return false, er
+		}
+		if !fn(n.keys[i], doc) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *btreeEngine) Drop() error {
+	t.file.Close()
+	return os.Remove(t.path)
+}
+
+func (t *btreeEngine) Sync() error {
+	if er := t.file.Sync(); er != nil {
+		return er
+	}
+	t.promote()
+	return nil
+}
+
+// promote робить вільними сторінки, звільнені meta, яку щойно скинуто на диск
+func (t *btreeEngine) promote() {
+	if len(t.unsynced) == 0 {
+		return
+	}
+	t.free = append(t.free, t.unsynced...)
+	slices.Sort(t.free)
+	t.unsynced = t.unsynced[:0]
+}
+
+func (t *btreeEngine) Close() error {
+	if er := t.file.Sync(); er != nil {
+		t.file.Close()
+		return er
+	}
+	return t.file.Close()
+}
+
+// update виконує зміну дерева і фіксує її записом meta. Якщо зміна не вдалася, дерево в пам'яті
+// повертається до попередньої meta; вже записані сторінки лишаються недосяжними і будуть перезаписані.
+func (t *btreeEngine) update(change func() error) error {
+	meta, free, unsynced := t.meta, slices.Clone(t.free), slices.Clone(t.unsynced)
+	t.pending = t.pending[:0]
+	er := change()
+	if er == nil && meta != t.meta {
+		er = t.commit()
+	}
+	if er != nil {
+		t.meta, t.free, t.unsynced, t.pending = meta, free, unsynced, nil
+		return er
+	}
+	return nil
+}
+
+// writeRoot записує корінь; якщо він розбився, над ним виростає нова гілка
+func (t *btreeEngine) writeRoot(root *btreeNode) error {
+	entries, er := t.writeSplit(root)
+	for er == nil && len(entries) > 1 {
+		branch := &btreeNode{}
+		branch.replace(0, 0, entries)
+		entries, er = t.writeSplit(branch)
+	}
+	if er != nil {
+		return er
+	}
+	t.meta.root = entries[0].id
+	return nil
+}
+
+// commit записує список вільних сторінок і meta; лише після того, як meta скинуто на диск,
+// сторінки старого дерева можна використати знову
+func (t *btreeEngine) commit() error {
+	if t.meta.freelist != 0 {
+		t.release(t.meta.freelist, t.meta.freelistPages)
+	}
+	// Сторінки під сам список беруться з вільних, тож список може лише зменшитися
+	pages := pagesFor(8 * (len(t.free) + len(t.unsynced) + len(t.pending)))
+	id, er := t.allocate(pages)
+	if er != nil {
+		return er
+	}
+	// На диску вільні всі сторінки, яких не читає нова meta
+	free := slices.Concat(t.free, t.unsynced, t.pending)
+	slices.Sort(free)
+	body := make([]byte, 8*len(free))
+	for i, page := range free {
+		binary.LittleEndian.PutUint64(body[8*i:], page)
+	}
+	if er := t.writePage(id, pages, pageFreelist, len(free), body); er != nil {
+		return er
+	}
+	if t.sync {
+		if er := t.file.Sync(); er != nil {
+			return er
+		}
+	}
+	t.meta.freelist, t.meta.freelistPages = id, pages
+	t.meta.txid++
+	if er := t.writeMeta(t.meta.txid % 2); er != nil {
+		return er
+	}
+	t.unsynced = append(t.unsynced, t.pending...)
+	t.pending = t.pending[:0]
+	if t.sync {
+		return t.Sync()
+	}
+	return nil
+}
+
+// writeSplit записує вузол, за потреби розбитий на кілька, і звільняє його старі сторінки
+func (t *btreeEngine) writeSplit(n *btreeNode) ([]btreeEntry, error) {
+	if n.id != 0 {
+		t.release(n.id, n.pages)
+	}
+	var entries []btreeEntry
+	for _, part := range n.split() {
+		id, er := t.write(part)
+		if er != nil {
+			return nil, er
+		}
+		var key string
+		if len(part.keys) > 0 {
+			key = part.keys[0]
+		}
+		entries = append(entries, btreeEntry{key: key, id: id})
+	}
+	return entries, nil
+}
+
+// write записує вузол на нові сторінки і кладе його в кеш
+func (t *btreeEngine) write(n *btreeNode) (uint64, error) {
+	typ, body := n.encode()
+	n.pages = pagesFor(len(body))
+	id, er := t.allocate(n.pages)
+	if er != nil {
+		return 0, er
+	}
+	n.id = id
+	if er := t.writePage(n.id, n.pages, typ, len(n.keys), body); er != nil {
+		return 0, er
+	}
+	t.cache.put(n)
+	return n.id, nil
+}
+
+func (t *btreeEngine) writePage(id uint64, pages int, typ byte, count int, body []byte) error {
+	buf := make([]byte, pages*btreePageSize)
+	buf[0] = typ
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(min(count, 0xffff)))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(pages-1))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[12:16], crc32.ChecksumIEEE(body))
+	copy(buf[btreeHeaderSize:], body)
+	_, er := t.file.WriteAt(buf, int64(id)*btreePageSize)
+	return er
+}
+
+func (t *btreeEngine) writeMeta(slot uint64) error {
+	buf := make([]byte, btreeMetaSize)
+	binary.LittleEndian.PutUint32(buf[0:4], btreeMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], btreeVersion)
+	binary.LittleEndian.PutUint32(buf[8:12], btreePageSize)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(t.meta.freelistPages))
+	binary.LittleEndian.PutUint64(buf[16:24], t.meta.root)
+	binary.LittleEndian.PutUint64(buf[24:32], t.meta.freelist)
+	binary.LittleEndian.PutUint64(buf[32:40], t.meta.pages)
+	binary.LittleEndian.PutUint64(buf[40:48], t.meta.txid)
+	binary.LittleEndian.PutUint64(buf[48:56], t.meta.count)
+	binary.LittleEndian.PutUint32(buf[64:68], crc32.ChecksumIEEE(buf[:64]))
+	_, er := t.file.WriteAt(buf, int64(slot)*btreePageSize)
+	return er
+}
+
+func decodeMeta(buf []byte) (btreeMeta, bool) {
+	if binary.LittleEndian.Uint32(buf[0:4]) != btreeMagic ||
+		binary.LittleEndian.Uint32(buf[4:8]) != btreeVersion ||
+		binary.LittleEndian.Uint32(buf[8:12]) != btreePageSize ||
+		binary.LittleEndian.Uint32(buf[64:68]) != crc32.ChecksumIEEE(buf[:64]) {
+		return btreeMeta{}, false
+	}
+	return btreeMeta{
+		freelistPages: int(binary.LittleEndian.Uint32(buf[12:16])),
+		root:          binary.LittleEndian.Uint64(buf[16:24]),
+		freelist:      binary.LittleEndian.Uint64(buf[24:32]),
+		pages:         binary.LittleEndian.Uint64(buf[32:40]),
+		txid:          binary.LittleEndian.Uint64(buf[40:48]),
+		count:         binary.LittleEndian.Uint64(buf[48:56]),
+	}, true
+}
+
+// allocate повертає першу сторінку з pages суміжних: з вільних, а якщо таких немає - в кінці файлу.
+// Сторінки meta (0 і 1) ніколи не виділяються. Коли сторінок, що чекають fsync, набирається
+// btreeSyncPages або восьма частина файлу, файл скидається на диск, тож без sync він росте обмежено.
+func (t *btreeEngine) allocate(pages int) (uint64, error) {
+	if t.meta.pages < 2 {
+		t.meta.pages = 2
+	}
+	if id, ok := t.allocateFree(pages); ok {
+		return id, nil
+	}
+	if len(t.unsynced) >= max(btreeSyncPages, int(t.meta.pages/8)) {
+		if er := t.Sync(); er != nil {
+			return 0, er
+		}
+		if id, ok := t.allocateFree(pages); ok {
+			return id, nil
+		}
+	}
+	id := t.meta.pages
+	t.meta.pages += uint64(pages)
+	return id, nil
+}
+
+// allocateFree шукає pages суміжних вільних сторінок
+func (t *btreeEngine) allocateFree(pages int) (uint64, bool) {
+	for i := 0; i+pages <= len(t.free); i++ {
+		if t.free[i+pages-1]-t.free[i] == uint64(pages-1) {
+			id := t.free[i]
+			t.free = slices.Delete(t.free, i, i+pages)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// release звільняє сторінки вузла після наступного commit
+func (t *btreeEngine) release(id uint64, pages int) {
+	if id == 0 {
+		return
+	}
+	for i := 0; i < pages; i++ {
+		t.pending = append(t.pending, id+uint64(i))
+	}
+	t.cache.remove(id)
+}
+
+// readPage читає сторінку разом з додатковими та перевіряє CRC тіла
+func (t *btreeEngine) readPage(id uint64) (byte, []byte, int, error) {
+	if id < 2 || id >= t.meta.pages {
+		return 0, nil, 0, fmt.Errorf("%w: page %d out of range", err.ErrStorageCorrupted, id)
+	}
+	buf := make([]byte, btreePageSize)
+	if _, er := t.file.ReadAt(buf, int64(id)*btreePageSize); er != nil {
+		return 0, nil, 0, fmt.Errorf("read page %d: %w", id, er)
+	}
+	pages := 1 + int(binary.LittleEndian.Uint32(buf[4:8]))
+	length := int(binary.LittleEndian.Uint32(buf[8:12]))
+	if length > pages*btreePageSize-btreeHeaderSize || id+uint64(pages) > t.meta.pages {
+		return 0, nil, 0, fmt.Errorf("%w: page %d has invalid header", err.ErrStorageCorrupted, id)
+	}
+	if pages > 1 {
+		buf = make([]byte, pages*btreePageSize)
+		if _, er := t.file.ReadAt(buf, int64(id)*btreePageSize); er != nil {
+			return 0, nil, 0, fmt.Errorf("read page %d: %w", id, er)
+		}
+	}
+	body := buf[btreeHeaderSize : btreeHeaderSize+length]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[12:16]) {
+		return 0, nil, 0, fmt.Errorf("%w: page %d checksum mismatch", err.ErrStorageCorrupted, id)
+	}
+	return buf[0], body, pages, nil
+}
+
+// readNode повертає вузол з кешу або з диску; повернутий вузол не можна змінювати
+func (t *btreeEngine) readNode(id uint64) (*btreeNode, error) {
+	if n := t.cache.get(id); n != nil {
+		return n, nil
+	}
+	typ, body, pages, er := t.readPage(id)
+	if er != nil {
+		return nil, er
+	}
+	n, er := decodeNode(typ, body)
+	if er != nil {
+		return nil, fmt.Errorf("page %d: %w", id, er)
+	}
+	n.id, n.pages = id, pages
+	t.cache.put(n)
+	return n, nil
+}
+
+// readCopy повертає копію вузла, яку зміна може редагувати
+func (t *btreeEngine) readCopy(id uint64) (*btreeNode, error) {
+	n, er := t.readNode(id)
+	if er != nil {
+		return nil, er
+	}
+	return &btreeNode{
+		id:       n.id,
+		pages:    n.pages,
+		leaf:     n.leaf,
+		keys:     slices.Clone(n.keys),
+		values:   slices.Clone(n.values),
+		children: slices.Clone(n.children),
+	}, nil
+}
+
+// childIndex повертає нащадка гілки, в піддереві якого має бути key
+func (n *btreeNode) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+	return max(i-1, 0)
+}
+
+// replace замінює count нащадків гілки, починаючи з i, записаними вузлами entries
+func (n *btreeNode) replace(i, count int, entries []btreeEntry) {
+	keys := make([]string, len(entries))
+	ids := make([]uint64, len(entries))
+	for k, e := range entries {
+		keys[k], ids[k] = e.key, e.id
+	}
+	n.keys = slices.Replace(n.keys, i, i+count, keys...)
+	n.children = slices.Replace(n.children, i, i+count, ids...)
+}
+
+func (n *btreeNode) entrySize(i int) int {
+	size := binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(len(n.keys[i]))) + len(n.keys[i])
+	if n.leaf {
+		return size + binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(len(n.values[i]))) + len(n.values[i])
+	}
+	return size + 8
+}
+
+func (n *btreeNode) size() int {
+	size := 0
+	for i := range n.keys {
+		size += n.entrySize(i)
+	}
+	return size
+}
+
+// split ділить вузол, що не вміщується на сторінку, на рівні частини. Частина з одного
+// великого документа займає кілька суміжних сторінок.
+func (n *btreeNode) split() []*btreeNode {
+	size := n.size()
+	if size <= btreeUsable || len(n.keys) < 2 {
+		return []*btreeNode{n}
+	}
+	target := size / ((size + btreeUsable - 1) / btreeUsable)
+	var parts []*btreeNode
+	start, acc := 0, 0
+	for i := range n.keys {
+		acc += n.entrySize(i)
+		if acc >= target && i+1 < len(n.keys) {
+			parts = append(parts, n.slice(start, i+1))
+			start, acc = i+1, 0
+		}
+	}
+	return append(parts, n.slice(start, len(n.keys)))
+}
+
+func (n *btreeNode) slice(from, to int) *btreeNode {
+	part := &btreeNode{leaf: n.leaf, keys: slices.Clone(n.keys[from:to])}
+	if n.leaf {
+		part.values = slices.Clone(n.values[from:to])
+	} else {
+		part.children = slices.Clone(n.children[from:to])
+	}
+	return part
+}
+
+func (n *btreeNode) encode() (byte, []byte) {
+	body := make([]byte, 0, n.size())
+	for i, key := range n.keys {
+		body = binary.AppendUvarint(body, uint64(len(key)))
+		body = append(body, key...)
+		if n.leaf {
+			body = binary.AppendUvarint(body, uint64(len(n.values[i])))
+			body = append(body, n.values[i]...)
+		} else {
+			body = binary.LittleEndian.AppendUint64(body, n.children[i])
+		}
+	}
+	if n.leaf {
+		return pageLeaf, body
+	}
+	return pageBranch, body
+}
+
+func decodeNode(typ byte, body []byte) (*btreeNode, error) {
+	if typ != pageLeaf && typ != pageBranch {
+		return nil, fmt.Errorf("%w: unexpected page type %d", err.ErrStorageCorrupted, typ)
+	}
+	n := &btreeNode{leaf: typ == pageLeaf}
+	bytesOf := func() ([]byte, bool) {
+		size, k := binary.Uvarint(body)
+		if k <= 0 || uint64(len(body)-k) < size {
+			return nil, false
+		}
+		b := body[k : k+int(size)]
+		body = body[k+int(size):]
+		return b, true
+	}
+	for len(body) > 0 {
+		key, ok := bytesOf()
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated key", err.ErrStorageCorrupted)
+		}
+		n.keys = append(n.keys, string(key))
+		if n.leaf {
+			value, ok := bytesOf()
+			if !ok {
+				return nil, fmt.Errorf("%w: truncated value", err.ErrStorageCorrupted)
+			}
+			n.values = append(n.values, value)
+			continue
+		}
+		if len(body) < 8 {
+			return nil, fmt.Errorf("%w: truncated child", err.ErrStorageCorrupted)
+		}
+		n.children = append(n.children, binary.LittleEndian.Uint64(body))
+		body = body[8:]
+	}
+	return n, nil
+}
+
+func decodeDocument(key string, value []byte) (Document, error) {
+	var doc Document
+	if er := json.Unmarshal(value, &doc); er != nil {
+		return Document{}, fmt.Errorf("decode document %s: %w", key, er)
+	}
+	return doc, nil
+}
+
+func pagesFor(bodySize int) int {
+	return (btreeHeaderSize + bodySize + btreePageSize - 1) / btreePageSize
+}
+
+// pageCache - LRU кеш прочитаних вузлів; читачі звертаються до нього одночасно
+type pageCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // від нещодавно використаних до давніх
+	nodes    map[uint64]*list.Element
+}
+
+func newPageCache(capacity int) *pageCache {
+	return &pageCache{capacity: capacity, order: list.New(), nodes: map[uint64]*list.Element{}}
+}
+
+func (c *pageCache) get(id uint64) *btreeNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.nodes[id]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*btreeNode)
+}
+
+func (c *pageCache) put(n *btreeNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.nodes[n.id]; ok {
+		el.Value = n
+		c.order.MoveToFront(el)
+		return
+	}
+	c.nodes[n.id] = c.order.PushFront(n)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.nodes, oldest.Value.(*btreeNode).id)
+	}
+}
+
+func (c *pageCache) remove(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.nodes[id]; ok {
+		c.order.Remove(el)
+		delete(c.nodes, id)
+	}
+}
@@ -0,0 +1,172 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func btreeTestOpen(t *testing.T, path string) *btreeEngine {
+	t.Helper()
+	e, er := OpenBTreeEngine(path, 8, false)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return e.(*versioned).backend.(*btreeEngine)
+}
+
+func TestBTreeEngine_RandomOperations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.btree")
+	e := btreeTestOpen(t, path)
+	want := map[string]string{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 6000; i++ {
+		key := fmt.Sprintf("k%05d", rnd.Intn(2000))
+		if rnd.Intn(3) == 0 {
+			if er := e.Delete(key); er != nil {
+				t.Fatal(er)
+			}
+			delete(want, key)
+			continue
+		}
+		// Частина документів більша за сторінку і займає кілька суміжних сторінок
+		name := strings.Repeat("x", rnd.Intn(40))
+		if rnd.Intn(50) == 0 {
+			name = strings.Repeat("y", 2*btreePageSize)
+		}
+		if er := e.Put(key, walTestDocument(key, name)); er != nil {
+			t.Fatal(er)
+		}
+		want[key] = name
+	}
+	storageTestCheck(t, e, want)
+	e.Close()
+
+	e = btreeTestOpen(t, path)
+	storageTestCheck(t, e, want)
+	pages := e.meta.pages
+
+	// Звільнені сторінки використовуються знову, тож файл не росте з кожним перезаписом
+	for key := range want {
+		e.Delete(key)
+	}
+	storageTestCheck(t, e, map[string]string{})
+	if root, _ := e.readNode(e.meta.root); !root.leaf {
+		t.Errorf("root of empty tree is a branch")
+	}
+	for key, name := range want {
+		e.Put(key, walTestDocument(key, name))
+	}
+	storageTestCheck(t, e, want)
+	if e.meta.pages > pages*3/2 {
+		t.Errorf("file grew from %d to %d pages after rewriting the same documents", pages, e.meta.pages)
+	}
+	e.Close()
+}
+
+func TestBTreeEngine_TornMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.btree")
+	e := btreeTestOpen(t, path)
+	e.Put("a", walTestDocument("a", "v1"))
+	e.Put("a", walTestDocument("a", "v2"))
+	slot := e.meta.txid % 2
+	e.Close()
+
+	// Обірваний запис останньої meta: дерево відкривається в стані попереднього запису
+	file, _ := os.OpenFile(path, os.O_RDWR, 0644)
+	file.WriteAt([]byte{0xff, 0xff}, int64(slot)*btreePageSize+20)
+	file.Close()
+	e = btreeTestOpen(t, path)
+	doc, _, er := e.Get("a")
+	if er != nil || doc.Fields["name"].Value != "v1" {
+		t.Errorf("Get() after torn meta = %v, %v, want v1", doc.Fields["name"].Value, er)
+	}
+
+	// Пошкоджену сторінку даних видно за CRC
+	root := e.meta.root
+	e.Close()
+	file, _ = os.OpenFile(path, os.O_RDWR, 0644)
+	file.WriteAt([]byte("garbage"), int64(root)*btreePageSize+btreeHeaderSize)
+	file.Close()
+	e = btreeTestOpen(t, path)
+	defer e.Close()
+	if _, _, er := e.Get("a"); !errors.Is(er, err.ErrStorageCorrupted) {
+		t.Errorf("Get() of corrupted page error = %v, want %v", er, err.ErrStorageCorrupted)
+	}
+}
+
+func TestBTreeEngine_CrashBeforeSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.btree")
+	e := btreeTestOpen(t, path)
+	want := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		e.Put(key, walTestDocument(key, "synced"))
+		want[key] = "synced"
+	}
+	if er := e.Sync(); er != nil {
+		t.Fatal(er)
+	}
+	durable := make([]byte, btreeMetaSize)
+	e.file.ReadAt(durable, int64(e.meta.txid%2)*btreePageSize)
+
+	// Без sync meta може не дійти до диску, тож сторінки дерева, яке вона описує, не перезаписуються до Sync
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%03d", i*30)
+		e.Put(key, walTestDocument(key, fmt.Sprintf("unsynced%d", i)))
+	}
+	data, er := os.ReadFile(path)
+	if er != nil {
+		t.Fatal(er)
+	}
+	e.Close()
+
+	// Збій: на диску лишилася тільки meta останнього Sync
+	crashed := filepath.Join(t.TempDir(), "crashed.btree")
+	copy(data, durable)
+	copy(data[btreePageSize:], durable)
+	if er := os.WriteFile(crashed, data, 0644); er != nil {
+		t.Fatal(er)
+	}
+	e = btreeTestOpen(t, crashed)
+	defer e.Close()
+	storageTestCheck(t, e, want)
+}
+
+func TestCollection_BTreeEngine(t *testing.T) {
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineBTree, Path: filepath.Join(t.TempDir(), "users.btree"), CachePages: 4}}
+	s := NewStore()
+	er, users := s.CreateCollectionWithConfig("users", cfg)
+	if er != nil {
+		t.Fatal(er)
+	}
+	users.CreateIndex("name")
+	for i := 0; i < 500; i++ {
+		users.Put(walTestDocument(fmt.Sprintf("u%03d", i), fmt.Sprintf("name%d", i%10)))
+	}
+	for i := 0; i < 500; i += 2 {
+		users.Delete(fmt.Sprintf("u%03d", i))
+	}
+	docs, _ := users.Find(Filter{"name": "name3"})
+	if got := len(docs); got != 50 {
+		t.Errorf("Find() returned %d documents, want 50", got)
+	}
+	s.Close()
+
+	reopened := NewStore()
+	defer reopened.Close()
+	_, users = reopened.CreateCollectionWithConfig("users", cfg)
+	if ids := indexTestIDs(users.List()); len(ids) != 250 || ids[0] != "u001" {
+		t.Errorf("List() after reopen returned %d documents", len(ids))
+	}
+	page, _ := users.ListPage(FindOptions{Limit: 2, Sort: []SortField{{Field: "id", Desc: true}}})
+	if got, want := indexTestIDs(page.Documents), []string{"u499", "u497"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListPage() = %v, want %v", got, want)
+	}
+}
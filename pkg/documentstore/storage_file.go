@@ -0,0 +1,168 @@
+package documentstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lesson4/pkg/err"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const fileEngineExt = ".json"
+
+// fileEngineMaxKey - найдовший ключ у байтах, для якого ім'я файлу разом із .tmp вкладається в 255 байтів
+const fileEngineMaxKey = (255 - len(fileEngineExt) - len(".tmp")) / 2
+
+// checkFileEngineKey повертає err.ErrKeyTooLong для ключа, з якого не вийде імені файлу
+func checkFileEngineKey(key string) error {
+	if len(key) > fileEngineMaxKey {
+		return fmt.Errorf("%w: %d bytes, file engine allows at most %d", err.ErrKeyTooLong, len(key), fileEngineMaxKey)
+	}
+	return nil
+}
+
+// fileEngine зберігає кожен документ в окремому файлі каталогу, ім'я файлу - ключ у hex.
+// Ключі тримаються в пам'яті, тож Len та впорядкований обхід не читають каталог.
+type fileEngine struct {
+	dir   string
+	sync  bool
+	keys  map[string]struct{}
+	dirty map[string]struct{} // ключі, записані без sync після останнього Sync
+}
+
+// OpenFileEngine відкриває файловий рушій у каталозі dir, створюючи його за потреби.
+// Якщо sync, кожен запис скидається на диск до повернення з Put.
+func OpenFileEngine(dir string, sync bool) (StorageEngine, error) {
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return nil, er
+	}
+	entries, er := os.ReadDir(dir)
+	if er != nil {
+		return nil, er
+	}
+	e := &fileEngine{dir: dir, sync: sync, keys: map[string]struct{}{}, dirty: map[string]struct{}{}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Запис, перерваний до rename, документа не змінив
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		key, er := hex.DecodeString(strings.TrimSuffix(name, fileEngineExt))
+		if er != nil || !strings.HasSuffix(name, fileEngineExt) {
+			continue
+		}
+		e.keys[string(key)] = struct{}{}
+	}
+	return newVersioned(e), nil
+}
+
+func (e *fileEngine) path(key string) string {
+	return filepath.Join(e.dir, hex.EncodeToString([]byte(key))+fileEngineExt)
+}
+
+func (e *fileEngine) Get(key string) (Document, bool, error) {
+	if _, exists := e.keys[key]; !exists {
+		return Document{}, false, nil
+	}
+	data, er := os.ReadFile(e.path(key))
+	if er != nil {
+		return Document{}, false, fmt.Errorf("read document %s: %w", key, er)
+	}
+	var doc Document
+	if er := json.Unmarshal(data, &doc); er != nil {
+		return Document{}, false, fmt.Errorf("decode document %s: %w", key, er)
+	}
+	return doc, true, nil
+}
+
+// Put замінює файл документа через rename, тож читач ніколи не бачить напівзаписаного документа
+func (e *fileEngine) Put(key string, doc Document) error {
+	if er := checkFileEngineKey(key); er != nil {
+		return er
+	}
+	data, er := json.Marshal(doc)
+	if er != nil {
+		return er
+	}
+	path := e.path(key)
+	if e.sync {
+		er = writeFileAtomic(path, data)
+	} else if er = os.WriteFile(path+".tmp", data, 0644); er == nil {
+		er = os.Rename(path+".tmp", path)
+		e.dirty[key] = struct{}{}
+	}
+	if er != nil {
+		return fmt.Errorf("write document %s: %w", key, er)
+	}
+	e.keys[key] = struct{}{}
+	return nil
+}
+
+func (e *fileEngine) Delete(key string) error {
+	if er := os.Remove(e.path(key)); er != nil && !errors.Is(er, os.ErrNotExist) {
+		return fmt.Errorf("delete document %s: %w", key, er)
+	}
+	delete(e.keys, key)
+	delete(e.dirty, key)
+	return nil
+}
+
+func (e *fileEngine) Len() int {
+	return len(e.keys)
+}
+
+func (e *fileEngine) Scan(from string, fn func(key string, doc Document) bool) error {
+	keys := make([]string, 0, len(e.keys))
+	for key := range e.keys {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc, _, er := e.Get(key)
+		if er != nil {
+			return er
+		}
+		if !fn(key, doc) {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *fileEngine) Drop() error {
+	clear(e.keys)
+	return os.RemoveAll(e.dir)
+}
+
+// Sync скидає на диск файли, записані без sync, та сам каталог, у якому їх перейменовано чи видалено
+func (e *fileEngine) Sync() error {
+	for key := range e.dirty {
+		file, er := os.Open(e.path(key))
+		if er == nil {
+			er = file.Sync()
+			file.Close()
+		}
+		if er != nil {
+			return fmt.Errorf("sync document %s: %w", key, er)
+		}
+		delete(e.dirty, key)
+	}
+	dir, er := os.Open(e.dir)
+	if er != nil {
+		return er
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Close нічого не робить: файли відкриваються лише на час читання чи запису
+func (e *fileEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,686 @@
+package documentstore
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"lesson4/pkg/err"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	logSegmentExt    = ".log"
+	logHintExt       = ".hint"
+	logCompactExt    = ".compact"
+	logMagic         = 0x73676f6c // "logs"
+	logVersion       = 1
+	logSegmentHeader = 16 // magic, версія, перший сегмент, який замінює цей
+	logRecordHeader  = 13 // CRC32, ознака видалення, довжина ключа, довжина значення
+	logHintHeader    = 20 // magic, перший сегмент, розмір сегмента
+
+	// defaultSegmentSize - розмір, після якого сегмент закривається, якщо розмір не задано
+	defaultSegmentSize = 16 << 20
+	// compactSegments - скільки закритих сегментів запускають ущільнення незалежно від сміття
+	compactSegments = 16
+)
+
+var errLogClosed = errors.New("log engine is closed")
+
+// logLocation - де лежить останній запис документа
+type logLocation struct {
+	segment uint64
+	offset  int64
+	size    int64 // довжина всього запису
+}
+
+// logSegment - файл сегмента. Дописується лише активний сегмент, закриті не змінюються,
+// доки ущільнення не замінить їх одним новим.
+type logSegment struct {
+	id    uint64
+	first uint64 // найменший id сегмента, дані якого містить цей; first < id лише в ущільнених
+	file  *os.File
+	size  int64
+	dead  int64 // байти перезаписаних і видалених записів
+}
+
+// logRecord - запис сегмента: документ або ознака його видалення
+type logRecord struct {
+	key       string
+	value     []byte
+	tombstone bool
+}
+
+func (r logRecord) size() int64 {
+	return int64(logRecordHeader + len(r.key) + len(r.value))
+}
+
+// logHint - запис hint-файлу: ключ і місце запису без самого документа
+type logHint struct {
+	key       string
+	tombstone bool
+	offset    int64
+	size      int64
+}
+
+// logEngine дописує документи в кінець сегментів, а в пам'яті тримає лише ключі та місця їх
+// останніх записів. Фонове ущільнення переписує живі записи закритих сегментів в один новий.
+// Поруч із кожним закритим сегментом лежить hint-файл, тож відкриття не читає самих документів.
+type logEngine struct {
+	dir         string
+	sync        bool
+	segmentSize int64
+	mu          sync.RWMutex // keydir та segments змінює і фонове ущільнення поза блокуванням колекції
+	keydir      map[string]logLocation
+	segments    map[uint64]*logSegment
+	active      *logSegment
+	hints       []logHint // записи активного сегмента для його hint-файлу
+	compacting  bool
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// OpenLogEngine відкриває журнальний рушій у каталозі dir, створюючи його за потреби. segmentSize -
+// розмір, після якого сегмент закривається (0 - defaultSegmentSize). Якщо sync, кожен запис
+// скидається на диск до повернення з Put.
+func OpenLogEngine(dir string, segmentSize int64, sync bool) (StorageEngine, error) {
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return nil, er
+	}
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	e := &logEngine{dir: dir, sync: sync, segmentSize: segmentSize, keydir: map[string]logLocation{}, segments: map[uint64]*logSegment{}}
+	er := e.load()
+	if er == nil {
+		var next uint64 = 1
+		for id := range e.segments {
+			next = max(next, id+1)
+		}
+		e.active, er = e.create(next)
+	}
+	if er != nil {
+		for _, seg := range e.segments {
+			seg.file.Close()
+		}
+		return nil, fmt.Errorf("log %s: %w", dir, er)
+	}
+	e.mu.Lock()
+	e.maybeCompact()
+	e.mu.Unlock()
+	return newVersioned(e), nil
+}
+
+// load відкриває сегменти і будує keydir з hint-файлів; сегменти без hint-файлу читаються повністю
+func (e *logEngine) load() error {
+	entries, er := os.ReadDir(e.dir)
+	if er != nil {
+		return er
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, logCompactExt) || strings.HasSuffix(name, ".tmp") {
+			// Ущільнення чи запис hint-файлу, перервані до rename, сегментів не змінили
+			os.Remove(filepath.Join(e.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, logSegmentExt) {
+			continue
+		}
+		if id, er := strconv.ParseUint(strings.TrimSuffix(name, logSegmentExt), 10, 64); er == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	// Від найновішого сегмента: ущільнений сегмент замінює всі старші за нього від first
+	var kept []*logSegment
+	staleFrom := ^uint64(0)
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		if id >= staleFrom {
+			// Сегмент уже переписаний в ущільнений, видалити його ущільнення не встигло
+			os.Remove(e.segmentPath(id))
+			os.Remove(e.hintPath(id))
+			continue
+		}
+		seg, er := e.openSegment(id)
+		if er != nil {
+			return er
+		}
+		e.segments[id] = seg
+		kept = append(kept, seg)
+		staleFrom = seg.first
+	}
+	slices.Reverse(kept)
+
+	for i, seg := range kept {
+		if hints, ok := e.readHint(seg); ok {
+			for _, h := range hints {
+				e.apply(seg, h)
+			}
+			continue
+		}
+		var hints []logHint
+		valid, er := seg.scan(func(rec logRecord, offset int64) error {
+			h := logHint{key: rec.key, tombstone: rec.tombstone, offset: offset, size: rec.size()}
+			hints = append(hints, h)
+			e.apply(seg, h)
+			return nil
+		})
+		if er != nil {
+			if i < len(kept)-1 {
+				return er
+			}
+			// Хвіст останнього сегмента - запис, обірваний аварійним завершенням
+			slog.Warn("log segment tail truncated", slog.String("segment", e.segmentPath(seg.id)), slog.String("error", er.Error()))
+			if er := seg.file.Truncate(valid); er != nil {
+				return er
+			}
+			seg.size = valid
+		}
+		e.writeHint(seg, hints)
+	}
+	return nil
+}
+
+// apply робить запис останнім для його ключа; попередній запис ключа стає сміттям
+func (e *logEngine) apply(seg *logSegment, h logHint) {
+	if old, exists := e.keydir[h.key]; exists {
+		e.segments[old.segment].dead += old.size
+	}
+	if h.tombstone {
+		delete(e.keydir, h.key)
+		seg.dead += h.size
+		return
+	}
+	e.keydir[h.key] = logLocation{segment: seg.id, offset: h.offset, size: h.size}
+}
+
+func (e *logEngine) Get(key string) (Document, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	loc, exists := e.keydir[key]
+	if !exists {
+		return Document{}, false, nil
+	}
+	rec, er := readLogRecord(io.NewSectionReader(e.segments[loc.segment].file, loc.offset, loc.size), loc.size)
+	if er != nil {
+		return Document{}, false, fmt.Errorf("segment %d offset %d: %w", loc.segment, loc.offset, er)
+	}
+	doc, er := decodeDocument(key, rec.value)
+	return doc, er == nil, er
+}
+
+func (e *logEngine) Put(key string, doc Document) error {
+	value, er := json.Marshal(doc)
+	if er != nil {
+		return er
+	}
+	return e.append(logRecord{key: key, value: value})
+}
+
+func (e *logEngine) Delete(key string) error {
+	e.mu.RLock()
+	_, exists := e.keydir[key]
+	e.mu.RUnlock()
+	if !exists {
+		return nil
+	}
+	return e.append(logRecord{key: key, tombstone: true})
+}
+
+// append дописує запис в активний сегмент; заповнений сегмент закривається перед записом
+func (e *logEngine) append(rec logRecord) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data := rec.encode()
+	if e.active.size > logSegmentHeader && e.active.size+int64(len(data)) > e.segmentSize {
+		if er := e.roll(); er != nil {
+			return er
+		}
+	}
+	seg := e.active
+	if _, er := seg.file.WriteAt(data, seg.size); er != nil {
+		return fmt.Errorf("append to segment %d: %w", seg.id, er)
+	}
+	if e.sync {
+		if er := seg.file.Sync(); er != nil {
+			return er
+		}
+	}
+	h := logHint{key: rec.key, tombstone: rec.tombstone, offset: seg.size, size: int64(len(data))}
+	seg.size += h.size
+	e.hints = append(e.hints, h)
+	e.apply(seg, h)
+	return nil
+}
+
+// roll закриває активний сегмент і починає новий
+func (e *logEngine) roll() error {
+	if er := e.seal(); er != nil {
+		return er
+	}
+	seg, er := e.create(e.active.id + 1)
+	if er != nil {
+		return er
+	}
+	e.active = seg
+	e.maybeCompact()
+	return nil
+}
+
+// seal скидає активний сегмент на диск і пише його hint-файл
+func (e *logEngine) seal() error {
+	if er := e.active.file.Sync(); er != nil {
+		return er
+	}
+	e.writeHint(e.active, e.hints)
+	e.hints = nil
+	return nil
+}
+
+func (e *logEngine) Len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.keydir)
+}
+
+func (e *logEngine) Scan(from string, fn func(key string, doc Document) bool) error {
+	e.mu.RLock()
+	keys := make([]string, 0, len(e.keydir))
+	for key := range e.keydir {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	e.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc, exists, er := e.Get(key)
+		if er != nil {
+			return er
+		}
+		if exists && !fn(key, doc) {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *logEngine) Drop() error {
+	e.stop()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, seg := range e.segments {
+		seg.file.Close()
+	}
+	clear(e.keydir)
+	clear(e.segments)
+	return os.RemoveAll(e.dir)
+}
+
+// Sync скидає активний сегмент; закриті сегменти та результати ущільнення вже на диску
+func (e *logEngine) Sync() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.active.file.Sync()
+}
+
+// Close чекає на ущільнення і закриває активний сегмент; порожній активний сегмент видаляється
+func (e *logEngine) Close() error {
+	e.stop()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var er error
+	if e.active.size == logSegmentHeader {
+		e.active.file.Close()
+		delete(e.segments, e.active.id)
+		er = os.Remove(e.segmentPath(e.active.id))
+	} else {
+		er = e.seal()
+	}
+	for _, seg := range e.segments {
+		er = errors.Join(er, seg.file.Close())
+	}
+	return er
+}
+
+// stop зупиняє ущільнення та чекає, доки воно прибере за собою
+func (e *logEngine) stop() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+// maybeCompact запускає фонове ущільнення, якщо в закритих сегментах забагато сміття
+// або самих сегментів; викликається під e.mu
+func (e *logEngine) maybeCompact() {
+	if e.compacting || e.closed {
+		return
+	}
+	var sealed []*logSegment
+	var size, dead int64
+	for _, seg := range e.segments {
+		if seg != e.active {
+			sealed = append(sealed, seg)
+			size += seg.size
+			dead += seg.dead
+		}
+	}
+	if len(sealed) == 0 || (2*dead < size && len(sealed) < compactSegments) {
+		return
+	}
+	slices.SortFunc(sealed, func(a, b *logSegment) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	e.compacting = true
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		if er := e.compact(sealed); er != nil && !errors.Is(er, errLogClosed) {
+			slog.Error("log segments not compacted", slog.String("dir", e.dir), slog.String("error", er.Error()))
+		}
+	}()
+}
+
+// compact переписує живі записи закритих сегментів в один сегмент з id найновішого з них.
+// Записи копіюються без блокування: закриті сегменти не змінюються, а документ, перезаписаний
+// під час ущільнення, лишається за новішим записом в активному сегменті.
+func (e *logEngine) compact(sealed []*logSegment) error {
+	defer func() {
+		e.mu.Lock()
+		e.compacting = false
+		e.mu.Unlock()
+	}()
+
+	last := sealed[len(sealed)-1]
+	path := e.segmentPath(last.id) + logCompactExt
+	out := &logSegment{id: last.id, first: sealed[0].first}
+	hints, moved, er := e.writeCompacted(path, out, sealed)
+	if er == nil {
+		out.file, er = os.OpenFile(path, os.O_RDWR, 0644)
+	}
+	if er != nil {
+		os.Remove(path)
+		return er
+	}
+	return e.install(out, sealed, hints, moved)
+}
+
+// install замінює сегменти sealed ущільненим сегментом out. Записи, перезаписані після
+// копіювання, лишаються в keydir за новішими місцями, а їхні копії в out стають сміттям.
+func (e *logEngine) install(out *logSegment, sealed []*logSegment, hints []logHint, moved []logLocation) error {
+	path := e.segmentPath(out.id) + logCompactExt
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		out.file.Close()
+		os.Remove(path)
+		return errLogClosed
+	}
+	// Після rename відкриття бачить ущільнений сегмент і видаляє замінені ним старші
+	if er := os.Rename(path, e.segmentPath(out.id)); er != nil {
+		out.file.Close()
+		os.Remove(path)
+		return er
+	}
+	for i, h := range hints {
+		if e.keydir[h.key] == moved[i] {
+			e.keydir[h.key] = logLocation{segment: out.id, offset: h.offset, size: h.size}
+		} else {
+			out.dead += h.size
+		}
+	}
+	for _, seg := range sealed {
+		seg.file.Close()
+		os.Remove(e.hintPath(seg.id))
+		if seg.id != out.id {
+			os.Remove(e.segmentPath(seg.id))
+		}
+		delete(e.segments, seg.id)
+	}
+	e.segments[out.id] = out
+	e.writeHint(out, hints)
+	return nil
+}
+
+// writeCompacted пише живі записи сегментів sealed у файл path і повертає їхні нові hint-записи
+// та місця, з яких їх скопійовано
+func (e *logEngine) writeCompacted(path string, out *logSegment, sealed []*logSegment) ([]logHint, []logLocation, error) {
+	file, er := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if er != nil {
+		return nil, nil, er
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	w.Write(encodeLogHeader(out.first))
+	out.size = logSegmentHeader
+	var hints []logHint
+	var moved []logLocation
+	for _, seg := range sealed {
+		_, er := seg.scan(func(rec logRecord, offset int64) error {
+			if rec.tombstone {
+				return nil
+			}
+			e.mu.RLock()
+			loc, live := e.keydir[rec.key]
+			closed := e.closed
+			e.mu.RUnlock()
+			if closed {
+				return errLogClosed
+			}
+			if !live || loc.segment != seg.id || loc.offset != offset {
+				return nil
+			}
+			data := rec.encode()
+			if _, er := w.Write(data); er != nil {
+				return er
+			}
+			hints = append(hints, logHint{key: rec.key, offset: out.size, size: int64(len(data))})
+			moved = append(moved, loc)
+			out.size += int64(len(data))
+			return nil
+		})
+		if er != nil {
+			return nil, nil, er
+		}
+	}
+	if er := w.Flush(); er != nil {
+		return nil, nil, er
+	}
+	return hints, moved, file.Sync()
+}
+
+// create починає новий сегмент; заголовок пишеться через rename, тож сегмент завжди має цілий заголовок
+func (e *logEngine) create(id uint64) (*logSegment, error) {
+	path := e.segmentPath(id)
+	if er := writeFileAtomic(path, encodeLogHeader(id)); er != nil {
+		return nil, er
+	}
+	file, er := os.OpenFile(path, os.O_RDWR, 0644)
+	if er != nil {
+		return nil, er
+	}
+	seg := &logSegment{id: id, first: id, file: file, size: logSegmentHeader}
+	e.segments[id] = seg
+	return seg, nil
+}
+
+func (e *logEngine) openSegment(id uint64) (*logSegment, error) {
+	file, er := os.OpenFile(e.segmentPath(id), os.O_RDWR, 0644)
+	if er != nil {
+		return nil, er
+	}
+	info, er := file.Stat()
+	if er != nil {
+		file.Close()
+		return nil, er
+	}
+	header := make([]byte, logSegmentHeader)
+	if _, er := file.ReadAt(header, 0); er != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: segment %d has no header", err.ErrStorageCorrupted, id)
+	}
+	first := binary.LittleEndian.Uint64(header[8:16])
+	if binary.LittleEndian.Uint32(header[0:4]) != logMagic || binary.LittleEndian.Uint32(header[4:8]) != logVersion || first > id {
+		file.Close()
+		return nil, fmt.Errorf("%w: segment %d has invalid header", err.ErrStorageCorrupted, id)
+	}
+	return &logSegment{id: id, first: first, file: file, size: info.Size()}, nil
+}
+
+func (e *logEngine) segmentPath(id uint64) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%010d%s", id, logSegmentExt))
+}
+
+func (e *logEngine) hintPath(id uint64) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%010d%s", id, logHintExt))
+}
+
+// writeHint записує hint-файл сегмента. Без hint-файлу відкриття читає весь сегмент,
+// тож помилка лише сповільнює наступне відкриття.
+func (e *logEngine) writeHint(seg *logSegment, hints []logHint) {
+	buf := make([]byte, logHintHeader, logHintHeader+len(hints)*32)
+	binary.LittleEndian.PutUint32(buf[0:4], logMagic)
+	binary.LittleEndian.PutUint64(buf[4:12], seg.first)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(seg.size))
+	for _, h := range hints {
+		var flag byte
+		if h.tombstone {
+			flag = 1
+		}
+		buf = append(buf, flag)
+		buf = binary.AppendUvarint(buf, uint64(len(h.key)))
+		buf = append(buf, h.key...)
+		buf = binary.AppendUvarint(buf, uint64(h.offset))
+		buf = binary.AppendUvarint(buf, uint64(h.size))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	if er := writeFileAtomic(e.hintPath(seg.id), buf); er != nil {
+		slog.Warn("log hint file not written", slog.String("segment", e.segmentPath(seg.id)), slog.String("error", er.Error()))
+	}
+}
+
+// readHint читає hint-файл сегмента; ok == false, якщо файлу немає або він не відповідає сегменту
+func (e *logEngine) readHint(seg *logSegment) (hints []logHint, ok bool) {
+	buf, er := os.ReadFile(e.hintPath(seg.id))
+	if er != nil || len(buf) < logHintHeader+4 {
+		return nil, false
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[len(body):]) ||
+		binary.LittleEndian.Uint32(body[0:4]) != logMagic ||
+		binary.LittleEndian.Uint64(body[4:12]) != seg.first ||
+		binary.LittleEndian.Uint64(body[12:20]) != uint64(seg.size) {
+		return nil, false
+	}
+	for rest := body[logHintHeader:]; len(rest) > 0; {
+		h := logHint{tombstone: rest[0] == 1}
+		keyLen, n := binary.Uvarint(rest[1:])
+		if n <= 0 || uint64(len(rest)-1-n) < keyLen {
+			return nil, false
+		}
+		rest = rest[1+n:]
+		h.key, rest = string(rest[:keyLen]), rest[keyLen:]
+		offset, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, false
+		}
+		size, m := binary.Uvarint(rest[n:])
+		if m <= 0 {
+			return nil, false
+		}
+		rest = rest[n+m:]
+		h.offset, h.size = int64(offset), int64(size)
+		if h.offset < logSegmentHeader || h.offset+h.size > seg.size {
+			return nil, false
+		}
+		hints = append(hints, h)
+	}
+	return hints, true
+}
+
+// scan читає записи сегмента по черзі; повертає кінець останнього цілого запису
+func (seg *logSegment) scan(fn func(rec logRecord, offset int64) error) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(seg.file, logSegmentHeader, seg.size-logSegmentHeader))
+	offset := int64(logSegmentHeader)
+	for offset < seg.size {
+		rec, er := readLogRecord(r, seg.size-offset)
+		if er != nil {
+			return offset, fmt.Errorf("segment %d offset %d: %w", seg.id, offset, er)
+		}
+		if er := fn(rec, offset); er != nil {
+			return offset, er
+		}
+		offset += rec.size()
+	}
+	return offset, nil
+}
+
+func encodeLogHeader(first uint64) []byte {
+	buf := make([]byte, logSegmentHeader)
+	binary.LittleEndian.PutUint32(buf[0:4], logMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], logVersion)
+	binary.LittleEndian.PutUint64(buf[8:16], first)
+	return buf
+}
+
+func (r logRecord) encode() []byte {
+	buf := make([]byte, r.size())
+	if r.tombstone {
+		buf[4] = 1
+	}
+	binary.LittleEndian.PutUint32(buf[5:9], uint32(len(r.key)))
+	binary.LittleEndian.PutUint32(buf[9:13], uint32(len(r.value)))
+	copy(buf[logRecordHeader:], r.key)
+	copy(buf[logRecordHeader+len(r.key):], r.value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readLogRecord читає запис з r, в якому лишилося remaining байтів сегмента
+func readLogRecord(r io.Reader, remaining int64) (logRecord, error) {
+	header := make([]byte, logRecordHeader)
+	if remaining < logRecordHeader {
+		return logRecord{}, fmt.Errorf("%w: truncated record header", err.ErrStorageCorrupted)
+	}
+	if _, er := io.ReadFull(r, header); er != nil {
+		return logRecord{}, er
+	}
+	keyLen := int64(binary.LittleEndian.Uint32(header[5:9]))
+	valueLen := int64(binary.LittleEndian.Uint32(header[9:13]))
+	if header[4] > 1 || logRecordHeader+keyLen+valueLen > remaining {
+		return logRecord{}, fmt.Errorf("%w: invalid record header", err.ErrStorageCorrupted)
+	}
+	body := make([]byte, keyLen+valueLen)
+	if _, er := io.ReadFull(r, body); er != nil {
+		return logRecord{}, er
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+		return logRecord{}, fmt.Errorf("%w: record checksum mismatch", err.ErrStorageCorrupted)
+	}
+	return logRecord{key: string(body[:keyLen]), value: body[keyLen:], tombstone: header[4] == 1}, nil
+}
@@ -0,0 +1,218 @@
+package documentstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func logTestOpen(t *testing.T, dir string, segmentSize int64) *logEngine {
+	t.Helper()
+	e, er := OpenLogEngine(dir, segmentSize, false)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return e.(*versioned).backend.(*logEngine)
+}
+
+func logTestFiles(t *testing.T, dir, ext string) int {
+	t.Helper()
+	entries, er := os.ReadDir(dir)
+	if er != nil {
+		t.Fatal(er)
+	}
+	n := 0
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ext) {
+			n++
+		}
+	}
+	return n
+}
+
+func logTestSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+logSegmentExt))
+	var size int64
+	for _, path := range paths {
+		info, er := os.Stat(path)
+		if er != nil {
+			t.Fatal(er)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func TestLogEngine_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	e := logTestOpen(t, dir, 512)
+	want := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%02d", i%40)
+		if i%7 == 0 {
+			e.Delete(key)
+			delete(want, key)
+			continue
+		}
+		name := fmt.Sprintf("v%d", i)
+		if er := e.Put(key, walTestDocument(key, name)); er != nil {
+			t.Fatal(er)
+		}
+		want[key] = name
+	}
+	// Ущільнення йде у фоні, поки пишуться нові сегменти; після останнього сміття лишається
+	// менше половини закритих сегментів, тож на диску лише кілька кілобайтів із записаних ~200
+	e.wg.Wait()
+	e.mu.Lock()
+	e.maybeCompact()
+	e.mu.Unlock()
+	e.wg.Wait()
+	if size := logTestSize(t, dir); size > 16<<10 {
+		t.Errorf("segments take %d bytes after compaction", size)
+	}
+	storageTestCheck(t, e, want)
+	e.Close()
+
+	// Відкриття бере ключі з hint-файлів закритих сегментів, не читаючи документів
+	reopened := logTestOpen(t, dir, 512)
+	defer reopened.Close()
+	if n := logTestFiles(t, dir, logHintExt); n != len(reopened.segments)-1 {
+		t.Errorf("%d hint files for %d sealed segments", n, len(reopened.segments)-1)
+	}
+	storageTestCheck(t, reopened, want)
+}
+
+func TestLogEngine_CompactWhileWriting(t *testing.T) {
+	e := logTestOpen(t, t.TempDir(), 1<<20)
+	defer e.Close()
+	for i := 0; i < 20; i++ {
+		e.Put(fmt.Sprintf("k%02d", i), walTestDocument("k", "old"))
+	}
+	e.Delete("k00")
+	e.mu.Lock()
+	e.roll()
+	sealed := []*logSegment{e.segments[1]}
+	e.mu.Unlock()
+
+	path := e.segmentPath(1) + logCompactExt
+	out := &logSegment{id: 1, first: 1}
+	hints, moved, er := e.writeCompacted(path, out, sealed)
+	if er != nil || len(hints) != 19 {
+		t.Fatalf("writeCompacted() = %d records, %v, want 19", len(hints), er)
+	}
+	out.file, _ = os.OpenFile(path, os.O_RDWR, 0644)
+	// Документ, перезаписаний між копіюванням і заміною сегментів, лишається за новішим записом
+	e.Put("k01", walTestDocument("k", "new"))
+	if er := e.install(out, sealed, hints, moved); er != nil {
+		t.Fatal(er)
+	}
+	if e.Len() != 19 || e.keydir["k01"].segment != e.active.id || e.keydir["k02"].segment != 1 {
+		t.Errorf("keydir after compaction = %v", e.keydir)
+	}
+	if doc, _, _ := e.Get("k01"); doc.Fields["name"].Value != "new" {
+		t.Errorf("Get(k01) = %v, want new", doc.Fields["name"].Value)
+	}
+	if doc, _, _ := e.Get("k02"); doc.Fields["name"].Value != "old" {
+		t.Errorf("Get(k02) = %v, want old", doc.Fields["name"].Value)
+	}
+}
+
+func TestLogEngine_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	e := logTestOpen(t, dir, 0)
+	e.Put("a", walTestDocument("a", "v1"))
+	e.Put("b", walTestDocument("b", "v1"))
+	active := e.segmentPath(e.active.id)
+	// Аварійне завершення: hint-файлу немає, останній запис обірвано
+	data := (logRecord{key: "c", value: []byte(`{}`)}).encode()
+	e.active.file.WriteAt(data[:len(data)-1], e.active.size)
+	for _, seg := range e.segments {
+		seg.file.Close()
+	}
+
+	reopened := logTestOpen(t, dir, 0)
+	defer reopened.Close()
+	if got, want := storageTestScan(t, reopened.Scan, ""), []string{"a:v1", "b:v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() after torn write = %v, want %v", got, want)
+	}
+	if info, _ := os.Stat(active); info.Size() != reopened.segments[1].size {
+		t.Errorf("torn tail not truncated: file %d bytes, segment %d", info.Size(), reopened.segments[1].size)
+	}
+	if _, er := os.Stat(filepath.Join(dir, "0000000001"+logHintExt)); er != nil {
+		t.Errorf("hint file of recovered segment: %v", er)
+	}
+}
+
+func TestCollection_LogEngine(t *testing.T) {
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineLog, Path: filepath.Join(t.TempDir(), "users"), SegmentSize: 1024}}
+	s := NewStore()
+	er, users := s.CreateCollectionWithConfig("users", cfg)
+	if er != nil {
+		t.Fatal(er)
+	}
+	users.CreateIndex("name")
+	for i := 0; i < 300; i++ {
+		users.Put(walTestDocument(fmt.Sprintf("u%02d", i%50), fmt.Sprintf("name%d", i)))
+	}
+	users.Delete("u00")
+	docs, _ := users.Find(Filter{"name": "name299"})
+	if got, want := indexTestIDs(docs), []string{"u49"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find() = %v, want %v", got, want)
+	}
+	s.Close()
+
+	reopened := NewStore()
+	defer reopened.Close()
+	_, users = reopened.CreateCollectionWithConfig("users", cfg)
+	if ids := indexTestIDs(users.List()); len(ids) != 49 || ids[0] != "u01" {
+		t.Errorf("List() after reopen = %v", ids)
+	}
+	if doc, er := users.Get("u10"); er != nil || doc.Fields["name"].Value != "name260" {
+		t.Errorf("Get() after reopen = %v, %v", doc, er)
+	}
+}
+
+func TestNewStoreWithWAL_LogEngineRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineLog, Path: filepath.Join(dir, "users")}}
+	s, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, users := s.CreateCollectionWithConfig("users", cfg)
+	users.CreateIndex("name")
+	for i := 0; i < 50; i++ {
+		users.Put(walTestDocument(fmt.Sprintf("u%02d", i), fmt.Sprintf("name%d", i%5)))
+	}
+	users.Delete("u00")
+	s.Close()
+	size := logTestSize(t, cfg.Engine.Path)
+
+	// Ні журнал, ні снапшот не переписують документів, які рушій уже зберіг
+	for i := 0; i < 3; i++ {
+		restored, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+		if er != nil {
+			t.Fatal(er)
+		}
+		users, _ := restored.GetCollection("users")
+		if docs, _ := users.Find(Filter{"name": "name0"}); len(docs) != 9 {
+			t.Errorf("Find() after restart %d returned %d documents, want 9", i, len(docs))
+		}
+		if res, er := users.Insert(walTestDocument(fmt.Sprintf("new%d", i), "new")); er != nil || res.Revision != uint64(52+2*i) {
+			t.Errorf("Insert() after restart %d = %+v, %v, want revision %d", i, res, er, 52+2*i)
+		}
+		users.Delete(fmt.Sprintf("new%d", i))
+		if i == 1 {
+			restored.Checkpoint()
+		}
+		restored.Close()
+	}
+	// Кожен перезапуск дописав лише вставку та видалення одного документа
+	if grown := logTestSize(t, cfg.Engine.Path) - size; grown > 3*512 {
+		t.Errorf("segments grew by %d bytes over 3 restarts", grown)
+	}
+}
@@ -0,0 +1,295 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memoryTestEngine створює рушій у пам'яті з готовими документами, як їх задають табличні тести
+func memoryTestEngine(docs map[string]Document) StorageEngine {
+	e := NewMemoryEngine()
+	for key, doc := range docs {
+		e.Put(key, doc)
+	}
+	return e
+}
+
+func storageTestScan(t *testing.T, scan func(from string, fn func(key string, doc Document) bool) error, from string) []string {
+	t.Helper()
+	var got []string
+	er := scan(from, func(key string, doc Document) bool {
+		got = append(got, key+":"+doc.Fields["name"].Value.(string))
+		return true
+	})
+	if er != nil {
+		t.Fatal(er)
+	}
+	return got
+}
+
+// storageTestCheck порівнює вміст рушія з очікуваною мапою ключ -> ім'я
+func storageTestCheck(t *testing.T, e backend, want map[string]string) {
+	t.Helper()
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var got []string
+	er := e.Scan("", func(key string, doc Document) bool {
+		if name := doc.Fields["name"].Value; name != want[key] {
+			t.Fatalf("Scan() document %s = %v, want %v", key, name, want[key])
+		}
+		got = append(got, key)
+		return true
+	})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if !reflect.DeepEqual(got, keys) && len(keys) > 0 {
+		t.Fatalf("Scan() returned %d keys, want %d", len(got), len(keys))
+	}
+	if e.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", e.Len(), len(want))
+	}
+	for _, key := range keys[:min(len(keys), 50)] {
+		doc, exists, er := e.Get(key)
+		if er != nil || !exists || doc.Fields["name"].Value != want[key] {
+			t.Fatalf("Get(%s) = %v, %v, %v", key, doc, exists, er)
+		}
+	}
+}
+
+func TestStorageEngines(t *testing.T) {
+	engines := map[string]func(t *testing.T) StorageEngine{
+		"memory": func(t *testing.T) StorageEngine { return NewMemoryEngine() },
+		"file": func(t *testing.T) StorageEngine {
+			e, er := OpenFileEngine(t.TempDir(), false)
+			if er != nil {
+				t.Fatal(er)
+			}
+			return e
+		},
+		"btree": func(t *testing.T) StorageEngine {
+			e, er := OpenBTreeEngine(filepath.Join(t.TempDir(), "data.btree"), 2, false)
+			if er != nil {
+				t.Fatal(er)
+			}
+			return e
+		},
+		"log": func(t *testing.T) StorageEngine {
+			e, er := OpenLogEngine(t.TempDir(), 64, false)
+			if er != nil {
+				t.Fatal(er)
+			}
+			return e
+		},
+	}
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			e := open(t)
+			defer e.Close()
+			for _, id := range []string{"c", "a", "d", "b"} {
+				if er := e.Put(id, walTestDocument(id, "v1")); er != nil {
+					t.Fatal(er)
+				}
+			}
+			e.Put("c", walTestDocument("c", "v2"))
+			e.Delete("d")
+			e.Delete("missing")
+
+			if got := e.Len(); got != 3 {
+				t.Errorf("Len() = %d, want 3", got)
+			}
+			doc, exists, er := e.Get("c")
+			if er != nil || !exists || doc.Fields["name"].Value != "v2" {
+				t.Errorf("Get() = %v, %v, %v", doc, exists, er)
+			}
+			if _, exists, _ := e.Get("d"); exists {
+				t.Errorf("Get() of deleted document exists")
+			}
+			if got, want := storageTestScan(t, e.Scan, "b"), []string{"b:v1", "c:v2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Scan(b) = %v, want %v", got, want)
+			}
+
+			snap := e.Snapshot()
+			e.Put("a", walTestDocument("a", "v3"))
+			e.Delete("b")
+			e.Put("e", walTestDocument("e", "v1"))
+			e.Put("0", walTestDocument("0", "v1"))
+			if got, want := storageTestScan(t, snap.Scan, ""), []string{"a:v1", "b:v1", "c:v2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot Scan() = %v, want %v", got, want)
+			}
+			if _, exists, _ := snap.Get("e"); exists {
+				t.Errorf("snapshot Get() sees document written after it")
+			}
+			snap.Release()
+			if got, want := storageTestScan(t, e.Scan, ""), []string{"0:v1", "a:v3", "c:v2", "e:v1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Scan() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCollection_FileEngine(t *testing.T) {
+	dir := t.TempDir()
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineFile, Path: filepath.Join(dir, "users")}}
+	s := NewStore()
+	er, users := s.CreateCollectionWithConfig("users", cfg)
+	if er != nil {
+		t.Fatal(er)
+	}
+	users.CreateIndex("name")
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.Put(walTestDocument("u2", "Taras"))
+	users.Put(walTestDocument("u3", "Andrii"))
+	users.Delete("u2")
+
+	docs, _ := users.Query("name", QueryParams{MinValue: "Andrii", MaxValue: "Andrii"})
+	if got, want := indexTestIDs(docs), []string{"u1", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+	s.Close()
+
+	// Нова колекція з тим самим каталогом бачить документи без журналу та дампу
+	reopened := NewStore()
+	_, users = reopened.CreateCollectionWithConfig("users", cfg)
+	if got, want := indexTestIDs(users.List()), []string{"u1", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() after reopen = %v, want %v", got, want)
+	}
+	res, er := users.Insert(walTestDocument("u4", "Olena"))
+	if er != nil || res.Revision <= 3 {
+		t.Errorf("Insert() after reopen = %+v, %v, want revision after 3", res, er)
+	}
+
+	// Задовгий ключ відхиляється до запису, а не помилкою файлової системи
+	long := strings.Repeat("k", fileEngineMaxKey+1)
+	if _, er := users.Insert(walTestDocument(long, "Olena")); !errors.Is(er, err.ErrKeyTooLong) {
+		t.Errorf("Insert() with %d byte key error = %v, want %v", len(long), er, err.ErrKeyTooLong)
+	}
+	if er := users.Put(walTestDocument(long[1:], "Olena")); er != nil {
+		t.Errorf("Put() with %d byte key: %v", len(long)-1, er)
+	}
+
+	if !reopened.DeleteCollection("users") {
+		t.Fatal("DeleteCollection() = false")
+	}
+	if _, er := os.Stat(cfg.Engine.Path); !errors.Is(er, os.ErrNotExist) {
+		t.Errorf("engine directory after DeleteCollection(): %v", er)
+	}
+}
+
+func TestCollection_FileEngineRecovery(t *testing.T) {
+	dir := t.TempDir()
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineFile, Path: filepath.Join(dir, "users"), Sync: true}}
+	s, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	s.CreateCollectionWithConfig("users", cfg)
+	users, _ := s.GetCollection("users")
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.Put(walTestDocument("u2", "Taras"))
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	users.Delete("u1")
+	users.Put(walTestDocument("u3", "Olena"))
+	s.Close()
+
+	restored, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	coll, _ := restored.GetCollection("users")
+	if got, want := indexTestIDs(coll.List()), []string{"u2", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered List() = %v, want %v", got, want)
+	}
+	if got := coll.ToDto().Config.Engine; got != cfg.Engine {
+		t.Errorf("recovered engine = %+v, want %+v", got, cfg.Engine)
+	}
+}
+
+func TestLoadFrom_EngineInUse(t *testing.T) {
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineBTree, Path: filepath.Join(t.TempDir(), "users.btree")}}
+	source := NewStore()
+	_, users := source.CreateCollectionWithConfig("users", cfg)
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.Put(walTestDocument("u2", "Taras"))
+	dump, er := source.Dump()
+	if er != nil {
+		t.Fatal(er)
+	}
+	users.Delete("u2")
+
+	// Дамп відкритого стору не відкриває другий рушій на тому ж файлі і не переписує його
+	if _, er := NewStoreFromDump(dump); !errors.Is(er, err.ErrEnginePathInUse) {
+		t.Errorf("NewStoreFromDump() of open store error = %v, want %v", er, err.ErrEnginePathInUse)
+	}
+	if er, _ := NewStore().CreateCollectionWithConfig("copy", cfg); !errors.Is(er, err.ErrEnginePathInUse) {
+		t.Errorf("CreateCollectionWithConfig() on open path error = %v, want %v", er, err.ErrEnginePathInUse)
+	}
+	if got, want := indexTestIDs(users.List()), []string{"u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("source List() = %v, want %v", got, want)
+	}
+
+	// Після Close шлях вільний
+	source.Close()
+	restored, er := NewStoreFromDump(dump)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	users, _ = restored.GetCollection("users")
+	if got, want := indexTestIDs(users.List()), []string{"u1", "u2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored List() = %v, want %v", got, want)
+	}
+}
+
+func TestCollectionConfig_Engine(t *testing.T) {
+	s := NewStore()
+	for _, opts := range []EngineOptions{{Type: "tape"}, {Type: EngineFile}} {
+		if er, _ := s.CreateCollectionWithConfig("bad", CollectionConfig{PrimaryKey: "id", Engine: opts}); !errors.Is(er, err.ErrInvalidCollectionConfig) {
+			t.Errorf("CreateCollectionWithConfig(%+v) error = %v, want %v", opts, er, err.ErrInvalidCollectionConfig)
+		}
+	}
+}
+
+func TestNewStoreWithWAL_EngineBehindLog(t *testing.T) {
+	dir := t.TempDir()
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineFile, Path: filepath.Join(dir, "users")}}
+	s, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, users := s.CreateCollectionWithConfig("users", cfg)
+	users.Put(walTestDocument("u1", "old"))
+	old, _ := users.Get("u1")
+	users.Put(walTestDocument("u1", "new"))
+	s.Close()
+
+	// Збій між журналом і рушієм: останнього запису рушій не має
+	engine, er := OpenFileEngine(cfg.Engine.Path, false)
+	if er != nil {
+		t.Fatal(er)
+	}
+	engine.Put("u1", *old)
+	engine.Close()
+
+	restored, er := NewStoreWithWAL(filepath.Join(dir, "wal"), WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	users, _ = restored.GetCollection("users")
+	if doc, er := users.Get("u1"); er != nil || doc.Fields["name"].Value != "new" || doc.Revision != 2 {
+		t.Errorf("Get() after recovery = %v, %v, want new document with revision 2", doc, er)
+	}
+}
@@ -1,16 +1,22 @@
 package documentstore
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
 	"lesson4/pkg/err"
 	"log/slog"
 	"os"
-	"strings"
+	"sync"
+	"time"
 )
 
 type Store struct {
+	mu          sync.RWMutex // захищає мапу collections
 	collections map[string]*Collection
+	wal         *wal     // nil, якщо стор створено без журналу
+	dir         string   // каталог снапшоту та журналу
+	sweeper     *sweeper // nil, якщо StartSweeper не викликали
 }
 
 func NewStore() *Store {
@@ -19,29 +25,58 @@ func NewStore() *Store {
 	}
 }
 
+// dumpVersion - версія формату дампу; дампи без версії (0) мають той самий формат без індексів,
+// у версії 1 індекс описувався одним полем "field"
+const dumpVersion = 2
+
 type DTOStore struct {
+	Version     int                      `json:"version"`
 	Collections map[string]DTOCollection `json:"collections"`
 }
 
+// ToDto повертає DTO стору на один момент часу; документи читаються зі знімка,
+// тож записи в колекції не чекають, доки дамп буде готовий
 func (s *Store) ToDto() DTOStore {
-	dtoCollections := make(map[string]DTOCollection, len(s.collections))
-	for name, coll := range s.collections {
-		dtoCollections[name] = coll.ToDto()
-	}
-	return DTOStore{
-		Collections: dtoCollections,
-	}
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	dto, _ := snap.toDto() // знімок ще не закритий, тож помилки бути не може
+	return dto
 }
+
 func (s *Store) CreateCollection(name, id string) (error, *Collection) {
 	// Створюємо нову колекцію і повертаємо `true` якщо колекція була створена
 	// Якщо ж колекція вже створеня то повертаємо `false` та nil
+	return s.CreateCollectionWithConfig(name, CollectionConfig{
+		PrimaryKey: id,
+	})
+}
+
+// CreateCollectionWithConfig створює колекцію з повною конфігурацією, зокрема з TTL документів
+func (s *Store) CreateCollectionWithConfig(name string, cfg CollectionConfig) (error, *Collection) {
+	if er := cfg.validate(); er != nil {
+		return er, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, exists := s.collections[name]; exists {
 		return err.ErrCollectionAlreadyExists, nil
 	}
-	coll := &Collection{
-		config: CollectionConfig{
-			PrimaryKey: id,
-		}}
+	coll, er := newCollection(name, cfg)
+	if er != nil {
+		return er, nil
+	}
+	if s.wal != nil {
+		if er := s.wal.append(walRecord{Op: walOpCreateCollection, Collection: name, Config: &cfg, Revision: coll.revision}); er != nil {
+			slog.Error("collection not logged", slog.String("error", er.Error()))
+			coll.engine.Close()
+			return er, nil
+		}
+	}
+	coll.wal = s.wal
+	coll.store = s
 	s.collections[name] = coll
 	slog.Info("collection added")
 
@@ -49,6 +84,9 @@ func (s *Store) CreateCollection(name, id string) (error, *Collection) {
 }
 
 func (s *Store) GetCollection(name string) (*Collection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if colect, ok := s.collections[name]; ok {
 		return colect, nil
 	}
@@ -57,7 +95,23 @@ func (s *Store) GetCollection(name string) (*Collection, error) {
 }
 
 func (s *Store) DeleteCollection(name string) bool {
-	if _, ok := s.collections[name]; ok {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if coll, ok := s.collections[name]; ok {
+		if s.wal != nil {
+			if er := s.wal.append(walRecord{Op: walOpDeleteCollection, Collection: name}); er != nil {
+				slog.Error("collection delete not logged", slog.String("error", er.Error()))
+				return false
+			}
+		}
+		// Колекція більше не належить стору, тож її зміни не повинні потрапляти в журнал,
+		// а LookupStage не повинен знаходити через неї інші колекції
+		coll.mu.Lock()
+		coll.wal = nil
+		coll.store = nil
+		coll.drop()
+		coll.mu.Unlock()
 		delete(s.collections, name)
 		slog.Info("collection delete - %s")
 		return true
@@ -68,68 +122,94 @@ func (s *Store) DeleteCollection(name string) bool {
 func NewStoreFromDump(dump []byte) (*Store, error) {
 	// Функція повинна створити та проініціалізувати новий `Store`
 	// зі всіма колекціями та даними з вхідного дампу.
-	var s Store
-	if err := json.Unmarshal(dump, &s); err != nil {
-		return nil, err
+	s, er := LoadFrom(context.Background(), bytes.NewReader(dump), StreamOptions{})
+	if er != nil {
+		return nil, er
 	}
 	if len(s.collections) == 0 {
 		slog.Info("collection not added")
 		return nil, err.ErrNotFound
 	}
-	return &s, nil
+	slog.Info("store loaded from dump", slog.Int("collections", len(s.collections)))
+	return s, nil
 }
 
 func (s *Store) Dump() ([]byte, error) {
 	// Методи повинен віддати дамп нашого стору в який включені дані про колекції та документ
-	sToJson, err := json.MarshalIndent(s, " ", "")
-	if err != nil {
-		return nil, err
+	var buf bytes.Buffer
+	if er := s.DumpTo(context.Background(), &buf, StreamOptions{}); er != nil {
+		return nil, er
 	}
-	return sToJson, nil
+	return buf.Bytes(), nil
+}
+
+// Розширення файлів дампу для кожного формату; NewStoreFromFile шукає файл з будь-яким з них
+const (
+	jsonDumpExt   = ".json"
+	binaryDumpExt = ".dsdb"
+)
+
+func dumpFileExt(format DumpFormat) (string, error) {
+	switch format {
+	case "", DumpJSON:
+		return jsonDumpExt, nil
+	case DumpBinary:
+		return binaryDumpExt, nil
+	}
+	return "", fmt.Errorf("unknown dump format %q", format)
 }
 
 func NewStoreFromFile(filename string) (*Store, error) {
 	// Робить те ж саме що і функція `NewStoreFromDump`, але сам дамп має діставатись з файлу
 
-	fileString := strings.Builder{}
-	fileString.WriteString(filename + ".json")
+	// Формат визначається за заголовком, тож підходить файл з будь-яким розширенням;
+	// якщо є обидва, читається той, що записаний пізніше
+	path := filename + jsonDumpExt
+	var modified time.Time
+	for _, ext := range []string{jsonDumpExt, binaryDumpExt} {
+		if info, err := os.Stat(filename + ext); err == nil && info.ModTime().After(modified) {
+			path, modified = filename+ext, info.ModTime()
+		}
+	}
 
-	dump, err := os.ReadFile(fileString.String())
+	file, err := os.Open(path)
 	if err != nil {
 		slog.Error("file not read")
 		return nil, err
 	}
-	slog.Info("file read successfully " + fileString.String())
-	s := NewStore()
-	var dto DTOStore
-	if err := json.Unmarshal(dump, &dto); err != nil {
-
+	defer file.Close()
+	// Дамп читається потоком, тож файл не потрапляє в пам'ять цілком
+	s, err := LoadFrom(context.Background(), file, StreamOptions{})
+	if err != nil {
 		return nil, err
 	}
-	for name, dtoColl := range dto.Collections {
-		coll := &Collection{
-			documents: dtoColl.Documents,
-			config:    dtoColl.Config,
-		}
-		s.collections[name] = coll
-	}
 	if len(s.collections) == 0 {
 		slog.Error("no collections found in store from file")
 		return nil, fmt.Errorf("no collections in store")
 	}
+	slog.Info("store loaded from file " + path)
 	return s, nil
 }
 
 func (s *Store) DumpToFile(filename string) error {
 	// Робить те ж саме що і метод  `Dump`, але записує у файл замість того щоб повертати сам дамп
-	sDump, err := s.Dump()
-	if err != nil {
+	return s.DumpToFileWithOptions(filename, StreamOptions{})
+}
 
-		fmt.Println(err)
+// DumpToFileWithOptions пише дамп у форматі opts.Format у файл filename з розширенням цього формату:
+// .json для DumpJSON та .dsdb для DumpBinary
+func (s *Store) DumpToFileWithOptions(filename string, opts StreamOptions) error {
+	ext, err := dumpFileExt(opts.Format)
+	if err != nil {
+		return err
 	}
-
-	fileString := strings.Builder{}
-	fileString.WriteString(filename + ".json")
-
-	return os.WriteFile(fileString.String(), sDump, 0644)
+	file, err := os.Create(filename + ext)
+	if err != nil {
+		return err
+	}
+	if err := s.DumpTo(context.Background(), file, opts); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
@@ -2,8 +2,12 @@ package documentstore
 
 import (
 	"errors"
+	"fmt"
 	"lesson4/pkg/err"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -104,7 +108,7 @@ func TestStore_GetCollection(t *testing.T) {
 		{name: "collection exists",
 			fields: fields{
 				Collections: map[string]*Collection{
-					"users": {documents: make(map[string]Document),
+					"users": {engine: NewMemoryEngine(),
 						config: CollectionConfig{
 							PrimaryKey: "id",
 						}},
@@ -161,7 +165,7 @@ func TestStore_DeleteCollection(t *testing.T) {
 		{name: "collection exists",
 			fields: fields{
 				Collections: map[string]*Collection{
-					"users": {documents: make(map[string]Document),
+					"users": {engine: NewMemoryEngine(),
 						config: CollectionConfig{
 							PrimaryKey: "id",
 						}},
@@ -193,3 +197,150 @@ func TestStore_DeleteCollection(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_ConcurrentAccess(t *testing.T) {
+	s := NewStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("coll-%d", (w+i)%5)
+				_, coll := s.CreateCollection(name, "id")
+				if coll == nil {
+					coll, _ = s.GetCollection(name)
+				}
+				if coll != nil {
+					coll.Put(Document{Fields: map[string]DocumentField{
+						"id": {Type: DocumentFieldTypeString, Value: fmt.Sprintf("%d-%d", w, i)},
+					}})
+				}
+				if i%10 == 0 {
+					s.DeleteCollection(name)
+				}
+				if _, err := s.Dump(); err != nil {
+					t.Error(err)
+					return
+				}
+				s.ToDto()
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestStore_DumpRoundTrip(t *testing.T) {
+	source := NewStore()
+	_, users := source.CreateCollection("users", "id")
+	users.Put(Document{Fields: map[string]DocumentField{
+		"id":     {Type: DocumentFieldTypeString, Value: "u1"},
+		"name":   {Type: DocumentFieldTypeString, Value: "Andrii"},
+		"age":    {Type: DocumentFieldTypeNumber, Value: int64(32)},
+		"admin":  {Type: DocumentFieldTypeBool, Value: true},
+		"tags":   {Type: DocumentFieldTypeArray, Value: []any{"a", int64(1)}},
+		"params": {Type: DocumentFieldTypeObject, Value: map[string]any{"x": 1.5}},
+	}})
+	users.Put(Document{Fields: map[string]DocumentField{
+		"id":   {Type: DocumentFieldTypeString, Value: "u2"},
+		"name": {Type: DocumentFieldTypeString, Value: "Taras"},
+	}})
+	// Лічильник ревізій після видалення більший за ревізії документів і теж має відновитися
+	users.Put(Document{Fields: map[string]DocumentField{"id": {Type: DocumentFieldTypeString, Value: "u3"}}})
+	users.Delete("u3")
+	users.CreateIndex("name")
+	source.CreateCollection("orders", "number")
+
+	tests := []struct {
+		name string
+		load func(t *testing.T) (*Store, error)
+	}{
+		{
+			name: "Dump and NewStoreFromDump",
+			load: func(t *testing.T) (*Store, error) {
+				dump, er := source.Dump()
+				if er != nil {
+					t.Fatal(er)
+				}
+				return NewStoreFromDump(dump)
+			},
+		},
+		{
+			name: "DumpToFile and NewStoreFromFile",
+			load: func(t *testing.T) (*Store, error) {
+				filename := filepath.Join(t.TempDir(), "store")
+				if er := source.DumpToFile(filename); er != nil {
+					t.Fatal(er)
+				}
+				return NewStoreFromFile(filename)
+			},
+		},
+		{
+			name: "binary DumpToFileWithOptions and NewStoreFromFile",
+			load: func(t *testing.T) (*Store, error) {
+				filename := filepath.Join(t.TempDir(), "store")
+				if er := source.DumpToFileWithOptions(filename, StreamOptions{Format: DumpBinary}); er != nil {
+					t.Fatal(er)
+				}
+				if _, er := os.Stat(filename + binaryDumpExt); er != nil {
+					t.Fatal(er)
+				}
+				return NewStoreFromFile(filename)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, er := tt.load(t)
+			if er != nil {
+				t.Fatal(er)
+			}
+			if got, want := restored.ToDto(), source.ToDto(); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored store = %+v, want %+v", got, want)
+			}
+			coll, er := restored.GetCollection("users")
+			if er != nil {
+				t.Fatal(er)
+			}
+			docs, er := coll.Query("name", QueryParams{MinValue: "B"})
+			if er != nil {
+				t.Fatal(er)
+			}
+			if len(docs) != 1 || docs[0].Fields["id"].Value != "u2" {
+				t.Errorf("Query() on restored index = %v", docs)
+			}
+		})
+	}
+}
+
+func TestNewStoreFromDump_Versions(t *testing.T) {
+	tests := []struct {
+		name    string
+		dump    string
+		wantErr error
+	}{
+		{
+			name: "legacy dump without version",
+			dump: `{"collections":{"id-1":{"documents":{"id-1":{"fields":{"id-1":{"type":"string","value":"setup.exe"}}}},"config":{"cgg":"id-1"}}}}`,
+		},
+		{
+			name:    "dump without collections",
+			dump:    `{"version":2,"collections":{}}`,
+			wantErr: err.ErrNotFound,
+		},
+		{
+			name:    "dump from a newer version",
+			dump:    `{"version":99,"collections":{}}`,
+			wantErr: err.ErrUnsupportedDumpVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, er := NewStoreFromDump([]byte(tt.dump))
+			if !errors.Is(er, tt.wantErr) {
+				t.Errorf("NewStoreFromDump() error = %v, wantErr %v", er, tt.wantErr)
+			}
+		})
+	}
+}
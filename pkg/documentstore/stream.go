@@ -0,0 +1,553 @@
+package documentstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lesson4/pkg/err"
+	"sort"
+	"time"
+)
+
+// StreamOptions налаштовує DumpTo та LoadFrom
+type StreamOptions struct {
+	// Format - формат, у якому пише DumpTo; LoadFrom визначає формат за заголовком дампу
+	Format DumpFormat
+	// Progress викликається після кожного документа та після кожної колекції; nil - не викликається
+	Progress func(StreamProgress)
+}
+
+type DumpFormat string
+
+const (
+	DumpJSON   DumpFormat = "json"   // JSON, як у Dump; формат за замовчуванням
+	DumpBinary DumpFormat = "binary" // компактні блоки з CRC32, див. dumpBinary
+)
+
+// StreamProgress - скільки дампу вже записано чи прочитано
+type StreamProgress struct {
+	Collection  string // колекція, яка зараз обробляється
+	Collections int    // скільки колекцій оброблено повністю
+	Documents   int    // скільки документів оброблено в усіх колекціях
+	Bytes       int64  // скільки байтів дампу записано чи прочитано
+}
+
+func (o StreamOptions) report(p StreamProgress) {
+	if o.Progress != nil {
+		o.Progress(p)
+	}
+}
+
+// DumpTo пише дамп стору у w по одному документу: у пам'яті не буває ні всього дампу, ні копії
+// колекції. Документи читаються зі знімка, тож записи в стор на цей час не зупиняються.
+// Формат задає opts.Format; скасування ctx перериває запис, і у w лишається неповний дамп.
+func (s *Store) DumpTo(ctx context.Context, w io.Writer, opts StreamOptions) error {
+	switch opts.Format {
+	case "", DumpJSON, DumpBinary:
+	default:
+		return fmt.Errorf("unknown dump format %q", opts.Format)
+	}
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	if opts.Format == DumpBinary {
+		return snap.dumpBinary(ctx, w, opts)
+	}
+	return snap.dumpTo(ctx, w, opts)
+}
+
+// dumpWriter запам'ятовує першу помилку запису, тож дамп пишеться без перевірки кожного кроку
+type dumpWriter struct {
+	w  *bufio.Writer
+	n  int64
+	er error
+}
+
+func (d *dumpWriter) raw(s string) {
+	if d.er != nil {
+		return
+	}
+	n, er := d.w.WriteString(s)
+	d.n += int64(n)
+	d.er = er
+}
+
+func (d *dumpWriter) value(v any) {
+	if d.er != nil {
+		return
+	}
+	data, er := json.Marshal(v)
+	if er != nil {
+		d.er = er
+		return
+	}
+	n, er := d.w.Write(data)
+	d.n += int64(n)
+	d.er = er
+}
+
+// dumpSource - колекція для writeDump: метадані без документів та обхід документів у порядку ключів
+type dumpSource struct {
+	name string
+	meta DTOCollection
+	scan func(fn func(key string, doc Document) bool) error // nil, якщо документи лишаються в рушії (meta.Stored)
+}
+
+// dumpTo пише колекції знімка за абеткою
+func (sn *StoreSnapshot) dumpTo(ctx context.Context, w io.Writer, opts StreamOptions) error {
+	sources := make([]dumpSource, 0, len(sn.collections))
+	for _, name := range sn.Collections() {
+		coll := sn.collections[name]
+		sources = append(sources, dumpSource{
+			name: name,
+			meta: DTOCollection{Config: coll.config, Indexes: coll.indexes, Revision: coll.revision, Order: coll.order},
+			scan: func(fn func(key string, doc Document) bool) error {
+				return coll.Scan(func(doc Document) bool {
+					key, _ := doc.Fields[coll.config.PrimaryKey].Value.(string)
+					return fn(key, doc)
+				})
+			},
+		})
+	}
+	return writeDump(ctx, w, sources, opts)
+}
+
+// writeDump пише JSON дамп колекцій у порядку sources. Конфігурація, індекси та порядок вставки
+// йдуть перед документами, тож LoadFrom відкриває колекцію до першого документа і не тримає їх у пам'яті.
+func writeDump(ctx context.Context, w io.Writer, sources []dumpSource, opts StreamOptions) error {
+	d := &dumpWriter{w: bufio.NewWriter(w)}
+	var progress StreamProgress
+	d.raw(`{"version":`)
+	d.value(dumpVersion)
+	d.raw(`,"collections":{`)
+	for i, src := range sources {
+		progress.Collection = src.name
+		if i > 0 {
+			d.raw(",")
+		}
+		d.value(src.name)
+		d.raw(`:{"config":`)
+		d.value(src.meta.Config)
+		if len(src.meta.Indexes) > 0 {
+			d.raw(`,"indexes":`)
+			d.value(src.meta.Indexes)
+		}
+		if src.meta.Revision > 0 {
+			d.raw(`,"revision":`)
+			d.value(src.meta.Revision)
+		}
+		if len(src.meta.Order) > 0 {
+			d.raw(`,"order":`)
+			d.value(src.meta.Order)
+		}
+		if len(src.meta.Expiry) > 0 {
+			d.raw(`,"expiry":`)
+			d.value(src.meta.Expiry)
+		}
+		if src.meta.Stored {
+			d.raw(`,"stored":true}`)
+		} else {
+			d.raw(`,"documents":{`)
+			first := true
+			er := src.scan(func(key string, doc Document) bool {
+				if d.er == nil {
+					d.er = ctx.Err()
+				}
+				if !first {
+					d.raw(",")
+				}
+				first = false
+				d.value(key)
+				d.raw(":")
+				d.value(doc)
+				progress.Documents++
+				progress.Bytes = d.n
+				opts.report(progress)
+				return d.er == nil
+			})
+			if er != nil {
+				return fmt.Errorf("collection %s: %w", src.name, er)
+			}
+			d.raw("}}")
+		}
+		if d.er != nil {
+			return d.er
+		}
+		progress.Collections++
+		progress.Bytes = d.n
+		opts.report(progress)
+	}
+	d.raw("}}")
+	if d.er != nil {
+		return d.er
+	}
+	return d.w.Flush()
+}
+
+// LoadFrom відновлює стор з дампу, який читає з r по одному документу. Документи кожної колекції
+// записуються в її рушій одразу після читання, тож дамп колекції з дисковим рушієм не мусить
+// вміщатися в пам'ять. Приймає дампи Dump, DumpTo в обох форматах та старіших версій; формат
+// визначається за заголовком. Якщо ctx скасовано або дамп пошкоджений, відкриті рушії
+// закриваються і повертається помилка; пошкодження бінарного дампу - *err.DumpCorruptedError.
+// Дисковий рушій відкривається за шляхом з дампу, тож дамп стору, який ще відкритий у процесі,
+// не завантажиться: err.ErrEnginePathInUse.
+func LoadFrom(ctx context.Context, r io.Reader, opts StreamOptions) (*Store, error) {
+	return loadFrom(ctx, r, opts, false)
+}
+
+// loadFrom - LoadFrom, який для recovery лише запам'ятовує індекси: NewStoreWithWAL
+// будує їх після журналу, коли вміст колекцій уже остаточний
+func loadFrom(ctx context.Context, r io.Reader, opts StreamOptions, recovery bool) (*Store, error) {
+	br := bufio.NewReader(r)
+	s := NewStore()
+	l := &storeLoader{ctx: ctx, store: s, opts: opts, recovery: recovery}
+	var er error
+	if magic, _ := br.Peek(len(binaryDumpMagic)); string(magic) == binaryDumpMagic {
+		er = l.loadBinary(&binaryDumpReader{r: br})
+	} else {
+		l.dec = json.NewDecoder(br)
+		l.offset = l.dec.InputOffset
+		er = l.load()
+	}
+	if er != nil {
+		s.Close()
+		return nil, er
+	}
+	return s, nil
+}
+
+type storeLoader struct {
+	ctx      context.Context
+	dec      *json.Decoder // nil для бінарного дампу
+	offset   func() int64  // скільки байтів дампу прочитано
+	store    *Store
+	opts     StreamOptions
+	progress StreamProgress
+	recovery bool // індекси відкладаються до кінця журналу
+}
+
+// collectionLoader - колекція, яку відновлює LoadFrom. Поля колекції можуть іти в дампі в будь-якому
+// порядку, тож усе, що прочитано до config, чекає, доки рушій відкриється.
+type collectionLoader struct {
+	name     string
+	coll     *Collection // nil, доки не прочитано config
+	revision uint64
+	indexes  []IndexDefinition
+	order    []string
+	buffered map[string]Document  // документи, які в дампі йшли перед config
+	stored   bool                 // документи лишилися в рушії колекції, дамп їх не містить
+	expiry   map[string]time.Time // для stored: коли застаріють документи рушія
+	seen     map[string]struct{}  // ключі документів дампу; решта документів рушія видаляється
+}
+
+func (l *storeLoader) load() error {
+	if er := l.delim('{'); er != nil {
+		return er
+	}
+	for l.dec.More() {
+		field, er := l.key()
+		if er != nil {
+			return er
+		}
+		switch field {
+		case "version":
+			var version int
+			if er := l.dec.Decode(&version); er != nil {
+				return er
+			}
+			if version > dumpVersion {
+				return fmt.Errorf("%w: %d", err.ErrUnsupportedDumpVersion, version)
+			}
+		case "collections":
+			er = l.collections()
+		default:
+			er = l.skip()
+		}
+		if er != nil {
+			return er
+		}
+	}
+	return l.delim('}')
+}
+
+func (l *storeLoader) collections() error {
+	if er := l.delim('{'); er != nil {
+		return er
+	}
+	for l.dec.More() {
+		name, er := l.key()
+		if er != nil {
+			return er
+		}
+		cl := newCollectionLoader(name)
+		if er := l.collection(cl); er != nil {
+			cl.close()
+			return fmt.Errorf("collection %s: %w", name, er)
+		}
+		l.register(cl)
+	}
+	return l.delim('}')
+}
+
+func (l *storeLoader) collection(cl *collectionLoader) error {
+	l.progress.Collection = cl.name
+	if er := l.delim('{'); er != nil {
+		return er
+	}
+	for l.dec.More() {
+		field, er := l.key()
+		if er != nil {
+			return er
+		}
+		switch field {
+		case "config":
+			var cfg CollectionConfig
+			if er = l.dec.Decode(&cfg); er == nil {
+				er = cl.open(cfg)
+			}
+		case "indexes":
+			er = l.dec.Decode(&cl.indexes)
+		case "revision":
+			if er = l.dec.Decode(&cl.revision); er == nil && cl.coll != nil {
+				cl.coll.revision = max(cl.coll.revision, cl.revision)
+			}
+		case "order":
+			if er = l.dec.Decode(&cl.order); er == nil && cl.coll != nil {
+				cl.seed()
+			}
+		case "stored":
+			er = l.dec.Decode(&cl.stored)
+		case "expiry":
+			er = l.dec.Decode(&cl.expiry)
+		case "documents":
+			er = l.documents(cl)
+		default:
+			er = l.skip()
+		}
+		if er != nil {
+			return er
+		}
+	}
+	if er := l.delim('}'); er != nil {
+		return er
+	}
+	return l.complete(cl)
+}
+
+// complete дописує документи, які чекали на config, і завершує колекцію
+func (l *storeLoader) complete(cl *collectionLoader) error {
+	// Дамп без config: колекція з конфігурацією за замовчуванням, як і раніше
+	if cl.coll == nil {
+		if er := cl.open(CollectionConfig{}); er != nil {
+			return er
+		}
+	}
+	if cl.buffered != nil {
+		// Документи старих дампів не мають ревізій; put видає їх у порядку ключів.
+		// Capped колекція відновлює ще й порядок вставки, тож її документи йдуть першими в порядку order.
+		keys := make([]string, 0, len(cl.buffered))
+		for key := range cl.buffered {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range append(cl.order, keys...) {
+			doc, ok := cl.buffered[key]
+			if _, done := cl.seen[key]; done || !ok {
+				continue
+			}
+			if er := l.put(cl, key, doc); er != nil {
+				return er
+			}
+		}
+	}
+	if er := cl.finish(); er != nil {
+		return er
+	}
+	return l.indexes(cl)
+}
+
+// indexes будує індекси колекції одним обходом рушія або, під час відновлення, відкладає їх
+func (l *storeLoader) indexes(cl *collectionLoader) error {
+	if !l.recovery {
+		return cl.coll.createIndexes(cl.indexes)
+	}
+	for _, def := range cl.indexes {
+		if er := cl.coll.deferIndex(def); er != nil {
+			return fmt.Errorf("index %s: %w", indexName(def.Fields), er)
+		}
+	}
+	return nil
+}
+
+// documents читає документи колекції по одному і одразу пише їх у рушій
+func (l *storeLoader) documents(cl *collectionLoader) error {
+	if er := l.delim('{'); er != nil {
+		return er
+	}
+	for l.dec.More() {
+		if er := l.ctx.Err(); er != nil {
+			return er
+		}
+		key, er := l.key()
+		if er != nil {
+			return er
+		}
+		var doc Document
+		if er := l.dec.Decode(&doc); er != nil {
+			return fmt.Errorf("document %s: %w", key, er)
+		}
+		if cl.coll == nil {
+			// Старі дампи пишуть документи перед config, а без конфігурації рушій не відкрити.
+			// У прогрес такі документи потрапляють, лише коли complete запише їх у рушій.
+			if cl.buffered == nil {
+				cl.buffered = map[string]Document{}
+			}
+			cl.buffered[key] = doc
+			continue
+		}
+		if er := l.put(cl, key, doc); er != nil {
+			return er
+		}
+	}
+	return l.delim('}')
+}
+
+// register додає відновлену колекцію до стору
+func (l *storeLoader) register(cl *collectionLoader) {
+	if old, exists := l.store.collections[cl.name]; exists {
+		// Як і json.Unmarshal, повторене ім'я колекції замінює попередню
+		old.engine.Close()
+	}
+	cl.coll.store = l.store
+	l.store.collections[cl.name] = cl.coll
+	l.progress.Collections++
+	l.progress.Bytes = l.offset()
+	l.opts.report(l.progress)
+}
+
+func (l *storeLoader) put(cl *collectionLoader, key string, doc Document) error {
+	if er := l.ctx.Err(); er != nil {
+		return er
+	}
+	if er := cl.coll.put(key, doc); er != nil {
+		return fmt.Errorf("document %s: %w", key, er)
+	}
+	cl.seen[key] = struct{}{}
+	l.progress.Documents++
+	l.progress.Bytes = l.offset()
+	l.opts.report(l.progress)
+	return nil
+}
+
+func newCollectionLoader(name string) *collectionLoader {
+	return &collectionLoader{name: name, seen: map[string]struct{}{}}
+}
+
+// close закриває рушій колекції, яку не вдалося відновити
+func (cl *collectionLoader) close() {
+	if cl.coll != nil {
+		cl.coll.engine.Close()
+	}
+}
+
+// open відкриває рушій колекції та застосовує поля, прочитані перед config
+func (cl *collectionLoader) open(cfg CollectionConfig) error {
+	if cl.coll != nil {
+		return fmt.Errorf("%w: repeated config", err.ErrInvalidCollectionConfig)
+	}
+	coll, er := openCollection(cl.name, cfg)
+	if er != nil {
+		return er
+	}
+	cl.coll = coll
+	coll.revision = max(coll.revision, cl.revision)
+	cl.seed()
+	return nil
+}
+
+// seed ставить ключі capped колекції в чергу вставки в порядку дампу ще до їхніх документів,
+// тож документи можуть іти в порядку ключів. Якщо документи вже пішли, порядок вставки - порядок дампу.
+func (cl *collectionLoader) seed() {
+	if cl.coll.config.Capped == nil || cl.order == nil || len(cl.seen) > 0 {
+		return
+	}
+	cl.coll.capped = newCappedState()
+	for _, key := range cl.order {
+		cl.coll.capped.add(key, 0)
+	}
+}
+
+// finish видаляє документи, які рушій зберіг сам, але яких немає в дампі:
+// вміст колекції визначає дамп. Якщо документи лишилися в рушії (stored), їх визначає рушій.
+func (cl *collectionLoader) finish() error {
+	coll := cl.coll
+	if cl.stored {
+		// Рушій не обходиться, тож час застарівання його документів береться з дампу
+		for key, at := range cl.expiry {
+			coll.trackExpiry(key, at)
+		}
+		return coll.syncCapped()
+	}
+	var stale []string
+	er := coll.engine.Scan("", func(key string, doc Document) bool {
+		if _, ok := cl.seen[key]; !ok {
+			coll.revision = max(coll.revision, doc.Revision)
+			stale = append(stale, key)
+		}
+		return true
+	})
+	for _, key := range stale {
+		if er != nil {
+			break
+		}
+		_, er = coll.delete(key)
+	}
+	if er != nil {
+		return er
+	}
+	if coll.capped != nil {
+		// Ключі з order, документів яких у дампі немає (застаріли під час дампу)
+		for key := range coll.capped.entries {
+			if _, ok := cl.seen[key]; !ok {
+				coll.capped.remove(key)
+			}
+		}
+	}
+	return nil
+}
+
+// key читає ключ об'єкта
+func (l *storeLoader) key() (string, error) {
+	tok, er := l.dec.Token()
+	if er != nil {
+		return "", er
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("dump: unexpected %v at offset %d", tok, l.dec.InputOffset())
+	}
+	return key, nil
+}
+
+// delim читає очікуваний роздільник { або }
+func (l *storeLoader) delim(want json.Delim) error {
+	tok, er := l.dec.Token()
+	if er != nil {
+		if er == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return er
+	}
+	if tok != want {
+		return fmt.Errorf("dump: expected %v, got %v at offset %d", want, tok, l.dec.InputOffset())
+	}
+	return nil
+}
+
+// skip пропускає невідоме поле
+func (l *storeLoader) skip() error {
+	var value json.RawMessage
+	return l.dec.Decode(&value)
+}
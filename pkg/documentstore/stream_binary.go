@@ -0,0 +1,487 @@
+package documentstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"lesson4/pkg/err"
+	"math"
+	"slices"
+)
+
+// Бінарний дамп: заголовок (magic, версія формату), далі блоки
+// [вид: 1 байт][довжина: uint32][дані][CRC32 виду, довжини та даних: uint32].
+// Блок колекції містить ім'я та JSON її конфігурації, індексів, ревізії й порядку вставки;
+// за ним ідуть блоки документів цієї колекції; останній блок містить кількість колекцій і документів.
+const (
+	binaryDumpMagic   = "DSDB"
+	binaryDumpVersion = 1
+	binaryHeaderSize  = 8
+	binaryBlockHeader = 5
+	binaryBlockSize   = 64 << 10 // після скількох байтів документів блок закривається
+	binaryMaxDepth    = 512      // найбільша вкладеність масивів та об'єктів у значенні поля
+)
+
+const (
+	binaryBlockCollection byte = iota + 1
+	binaryBlockDocuments
+	binaryBlockEnd
+)
+
+// Теги значень полів
+const (
+	binaryNull byte = iota
+	binaryFalse
+	binaryTrue
+	binaryInt
+	binaryFloat
+	binaryString
+	binaryArray
+	binaryObject
+)
+
+// binaryFieldTypes - коди типів полів; 0 - тип не з цього списку, його назва йде рядком
+var binaryFieldTypes = []DocumentFieldType{"", DocumentFieldTypeString, DocumentFieldTypeNumber, DocumentFieldTypeBool, DocumentFieldTypeArray, DocumentFieldTypeObject}
+
+type binaryDumpWriter struct {
+	w  *bufio.Writer
+	n  int64
+	er error
+}
+
+func (d *binaryDumpWriter) write(data []byte) {
+	if d.er != nil {
+		return
+	}
+	n, er := d.w.Write(data)
+	d.n += int64(n)
+	d.er = er
+}
+
+func (d *binaryDumpWriter) block(kind byte, payload []byte) {
+	header := make([]byte, binaryBlockHeader, binaryBlockHeader+4)
+	header[0] = kind
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(payload)
+	d.write(header)
+	d.write(payload)
+	d.write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+// dumpBinary пише знімок у бінарному форматі. На відміну від JSON, числа зберігають свій тип
+// (float64 1.0 не стає int64), а тип поля та ключі не повторюються текстом для кожного значення.
+func (sn *StoreSnapshot) dumpBinary(ctx context.Context, w io.Writer, opts StreamOptions) error {
+	d := &binaryDumpWriter{w: bufio.NewWriter(w)}
+	header := append([]byte(binaryDumpMagic), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(header[4:], binaryDumpVersion)
+	d.write(header)
+
+	var progress StreamProgress
+	for _, name := range sn.Collections() {
+		coll := sn.collections[name]
+		progress.Collection = name
+		meta, er := json.Marshal(DTOCollection{Config: coll.config, Indexes: coll.indexes, Revision: coll.revision, Order: coll.order})
+		if er != nil {
+			return fmt.Errorf("collection %s: %w", name, er)
+		}
+		d.block(binaryBlockCollection, append(appendBinaryString(nil, name), meta...))
+
+		var docs []byte
+		er = coll.Scan(func(doc Document) bool {
+			if d.er == nil {
+				d.er = ctx.Err()
+			}
+			if d.er == nil {
+				key, _ := doc.Fields[coll.config.PrimaryKey].Value.(string)
+				docs, d.er = appendDocument(appendBinaryString(docs, key), doc)
+			}
+			if len(docs) >= binaryBlockSize {
+				d.block(binaryBlockDocuments, docs)
+				docs = docs[:0]
+			}
+			progress.Documents++
+			progress.Bytes = d.n
+			opts.report(progress)
+			return d.er == nil
+		})
+		if er != nil {
+			return fmt.Errorf("collection %s: %w", name, er)
+		}
+		if len(docs) > 0 {
+			d.block(binaryBlockDocuments, docs)
+		}
+		if d.er != nil {
+			return d.er
+		}
+		progress.Collections++
+		progress.Bytes = d.n
+		opts.report(progress)
+	}
+	end := binary.AppendUvarint(nil, uint64(progress.Collections))
+	d.block(binaryBlockEnd, binary.AppendUvarint(end, uint64(progress.Documents)))
+	if d.er != nil {
+		return d.er
+	}
+	return d.w.Flush()
+}
+
+func appendBinaryString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendDocument(buf []byte, doc Document) ([]byte, error) {
+	buf = binary.AppendUvarint(buf, doc.Revision)
+	if doc.ExpiresAt.IsZero() {
+		buf = append(buf, 0)
+	} else {
+		t, er := doc.ExpiresAt.MarshalBinary()
+		if er != nil {
+			return nil, er
+		}
+		buf = append(append(buf, byte(len(t))), t...)
+	}
+	names := make([]string, 0, len(doc.Fields))
+	for name := range doc.Fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		field := doc.Fields[name]
+		buf = appendBinaryString(buf, name)
+		if code := slices.Index(binaryFieldTypes, field.Type); code > 0 {
+			buf = append(buf, byte(code))
+		} else {
+			buf = appendBinaryString(append(buf, 0), string(field.Type))
+		}
+		var er error
+		if buf, er = appendValue(buf, field.Value); er != nil {
+			return nil, fmt.Errorf("field %s: %w", name, er)
+		}
+	}
+	return buf, nil
+}
+
+// appendValue пише значення поля. Значення інших типів Go пишуться так, як їх прочитав би
+// JSON дамп: через json.Marshal з цілими числами як int64.
+func appendValue(buf []byte, v any) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, binaryNull), nil
+	case bool:
+		if val {
+			return append(buf, binaryTrue), nil
+		}
+		return append(buf, binaryFalse), nil
+	case string:
+		return appendBinaryString(append(buf, binaryString), val), nil
+	case int:
+		return binary.AppendVarint(append(buf, binaryInt), int64(val)), nil
+	case int32:
+		return binary.AppendVarint(append(buf, binaryInt), int64(val)), nil
+	case int64:
+		return binary.AppendVarint(append(buf, binaryInt), val), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(buf, binaryFloat), math.Float64bits(val)), nil
+	case []any:
+		if val == nil {
+			return append(buf, binaryNull), nil
+		}
+		buf = binary.AppendUvarint(append(buf, binaryArray), uint64(len(val)))
+		for _, item := range val {
+			var er error
+			if buf, er = appendValue(buf, item); er != nil {
+				return nil, er
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		if val == nil {
+			return append(buf, binaryNull), nil
+		}
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		buf = binary.AppendUvarint(append(buf, binaryObject), uint64(len(keys)))
+		for _, key := range keys {
+			var er error
+			if buf, er = appendValue(appendBinaryString(buf, key), val[key]); er != nil {
+				return nil, er
+			}
+		}
+		return buf, nil
+	}
+	data, er := json.Marshal(v)
+	if er != nil {
+		return nil, er
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if er := dec.Decode(&value); er != nil {
+		return nil, er
+	}
+	return appendValue(buf, normalizeNumbers(value))
+}
+
+// binaryDumpReader читає блоки бінарного дампу і рахує прочитані байти для зсувів у помилках
+type binaryDumpReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (b *binaryDumpReader) header() error {
+	header := make([]byte, binaryHeaderSize)
+	if _, er := io.ReadFull(b.r, header); er != nil {
+		return &err.DumpCorruptedError{Offset: 0, Reason: "truncated header"}
+	}
+	b.n = binaryHeaderSize
+	if version := binary.LittleEndian.Uint32(header[4:]); version > binaryDumpVersion {
+		return fmt.Errorf("%w: binary %d", err.ErrUnsupportedDumpVersion, version)
+	}
+	return nil
+}
+
+// block читає наступний блок і перевіряє його CRC32; offset - зсув початку блоку в дампі
+func (b *binaryDumpReader) block() (kind byte, payload []byte, offset int64, er error) {
+	offset = b.n
+	header := make([]byte, binaryBlockHeader)
+	if _, er := io.ReadFull(b.r, header); er != nil {
+		if er == io.EOF || er == io.ErrUnexpectedEOF {
+			return 0, nil, offset, &err.DumpCorruptedError{Offset: offset, Reason: "unexpected end of dump"}
+		}
+		return 0, nil, offset, er
+	}
+	size := int64(binary.LittleEndian.Uint32(header[1:]))
+	// Буфер росте разом із прочитаним, тож пошкоджена довжина не виділяє зайвої пам'яті
+	var buf bytes.Buffer
+	if _, er := buf.ReadFrom(io.LimitReader(b.r, size+4)); er != nil {
+		return 0, nil, offset, er
+	}
+	if int64(buf.Len()) < size+4 {
+		return 0, nil, offset, &err.DumpCorruptedError{Offset: offset, Reason: "unexpected end of dump"}
+	}
+	data := buf.Bytes()
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(data[:size])
+	if crc.Sum32() != binary.LittleEndian.Uint32(data[size:]) {
+		return 0, nil, offset, &err.DumpCorruptedError{Offset: offset, Reason: "block checksum mismatch"}
+	}
+	b.n += binaryBlockHeader + size + 4
+	return header[0], data[:size], offset, nil
+}
+
+// loadBinary відновлює колекції з блоків бінарного дампу
+func (l *storeLoader) loadBinary(b *binaryDumpReader) error {
+	l.offset = func() int64 { return b.n }
+	if er := b.header(); er != nil {
+		return er
+	}
+	var cl *collectionLoader
+	er := func() error {
+		for {
+			kind, payload, offset, er := b.block()
+			if er != nil {
+				return er
+			}
+			corrupted := func(format string, args ...any) error {
+				return &err.DumpCorruptedError{Offset: offset, Reason: fmt.Sprintf(format, args...)}
+			}
+			switch kind {
+			case binaryBlockCollection:
+				if er := l.completeBinary(cl); er != nil {
+					return er
+				}
+				p := &payloadReader{data: payload}
+				name := p.string()
+				var meta DTOCollection
+				if p.er != nil || json.Unmarshal(p.data, &meta) != nil {
+					return corrupted("invalid collection block")
+				}
+				cl = newCollectionLoader(name)
+				l.progress.Collection = name
+				cl.revision, cl.indexes, cl.order, cl.stored, cl.expiry = meta.Revision, meta.Indexes, meta.Order, meta.Stored, meta.Expiry
+				if er := cl.open(meta.Config); er != nil {
+					return fmt.Errorf("collection %s: %w", name, er)
+				}
+			case binaryBlockDocuments:
+				if cl == nil {
+					return corrupted("documents outside of a collection")
+				}
+				for p := (&payloadReader{data: payload}); len(p.data) > 0; {
+					key := p.string()
+					doc := p.document()
+					if p.er != nil {
+						return corrupted("%v", p.er)
+					}
+					if er := l.put(cl, key, doc); er != nil {
+						return fmt.Errorf("collection %s: %w", cl.name, er)
+					}
+				}
+			case binaryBlockEnd:
+				if er := l.completeBinary(cl); er != nil {
+					return er
+				}
+				cl = nil
+				p := &payloadReader{data: payload}
+				collections, documents := p.uvarint(), p.uvarint()
+				if p.er != nil || collections != uint64(l.progress.Collections) || documents != uint64(l.progress.Documents) {
+					return corrupted("dump has %d collections and %d documents, end block expects %d and %d",
+						l.progress.Collections, l.progress.Documents, collections, documents)
+				}
+				return nil
+			default:
+				return corrupted("unknown block kind %d", kind)
+			}
+		}
+	}()
+	if er != nil && cl != nil && l.store.collections[cl.name] != cl.coll {
+		cl.close()
+	}
+	return er
+}
+
+// completeBinary завершує колекцію, документи якої закінчилися; nil нічого не робить
+func (l *storeLoader) completeBinary(cl *collectionLoader) error {
+	if cl == nil {
+		return nil
+	}
+	if er := l.complete(cl); er != nil {
+		return fmt.Errorf("collection %s: %w", cl.name, er)
+	}
+	l.register(cl)
+	return nil
+}
+
+// payloadReader розбирає дані блоку; перша помилка запам'ятовується, а решта читань повертає нулі
+type payloadReader struct {
+	data []byte
+	er   error
+}
+
+func (p *payloadReader) fail(reason string) {
+	if p.er == nil {
+		p.er = fmt.Errorf("%s", reason)
+	}
+	p.data = nil
+}
+
+func (p *payloadReader) byte() byte {
+	if len(p.data) == 0 {
+		p.fail("truncated block")
+		return 0
+	}
+	b := p.data[0]
+	p.data = p.data[1:]
+	return b
+}
+
+func (p *payloadReader) uvarint() uint64 {
+	v, n := binary.Uvarint(p.data)
+	if n <= 0 {
+		p.fail("invalid varint")
+		return 0
+	}
+	p.data = p.data[n:]
+	return v
+}
+
+func (p *payloadReader) varint() int64 {
+	v, n := binary.Varint(p.data)
+	if n <= 0 {
+		p.fail("invalid varint")
+		return 0
+	}
+	p.data = p.data[n:]
+	return v
+}
+
+func (p *payloadReader) bytes(n uint64) []byte {
+	if uint64(len(p.data)) < n {
+		p.fail("truncated block")
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *payloadReader) string() string {
+	return string(p.bytes(p.uvarint()))
+}
+
+func (p *payloadReader) document() Document {
+	doc := Document{Revision: p.uvarint()}
+	if n := p.byte(); n > 0 {
+		if t := p.bytes(uint64(n)); p.er == nil && doc.ExpiresAt.UnmarshalBinary(t) != nil {
+			p.fail("invalid expiration time")
+		}
+	}
+	count := p.uvarint()
+	doc.Fields = make(map[string]DocumentField, min(count, uint64(len(p.data))))
+	for i := uint64(0); i < count && p.er == nil; i++ {
+		name := p.string()
+		var field DocumentField
+		if code := p.byte(); code == 0 {
+			field.Type = DocumentFieldType(p.string())
+		} else if int(code) < len(binaryFieldTypes) {
+			field.Type = binaryFieldTypes[code]
+		} else {
+			p.fail("unknown field type")
+		}
+		field.Value = p.value(0)
+		doc.Fields[name] = field
+	}
+	return doc
+}
+
+func (p *payloadReader) value(depth int) any {
+	if depth > binaryMaxDepth {
+		p.fail("value is nested too deeply")
+		return nil
+	}
+	switch tag := p.byte(); tag {
+	case binaryNull:
+		return nil
+	case binaryFalse, binaryTrue:
+		return tag == binaryTrue
+	case binaryInt:
+		return p.varint()
+	case binaryFloat:
+		b := p.bytes(8)
+		if p.er != nil {
+			return nil
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case binaryString:
+		return p.string()
+	case binaryArray:
+		n := p.uvarint()
+		items := make([]any, 0, min(n, uint64(len(p.data))))
+		for i := uint64(0); i < n && p.er == nil; i++ {
+			items = append(items, p.value(depth+1))
+		}
+		return items
+	case binaryObject:
+		n := p.uvarint()
+		obj := make(map[string]any, min(n, uint64(len(p.data))))
+		for i := uint64(0); i < n && p.er == nil; i++ {
+			key := p.string()
+			obj[key] = p.value(depth + 1)
+		}
+		return obj
+	}
+	p.fail("unknown value tag")
+	return nil
+}
@@ -0,0 +1,91 @@
+package documentstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore_DumpToLoadFromBinary(t *testing.T) {
+	source := streamTestStore(t)
+	users, _ := source.GetCollection("users")
+	doc := walTestDocument("typed", "typed")
+	doc.Fields["score"] = DocumentField{Type: DocumentFieldTypeNumber, Value: float64(1)}
+	doc.Fields["age"] = DocumentField{Type: DocumentFieldTypeNumber, Value: int64(-42)}
+	doc.Fields["tags"] = DocumentField{Type: DocumentFieldTypeArray, Value: []any{"a", true, nil, 2.5}}
+	doc.Fields["meta"] = DocumentField{Type: DocumentFieldTypeObject, Value: map[string]any{"x": int64(1), "y": []any{}}}
+	doc.Fields["custom"] = DocumentField{Type: "date", Value: "2024-01-01"}
+	users.Put(doc)
+	expiring := walTestDocument("ttl", "ttl")
+	expiring.ExpiresAt = time.Now().Add(time.Hour).UTC()
+	users.Put(expiring)
+
+	var binaryDump, jsonDump bytes.Buffer
+	if er := source.DumpTo(context.Background(), &binaryDump, StreamOptions{Format: DumpBinary}); er != nil {
+		t.Fatal(er)
+	}
+	source.DumpTo(context.Background(), &jsonDump, StreamOptions{})
+	if binaryDump.Len() >= jsonDump.Len()/2 {
+		t.Errorf("binary dump has %d bytes, JSON dump %d", binaryDump.Len(), jsonDump.Len())
+	}
+
+	// Формат визначається за заголовком дампу
+	restored, er := NewStoreFromDump(binaryDump.Bytes())
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got, want := restored.ToDto(), source.ToDto(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored store = %+v, want %+v", got, want)
+	}
+	restoredUsers, _ := restored.GetCollection("users")
+	// JSON дамп перетворив би 1.0 на int64, бінарний зберігає float64
+	if got, _ := restoredUsers.Get("typed"); got.Fields["score"].Value != float64(1) {
+		t.Errorf("score = %#v, want float64(1)", got.Fields["score"].Value)
+	}
+	if docs, _ := restoredUsers.Find(Filter{"name": "name1"}); len(docs) != 3 {
+		t.Errorf("Find() by restored index returned %d documents, want 3", len(docs))
+	}
+	events, _ := restored.GetCollection("events")
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"a", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored insertion order = %v, want %v", got, want)
+	}
+
+	if er := source.DumpTo(context.Background(), &bytes.Buffer{}, StreamOptions{Format: "xml"}); er == nil {
+		t.Errorf("DumpTo() with unknown format succeeded")
+	}
+}
+
+func TestLoadFrom_BinaryCorrupted(t *testing.T) {
+	var buf bytes.Buffer
+	if er := streamTestStore(t).DumpTo(context.Background(), &buf, StreamOptions{Format: DumpBinary}); er != nil {
+		t.Fatal(er)
+	}
+	dump := buf.Bytes()
+	// Другий блок - документи колекції events - починається одразу за блоком її конфігурації
+	second := int64(binaryHeaderSize + binaryBlockHeader + 4 + int(binary.LittleEndian.Uint32(dump[binaryHeaderSize+1:])))
+
+	flipped := bytes.Clone(dump)
+	flipped[second+binaryBlockHeader+3] ^= 0xff
+	_, er := LoadFrom(context.Background(), bytes.NewReader(flipped), StreamOptions{})
+	var corrupted *err.DumpCorruptedError
+	if !errors.As(er, &corrupted) || corrupted.Offset != second || !errors.Is(er, err.ErrDumpCorrupted) {
+		t.Errorf("LoadFrom() of flipped byte error = %v, want corruption at offset %d", er, second)
+	}
+
+	// Обірваний дамп без останнього блоку теж пошкоджений, а не порожній
+	_, er = LoadFrom(context.Background(), bytes.NewReader(dump[:len(dump)-3]), StreamOptions{})
+	if !errors.Is(er, err.ErrDumpCorrupted) {
+		t.Errorf("LoadFrom() of truncated dump error = %v, want %v", er, err.ErrDumpCorrupted)
+	}
+
+	newer := bytes.Clone(dump)
+	binary.LittleEndian.PutUint32(newer[4:], binaryDumpVersion+1)
+	if _, er := LoadFrom(context.Background(), bytes.NewReader(newer), StreamOptions{}); !errors.Is(er, err.ErrUnsupportedDumpVersion) {
+		t.Errorf("LoadFrom() of newer format error = %v, want %v", er, err.ErrUnsupportedDumpVersion)
+	}
+}
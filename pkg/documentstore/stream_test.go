@@ -0,0 +1,149 @@
+package documentstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func streamTestStore(t *testing.T) *Store {
+	t.Helper()
+	s := NewStore()
+	_, users := s.CreateCollection("users", "id")
+	for i := 0; i < 10; i++ {
+		users.Put(walTestDocument(fmt.Sprintf("u%d", i), fmt.Sprintf("name%d", i%3)))
+	}
+	users.CreateIndex("name")
+	s.CreateCollectionWithConfig("events", CollectionConfig{PrimaryKey: "id", Capped: &CappedOptions{MaxDocuments: 3}})
+	events, _ := s.GetCollection("events")
+	for _, id := range []string{"c", "a", "d", "b"} {
+		events.Put(walTestDocument(id, "event"))
+	}
+	return s
+}
+
+func TestStore_DumpToLoadFrom(t *testing.T) {
+	source := streamTestStore(t)
+	var buf bytes.Buffer
+	var dumped []StreamProgress
+	if er := source.DumpTo(context.Background(), &buf, StreamOptions{Progress: func(p StreamProgress) { dumped = append(dumped, p) }}); er != nil {
+		t.Fatal(er)
+	}
+	last := dumped[len(dumped)-1]
+	if last.Collections != 2 || last.Documents != 13 || last.Bytes != int64(buf.Len()-2) {
+		t.Errorf("last dump progress = %+v, dump has %d bytes", last, buf.Len())
+	}
+	// Колекції пишуться за абеткою, конфігурація - перед документами
+	if dump := buf.String(); !strings.HasPrefix(dump, `{"version":2,"collections":{"events":{"config":`) {
+		t.Errorf("dump starts with %.60s", dump)
+	}
+
+	var loaded StreamProgress
+	restored, er := LoadFrom(context.Background(), &buf, StreamOptions{Progress: func(p StreamProgress) { loaded = p }})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if loaded.Collections != 2 || loaded.Documents != 13 || loaded.Collection != "users" {
+		t.Errorf("last load progress = %+v", loaded)
+	}
+	if got, want := restored.ToDto(), source.ToDto(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored store = %+v, want %+v", got, want)
+	}
+	events, _ := restored.GetCollection("events")
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"a", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored insertion order = %v, want %v", got, want)
+	}
+}
+
+func TestStore_DumpToLoadFromCancel(t *testing.T) {
+	source := streamTestStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buf bytes.Buffer
+	er := source.DumpTo(ctx, &buf, StreamOptions{Progress: func(p StreamProgress) {
+		if p.Documents == 5 {
+			cancel()
+		}
+	}})
+	if !errors.Is(er, context.Canceled) {
+		t.Errorf("DumpTo() error = %v, want %v", er, context.Canceled)
+	}
+
+	dump, _ := source.Dump()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	documents := 0
+	_, er = LoadFrom(ctx, bytes.NewReader(dump), StreamOptions{Progress: func(p StreamProgress) {
+		if documents = p.Documents; documents == 5 {
+			cancel()
+		}
+	}})
+	if !errors.Is(er, context.Canceled) || documents != 5 {
+		t.Errorf("LoadFrom() error = %v after %d documents, want %v after 5", er, documents, context.Canceled)
+	}
+
+	if _, er := LoadFrom(context.Background(), bytes.NewReader(dump[:len(dump)/2]), StreamOptions{}); er == nil {
+		t.Errorf("LoadFrom() of truncated dump succeeded")
+	}
+}
+
+func TestLoadFrom_DocumentsBeforeConfig(t *testing.T) {
+	// Так поля колекції писав Dump до DumpTo: документи перед config, порядок вставки - в кінці
+	dump := `{"version":2,"collections":{"events":{"documents":{` +
+		`"a":{"fields":{"id":{"type":"string","value":"a"}},"revision":2},` +
+		`"b":{"fields":{"id":{"type":"string","value":"b"}},"revision":3},` +
+		`"c":{"fields":{"id":{"type":"string","value":"c"}},"revision":1}},` +
+		`"config":{"cgg":"id","capped":{"max_documents":5}},"revision":4,"order":["c","a","b"]}}}`
+	s, er := LoadFrom(context.Background(), strings.NewReader(dump), StreamOptions{})
+	if er != nil {
+		t.Fatal(er)
+	}
+	events, _ := s.GetCollection("events")
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("insertion order = %v, want %v", got, want)
+	}
+	if res, er := events.Insert(walTestDocument("d", "event")); er != nil || res.Revision != 5 {
+		t.Errorf("Insert() = %+v, %v, want revision 5", res, er)
+	}
+}
+
+// streamTestReader скасовує завантаження після першого прочитаного блоку
+type streamTestReader struct {
+	r      io.Reader
+	n      int
+	cancel func()
+}
+
+func (r *streamTestReader) Read(p []byte) (int, error) {
+	n, er := r.r.Read(p)
+	r.n += n
+	r.cancel()
+	return n, er
+}
+
+func TestLoadFrom_DocumentsBeforeConfigCancel(t *testing.T) {
+	var dump strings.Builder
+	dump.WriteString(`{"version":2,"collections":{"users":{"documents":{`)
+	for i := 0; i < 2000; i++ {
+		if i > 0 {
+			dump.WriteString(",")
+		}
+		fmt.Fprintf(&dump, `"u%04d":{"fields":{"id":{"type":"string","value":"u%04d"}}}`, i, i)
+	}
+	dump.WriteString(`},"config":{"cgg":"id"}}}}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &streamTestReader{r: strings.NewReader(dump.String()), cancel: cancel}
+	reported := 0
+	_, er := LoadFrom(ctx, r, StreamOptions{Progress: func(p StreamProgress) { reported = p.Documents }})
+	// Документи, що чекають на config, читаються з перевіркою ctx і не потрапляють у прогрес
+	if !errors.Is(er, context.Canceled) || r.n == dump.Len() || reported != 0 {
+		t.Errorf("LoadFrom() = %v after %d of %d bytes and %d documents, want %v before the end", er, r.n, dump.Len(), reported, context.Canceled)
+	}
+}
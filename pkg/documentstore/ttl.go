@@ -0,0 +1,184 @@
+package documentstore
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultSweepInterval - як часто sweeper видаляє застарілі документи, якщо інтервал не задано
+const defaultSweepInterval = time.Minute
+
+// expires перевіряє, чи документи колекції можуть застарівати
+func (c CollectionConfig) expires() bool {
+	return c.TTL > 0 || c.ExpireField != ""
+}
+
+// expiresAt повертає час, коли документ, записаний у момент written, застаріє; нульовий час - ніколи
+func (c CollectionConfig) expiresAt(doc Document, written time.Time) time.Time {
+	if c.ExpireField == "" {
+		if c.TTL > 0 {
+			return written.Add(c.TTL).UTC()
+		}
+		return time.Time{}
+	}
+	v, ok := lookupPath(doc, c.ExpireField)
+	if !ok {
+		return time.Time{}
+	}
+	t, ok := timeValue(v)
+	if !ok {
+		return time.Time{}
+	}
+	return t.Add(c.TTL).UTC()
+}
+
+// timeValue розпізнає час у полі документа; після дампу чи журналу time.Time стає рядком RFC 3339
+func timeValue(v any) (time.Time, bool) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, !val.IsZero()
+	case *time.Time:
+		if val == nil {
+			return time.Time{}, false
+		}
+		return timeValue(*val)
+	case string:
+		t, er := time.Parse(time.RFC3339Nano, val)
+		return t, er == nil
+	}
+	return time.Time{}, false
+}
+
+// trackExpiry запам'ятовує, коли застаріє документ; нульовий час прибирає ключ з переліку
+func (s *Collection) trackExpiry(key string, at time.Time) {
+	if at.IsZero() {
+		delete(s.expiry, key)
+		return
+	}
+	if s.expiry == nil {
+		s.expiry = map[string]time.Time{}
+	}
+	s.expiry[key] = at
+}
+
+// DeleteExpired видаляє застарілі документи і повертає їх кількість. Шукає їх у переліку expiry
+// під блокуванням на читання, тож рушій не читається, а читачі на цей час не зупиняються;
+// записи блокуються лише на саме видалення.
+func (s *Collection) DeleteExpired() (int, error) {
+	if !s.config.expires() {
+		return 0, nil
+	}
+	now := time.Now()
+
+	s.mu.RLock()
+	var keys []string
+	for key, at := range s.expiry {
+		if !now.Before(at) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	sort.Strings(keys)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		// Поки блокування було знято, документ могли перезаписати
+		doc, exists, er := s.storage().Get(key)
+		if er != nil {
+			return deleted, er
+		}
+		if !exists || !doc.expired(now) {
+			// Перелік міг розійтися з рушієм, який відновлення не читало повністю
+			s.trackExpiry(key, doc.ExpiresAt)
+			continue
+		}
+		if er := s.expire(key); er != nil {
+			return deleted, er
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		slog.Info("expired documents deleted", slog.String("collection", s.name), slog.Int("count", deleted))
+	}
+	return deleted, nil
+}
+
+// expire видаляє застарілий документ разом із записом у журнал
+func (s *Collection) expire(key string) error {
+	if er := s.log(walRecord{Op: walOpDelete, Key: key}); er != nil {
+		return er
+	}
+	_, er := s.delete(key)
+	return s.applied(er)
+}
+
+type sweeper struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartSweeper запускає фонове видалення застарілих документів з усіх колекцій стору раз на interval
+// (за замовчуванням раз на хвилину). Повторний виклик перезапускає sweeper з новим інтервалом.
+// Читання не повертають застарілих документів і без sweeper, він лише звільняє пам'ять та індекси.
+// Зупиняє sweeper Close.
+func (s *Store) StartSweeper(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	sw := &sweeper{done: make(chan struct{})}
+	sw.wg.Add(1)
+	go s.sweepLoop(sw, interval)
+
+	s.mu.Lock()
+	old := s.sweeper
+	s.sweeper = sw
+	s.mu.Unlock()
+	old.stop()
+}
+
+func (s *Store) sweepLoop(sw *sweeper, interval time.Duration) {
+	defer sw.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-sw.done:
+			return
+		}
+	}
+}
+
+// sweep видаляє застарілі документи з кожної колекції; стор не блокується на весь прохід
+func (s *Store) sweep() {
+	s.mu.RLock()
+	colls := make([]*Collection, 0, len(s.collections))
+	for _, coll := range s.collections {
+		colls = append(colls, coll)
+	}
+	s.mu.RUnlock()
+
+	for _, coll := range colls {
+		if _, er := coll.DeleteExpired(); er != nil {
+			slog.Error("expired documents not deleted", slog.String("collection", coll.name), slog.String("error", er.Error()))
+		}
+	}
+}
+
+// stop зупиняє sweeper і чекає на завершення поточного проходу; nil нічого не робить
+func (sw *sweeper) stop() {
+	if sw == nil {
+		return
+	}
+	close(sw.done)
+	sw.wg.Wait()
+}
@@ -0,0 +1,233 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ttlTestSession(id string, expiresAt any) Document {
+	doc := Document{Fields: map[string]DocumentField{
+		"id":   {Type: DocumentFieldTypeString, Value: id},
+		"user": {Type: DocumentFieldTypeString, Value: "andrii"},
+	}}
+	if expiresAt != nil {
+		doc.Fields["expires_at"] = DocumentField{Type: DocumentFieldTypeString, Value: expiresAt}
+	}
+	return doc
+}
+
+func TestCollection_ExpireField(t *testing.T) {
+	now := time.Now()
+	s := NewStore()
+	_, sessions := s.CreateCollectionWithConfig("sessions", CollectionConfig{PrimaryKey: "id", ExpireField: "expires_at"})
+	sessions.CreateIndex("user")
+	sessions.Put(ttlTestSession("past", now.Add(-time.Minute)))
+	sessions.Put(ttlTestSession("past_string", now.Add(-time.Minute).Format(time.RFC3339Nano)))
+	sessions.Put(ttlTestSession("future", now.Add(time.Hour)))
+	sessions.Put(ttlTestSession("future_string", now.Add(time.Hour).Format(time.RFC3339)))
+	sessions.Put(ttlTestSession("no_field", nil))
+	sessions.Put(ttlTestSession("not_a_time", "tomorrow"))
+
+	want := []string{"future", "future_string", "no_field", "not_a_time"}
+	if got := indexTestIDs(sessions.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	docs, _ := sessions.Find(Filter{"user": "andrii"})
+	if got := indexTestIDs(docs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Find() = %v, want %v", got, want)
+	}
+	docs, _ = sessions.Query("user", QueryParams{Limit: 2})
+	if got := indexTestIDs(docs); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("Query() = %v, want %v", got, want[:2])
+	}
+	page, _ := sessions.ListPage(FindOptions{Limit: 10})
+	if got := indexTestIDs(page.Documents); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListPage() = %v, want %v", got, want)
+	}
+	if _, er := sessions.Get("past"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Get() of expired document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	if _, er := sessions.GetWithProjection("past", Projection{}); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("GetWithProjection() of expired document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	if _, er := s.Begin().Get("sessions", "past"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Tx.Get() of expired document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	if _, ok := s.ToDto().Collections["sessions"].Documents["past"]; ok {
+		t.Errorf("dump contains expired document")
+	}
+
+	// Застарілий документ не існує і для записів
+	if sessions.Delete("past") {
+		t.Errorf("Delete() of expired document = true")
+	}
+	if res, _ := sessions.Update("past", Update{"$set": map[string]any{"user": "taras"}}); res.Matched {
+		t.Errorf("Update() matched expired document")
+	}
+	res, er := sessions.Insert(ttlTestSession("past", now.Add(time.Hour)))
+	if er != nil || !res.Inserted {
+		t.Fatalf("Insert() over expired document = %+v, %v", res, er)
+	}
+	doc, _ := sessions.Get("past")
+	if want := now.Add(time.Hour).UTC(); !doc.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", doc.ExpiresAt, want)
+	}
+}
+
+func TestCollection_TTL(t *testing.T) {
+	s := NewStore()
+	_, tokens := s.CreateCollectionWithConfig("tokens", CollectionConfig{PrimaryKey: "id", TTL: 50 * time.Millisecond})
+	_, sessions := s.CreateCollectionWithConfig("sessions", CollectionConfig{PrimaryKey: "id", TTL: time.Hour, ExpireField: "expires_at"})
+
+	tokens.Put(walTestDocument("t1", "one-time"))
+	sessions.Put(ttlTestSession("old", time.Now().Add(-2*time.Hour)))
+	sessions.Put(ttlTestSession("recent", time.Now().Add(-30*time.Minute)))
+
+	if got := indexTestIDs(sessions.List()); !reflect.DeepEqual(got, []string{"recent"}) {
+		t.Errorf("sessions = %v, want [recent]", got)
+	}
+	if _, er := tokens.Get("t1"); er != nil {
+		t.Fatalf("Get() before ttl error = %v", er)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, er := tokens.Get("t1"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Get() after ttl error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+
+	if er, _ := s.CreateCollectionWithConfig("bad", CollectionConfig{PrimaryKey: "id", TTL: -time.Second}); !errors.Is(er, err.ErrInvalidCollectionConfig) {
+		t.Errorf("CreateCollectionWithConfig() error = %v, want %v", er, err.ErrInvalidCollectionConfig)
+	}
+}
+
+func TestCollection_ExpiredUniqueValue(t *testing.T) {
+	s := NewStore()
+	_, tokens := s.CreateCollectionWithConfig("tokens", CollectionConfig{PrimaryKey: "id", ExpireField: "expires_at"})
+	if er := tokens.CreateIndexWithOptions("user", IndexOptions{Unique: true}); er != nil {
+		t.Fatal(er)
+	}
+	tokens.Put(ttlTestSession("t1", time.Now().Add(-time.Second)))
+	if er := tokens.Put(ttlTestSession("t2", time.Now().Add(time.Hour))); er != nil {
+		t.Fatalf("Put() with value of expired document error = %v", er)
+	}
+	if _, exists, _ := tokens.engine.Get("t1"); exists {
+		t.Errorf("expired document that held the unique value was not deleted")
+	}
+	if er := tokens.Put(ttlTestSession("t3", time.Now().Add(time.Hour))); !errors.Is(er, err.ErrDuplicateKey) {
+		t.Errorf("Put() with value of live document error = %v, want %v", er, err.ErrDuplicateKey)
+	}
+}
+
+func TestCollection_DeleteExpired(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, sessions := s.CreateCollectionWithConfig("sessions", CollectionConfig{PrimaryKey: "id", ExpireField: "expires_at"})
+	sessions.CreateIndex("user")
+	sessions.Put(ttlTestSession("s1", time.Now().Add(-time.Minute)))
+	sessions.Put(ttlTestSession("s2", time.Now().Add(-time.Minute)))
+	sessions.Put(ttlTestSession("s3", time.Now().Add(time.Hour)))
+
+	deleted, er := sessions.DeleteExpired()
+	if er != nil || deleted != 2 {
+		t.Fatalf("DeleteExpired() = %d, %v, want 2", deleted, er)
+	}
+	if got := len(sessions.indexes["user"].Entries[0].IDs); got != 1 {
+		t.Errorf("index has %d documents after DeleteExpired(), want 1", got)
+	}
+	before, _ := sessions.Get("s3")
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	coll, _ := restored.GetCollection("sessions")
+	if got := coll.engine.Len(); got != 1 {
+		t.Errorf("restored collection has %d documents, want 1", got)
+	}
+	after, _ := coll.Get("s3")
+	if after == nil || !reflect.DeepEqual(after.ExpiresAt, before.ExpiresAt) || after.Revision != before.Revision {
+		t.Errorf("restored document = %+v, want expiry %v", after, before.ExpiresAt)
+	}
+}
+
+// ttlTestEngine не дозволяє обходити рушій: DeleteExpired має шукати документи в переліку expiry
+type ttlTestEngine struct {
+	StorageEngine
+	t *testing.T
+}
+
+func (e *ttlTestEngine) Scan(from string, fn func(key string, doc Document) bool) error {
+	e.t.Errorf("engine scanned from %q", from)
+	return e.StorageEngine.Scan(from, fn)
+}
+
+func TestCollection_DeleteExpiredDiskEngine(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	cfg := CollectionConfig{PrimaryKey: "id", ExpireField: "expires_at",
+		Engine: EngineOptions{Type: EngineBTree, Path: filepath.Join(dir, "sessions.btree")}}
+	_, sessions := s.CreateCollectionWithConfig("sessions", cfg)
+	sessions.Put(ttlTestSession("s1", time.Now().Add(-time.Minute)))
+	sessions.Put(ttlTestSession("s2", time.Now().Add(time.Hour)))
+	sessions.Put(ttlTestSession("s3", nil))
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	sessions.Put(ttlTestSession("s4", time.Now().Add(-time.Minute)))
+	sessions.Put(ttlTestSession("s2", time.Now().Add(-time.Minute)))
+	s.Close()
+
+	// Документи лишилися в рушії, а час їх застарівання відновлюється зі снапшоту та журналу
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	sessions, _ = restored.GetCollection("sessions")
+	sessions.engine = &ttlTestEngine{StorageEngine: sessions.engine, t: t}
+	deleted, er := sessions.DeleteExpired()
+	if er != nil || deleted != 3 {
+		t.Fatalf("DeleteExpired() = %d, %v, want 3", deleted, er)
+	}
+	if got := sessions.engine.Len(); got != 1 {
+		t.Errorf("collection has %d documents after DeleteExpired(), want 1", got)
+	}
+	if got := len(sessions.expiry); got != 0 {
+		t.Errorf("expiry has %d keys after DeleteExpired(), want 0", got)
+	}
+}
+
+func TestStore_Sweeper(t *testing.T) {
+	s := NewStore()
+	_, sessions := s.CreateCollectionWithConfig("sessions", CollectionConfig{PrimaryKey: "id", TTL: 10 * time.Millisecond})
+	sessions.CreateIndex("name")
+	sessions.Put(walTestDocument("s1", "Andrii"))
+	sessions.Put(walTestDocument("s2", "Taras"))
+	s.StartSweeper(5 * time.Millisecond)
+	defer s.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sessions.mu.RLock()
+		left, entries := sessions.engine.Len(), len(sessions.indexes["name"].Entries)
+		sessions.mu.RUnlock()
+		if left == 0 && entries == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sweeper left %d documents and %d index entries", left, entries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,487 @@
+package documentstore
+
+import (
+	"fmt"
+	"lesson4/pkg/err"
+	"log/slog"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Tx групує записи в кілька колекцій стору, які застосовуються всі разом під час Commit або жоден.
+//
+// Рівень ізоляції - серіалізовність для документів, до яких транзакція звертається за ключем
+// (оптимістичне блокування). До Commit записи транзакції не бачить ніхто, крім неї самої;
+// читання бачать останній закомічений стан разом з власними записами транзакції.
+// Ревізія кожного прочитаного документа запам'ятовується, і Commit перевіряє, що відтоді
+// документ не змінили; інакше повертається err.ErrTxConflict і нічого не записується.
+// Документи, яких транзакція не читала за ключем, не перевіряються, тож Put без Get
+// перезаписує документ так само, як Collection.Put.
+//
+// Tx не призначена для одночасного використання з кількох горутин.
+type Tx struct {
+	store *Store
+	colls map[string]*txCollection
+	done  bool
+}
+
+type txCollection struct {
+	coll   *Collection
+	reads  map[string]uint64    // ключ -> ревізія при першому читанні, 0 - документа не було
+	writes map[string]*Document // ключ -> новий документ, nil - видалення
+	order  []string             // ключі в порядку першого запису
+}
+
+// Begin починає транзакцію
+func (s *Store) Begin() *Tx {
+	return &Tx{store: s, colls: map[string]*txCollection{}}
+}
+
+// RunInTx виконує fn у транзакції: якщо fn повертає nil, транзакція комітиться,
+// якщо помилку чи панікує - відкочується
+func (s *Store) RunInTx(fn func(tx *Tx) error) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+
+	if er := fn(tx); er != nil {
+		return er
+	}
+	return tx.Commit()
+}
+
+// Get повертає документ з урахуванням записів цієї транзакції
+func (tx *Tx) Get(collection, key string) (*Document, error) {
+	tc, er := tx.collection(collection)
+	if er != nil {
+		return nil, er
+	}
+	doc, exists, er := tc.read(key)
+	if er != nil {
+		return nil, er
+	}
+	if !exists {
+		return nil, err.ErrDocumentNotFound
+	}
+	return &doc, nil
+}
+
+// Put записує документ, замінюючи наявний з тим самим ключем
+func (tx *Tx) Put(collection string, doc Document) error {
+	tc, er := tx.collection(collection)
+	if er != nil {
+		return er
+	}
+	key, er := tc.coll.documentKey(doc)
+	if er != nil {
+		return er
+	}
+	doc = doc.clone()
+	tc.write(key, &doc)
+	return nil
+}
+
+// Insert додає документ; якщо ключ зайнятий, повертає *err.DuplicateKeyError.
+// Відсутність документа перевіряється ще раз під час Commit.
+func (tx *Tx) Insert(collection string, doc Document) error {
+	tc, er := tx.collection(collection)
+	if er != nil {
+		return er
+	}
+	key, er := tc.coll.documentKey(doc)
+	if er != nil {
+		return er
+	}
+	_, exists, er := tc.read(key)
+	if er != nil {
+		return er
+	}
+	if exists {
+		return &err.DuplicateKeyError{Index: tc.coll.config.PrimaryKey, Value: key, DocumentID: key}
+	}
+	doc = doc.clone()
+	tc.write(key, &doc)
+	return nil
+}
+
+// Delete видаляє документ; якщо його немає, повертає err.ErrDocumentNotFound
+func (tx *Tx) Delete(collection, key string) error {
+	tc, er := tx.collection(collection)
+	if er != nil {
+		return er
+	}
+	_, exists, er := tc.read(key)
+	if er != nil {
+		return er
+	}
+	if !exists {
+		return err.ErrDocumentNotFound
+	}
+	tc.write(key, nil)
+	return nil
+}
+
+// Update застосовує зміни до документа, як Collection.Update.
+// Ревізія в результаті нульова: документ отримає ревізію лише під час Commit.
+func (tx *Tx) Update(collection, key string, update Update) (*UpdateResult, error) {
+	tc, er := tx.collection(collection)
+	if er != nil {
+		return nil, er
+	}
+	ops, er := tc.coll.compileUpdate(update)
+	if er != nil {
+		return nil, er
+	}
+	old, exists, er := tc.read(key)
+	if er != nil {
+		return nil, er
+	}
+	if !exists {
+		return &UpdateResult{}, nil
+	}
+	doc := old.clone()
+	for _, op := range ops {
+		if er := op(doc); er != nil {
+			return nil, er
+		}
+	}
+	if reflect.DeepEqual(old.Fields, doc.Fields) {
+		return &UpdateResult{Matched: true}, nil
+	}
+	tc.write(key, &doc)
+	return &UpdateResult{Matched: true, Modified: true}, nil
+}
+
+// Commit перевіряє прочитані документи і застосовує всі записи. Колекції блокуються в порядку
+// імен, тож транзакції з тими самими колекціями не блокують одна одну назавжди.
+// Якщо перевірка, індекс чи журнал відхиляють запис, уже застосовані зміни відкочуються.
+// Після Commit транзакція завершена, навіть якщо він повернув помилку.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return err.ErrTxDone
+	}
+	tx.done = true
+
+	names := make([]string, 0, len(tx.colls))
+	for name := range tx.colls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Блокування стору не дає видалити колекцію чи зробити Checkpoint посеред коміту
+	tx.store.mu.RLock()
+	defer tx.store.mu.RUnlock()
+	for _, name := range names {
+		coll := tx.colls[name].coll
+		coll.mu.Lock()
+		defer coll.mu.Unlock()
+	}
+
+	for _, name := range names {
+		tc := tx.colls[name]
+		if tc.coll.store != tx.store {
+			return fmt.Errorf("%w: %w: %s", err.ErrTxConflict, err.ErrCollectionNotFound, name)
+		}
+		for key, revision := range tc.reads {
+			current, _, er := tc.coll.storage().Get(key)
+			if er != nil {
+				return fmt.Errorf("collection %s: %w", name, er)
+			}
+			if current.Revision != revision {
+				return fmt.Errorf("%w: collection %s: %w", err.ErrTxConflict, name,
+					&err.RevisionConflictError{Key: key, Expected: revision, Actual: current.Revision})
+			}
+		}
+	}
+
+	// Записи йдуть у txOverlay і потрапляють у рушії лише після запису транзакції в журнал,
+	// як і в Collection.write: після збою дисковий рушій не тримає половини транзакції
+	overlays := make([]*txOverlay, len(names))
+	for i, name := range names {
+		coll := tx.colls[name].coll
+		if coll.engine == nil {
+			coll.engine = NewMemoryEngine()
+		}
+		overlays[i] = &txOverlay{StorageEngine: coll.engine, writes: map[string]*Document{}}
+		coll.engine = overlays[i]
+	}
+	flush := func() error {
+		var first error
+		for i, name := range names {
+			tx.colls[name].coll.engine = overlays[i].StorageEngine
+			if er := overlays[i].flush(); er != nil && first == nil {
+				first = fmt.Errorf("collection %s: %w", name, er)
+			}
+		}
+		return first
+	}
+
+	var applied []txUndo
+	var records []walRecord
+	now := time.Now()
+	rollback := func() {
+		for i := len(applied) - 1; i >= 0; i-- {
+			applied[i].undo()
+		}
+		// Після відкату overlay тримає попередні документи та видалення застарілих документів,
+		// які checkIndexes уже записав у журнал
+		if er := flush(); er != nil {
+			if tx.store.wal != nil {
+				er = tx.store.wal.abandon(er)
+			}
+			slog.Error("transaction rollback not written", slog.String("error", er.Error()))
+		}
+	}
+	for _, name := range names {
+		tc := tx.colls[name]
+		coll := tc.coll
+		remove := func(key string) error {
+			old, existed, er := coll.storage().Get(key)
+			if er != nil || !existed {
+				return er
+			}
+			seq := coll.capped.seqOf(key)
+			if _, er := coll.delete(key); er != nil {
+				return er
+			}
+			applied = append(applied, txUndo{coll: coll, key: key, old: old, existed: true, seq: seq})
+			records = append(records, walRecord{Op: walOpDelete, Collection: name, Key: key})
+			return nil
+		}
+		for _, key := range tc.order {
+			doc := tc.writes[key]
+			if doc == nil {
+				if er := remove(key); er != nil {
+					rollback()
+					return fmt.Errorf("collection %s: %w", name, er)
+				}
+				continue
+			}
+			next := doc.clone()
+			next.Revision = coll.revision + 1
+			next.ExpiresAt = coll.config.expiresAt(next, now)
+			if er := coll.checkIndexes(key, next, now); er != nil {
+				rollback()
+				return fmt.Errorf("collection %s: %w", name, er)
+			}
+			evicted, er := coll.evictions(key, next)
+			if er != nil {
+				rollback()
+				return fmt.Errorf("collection %s: %w", name, er)
+			}
+			old, existed, er := coll.storage().Get(key)
+			if er == nil {
+				seq := coll.capped.seqOf(key)
+				if er = coll.put(key, next); er == nil {
+					applied = append(applied, txUndo{coll: coll, key: key, old: old, existed: existed, seq: seq})
+				}
+			}
+			if er != nil {
+				rollback()
+				return fmt.Errorf("collection %s: %w", name, er)
+			}
+			records = append(records, walRecord{Op: walOpPut, Collection: name, Key: key, Document: &next})
+			for _, key := range evicted {
+				if er := remove(key); er != nil {
+					rollback()
+					return fmt.Errorf("collection %s: %w", name, er)
+				}
+			}
+		}
+	}
+	if tx.store.wal != nil && len(records) > 0 {
+		if er := tx.store.wal.append(walRecord{Op: walOpTx, Batch: records}); er != nil {
+			slog.Error("wal append failed", slog.String("error", er.Error()))
+			rollback()
+			return er
+		}
+	}
+	if er := flush(); er != nil {
+		// Транзакція вже в журналі, тож відновлення після перезапуску допише решту
+		slog.Error("transaction not written to storage engine", slog.String("error", er.Error()))
+		if tx.store.wal != nil {
+			return tx.store.wal.abandon(er)
+		}
+		return er
+	}
+	return nil
+}
+
+// txOverlay - записи коміту поверх рушія колекції; nil у writes означає видалений документ
+type txOverlay struct {
+	StorageEngine
+	writes map[string]*Document
+}
+
+func (o *txOverlay) Get(key string) (Document, bool, error) {
+	if doc, ok := o.writes[key]; ok {
+		if doc == nil {
+			return Document{}, false, nil
+		}
+		return *doc, true, nil
+	}
+	return o.StorageEngine.Get(key)
+}
+
+func (o *txOverlay) Put(key string, doc Document) error {
+	o.writes[key] = &doc
+	return nil
+}
+
+func (o *txOverlay) Delete(key string) error {
+	o.writes[key] = nil
+	return nil
+}
+
+func (o *txOverlay) Len() int {
+	n := o.StorageEngine.Len()
+	for key, doc := range o.writes {
+		_, exists, _ := o.StorageEngine.Get(key)
+		switch {
+		case exists && doc == nil:
+			n--
+		case !exists && doc != nil:
+			n++
+		}
+	}
+	return n
+}
+
+func (o *txOverlay) Scan(from string, fn func(key string, doc Document) bool) error {
+	keys := make([]string, 0, len(o.writes))
+	for key := range o.writes {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// emit віддає записи overlay з ключами до bound; false - fn зупинив обхід
+	emit := func(bound string, all bool) bool {
+		for len(keys) > 0 && (all || keys[0] < bound) {
+			key := keys[0]
+			keys = keys[1:]
+			if doc := o.writes[key]; doc != nil && !fn(key, *doc) {
+				return false
+			}
+		}
+		return true
+	}
+	stopped := false
+	er := o.StorageEngine.Scan(from, func(key string, doc Document) bool {
+		if stopped = !emit(key, false); stopped {
+			return false
+		}
+		if _, ok := o.writes[key]; ok {
+			return true
+		}
+		stopped = !fn(key, doc)
+		return !stopped
+	})
+	if er != nil || stopped {
+		return er
+	}
+	emit("", true)
+	return nil
+}
+
+// flush переносить записи в рушій у порядку ключів
+func (o *txOverlay) flush() error {
+	keys := make([]string, 0, len(o.writes))
+	for key := range o.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var er error
+		if doc := o.writes[key]; doc != nil {
+			er = o.StorageEngine.Put(key, *doc)
+		} else {
+			er = o.StorageEngine.Delete(key)
+		}
+		if er != nil {
+			return fmt.Errorf("document %s: %w", key, er)
+		}
+	}
+	return nil
+}
+
+// Rollback скасовує транзакцію; після Commit нічого не робить, тож його зручно викликати через defer
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.colls = nil
+}
+
+func (tx *Tx) collection(name string) (*txCollection, error) {
+	if tx.done {
+		return nil, err.ErrTxDone
+	}
+	if tc, ok := tx.colls[name]; ok {
+		return tc, nil
+	}
+	coll, er := tx.store.GetCollection(name)
+	if er != nil {
+		return nil, er
+	}
+	tc := &txCollection{coll: coll, reads: map[string]uint64{}, writes: map[string]*Document{}}
+	tx.colls[name] = tc
+	return tc, nil
+}
+
+// read повертає документ з урахуванням записів транзакції і запам'ятовує ревізію першого читання.
+// Застарілий документ транзакція не бачить, але його ревізію теж запам'ятовує: якщо до коміту
+// документ перезапишуть, це буде конфлікт, а якщо ні - запис транзакції просто замінить його.
+func (tc *txCollection) read(key string) (Document, bool, error) {
+	if doc, written := tc.writes[key]; written {
+		if doc == nil {
+			return Document{}, false, nil
+		}
+		return doc.clone(), true, nil
+	}
+	tc.coll.mu.RLock()
+	doc, exists, er := tc.coll.storage().Get(key)
+	if exists {
+		doc = doc.clone()
+	}
+	tc.coll.mu.RUnlock()
+	if er != nil {
+		return Document{}, false, er
+	}
+	if _, seen := tc.reads[key]; !seen {
+		tc.reads[key] = doc.Revision
+	}
+	if exists && doc.expired(time.Now()) {
+		return Document{}, false, nil
+	}
+	return doc, exists, nil
+}
+
+func (tc *txCollection) write(key string, doc *Document) {
+	if _, written := tc.writes[key]; !written {
+		tc.order = append(tc.order, key)
+	}
+	tc.writes[key] = doc
+}
+
+// txUndo повертає документ до стану перед комітом
+type txUndo struct {
+	coll    *Collection
+	key     string
+	old     Document
+	existed bool
+	seq     uint64 // місце документа в черзі capped колекції
+}
+
+// undo не повертає помилку: відкат уже повертає помилку коміту, тож невдача рушія лише логується
+func (u txUndo) undo() {
+	var er error
+	if u.existed {
+		if er = u.coll.put(u.key, u.old); er == nil && u.coll.capped != nil {
+			u.coll.capped.reposition(u.key, u.seq)
+		}
+	} else {
+		_, er = u.coll.delete(u.key)
+	}
+	if er != nil {
+		slog.Error("transaction write not undone", slog.String("collection", u.coll.name), slog.String("key", u.key), slog.String("error", er.Error()))
+	}
+}
@@ -0,0 +1,354 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func txTestAccount(id string, balance int) Document {
+	return Document{Fields: map[string]DocumentField{
+		"id":      {Type: DocumentFieldTypeString, Value: id},
+		"balance": {Type: DocumentFieldTypeNumber, Value: balance},
+	}}
+}
+
+func txTestStore(t *testing.T) *Store {
+	t.Helper()
+	s := NewStore()
+	_, accounts := s.CreateCollection("accounts", "id")
+	accounts.Put(txTestAccount("a1", 100))
+	accounts.Put(txTestAccount("a2", 50))
+	s.CreateCollection("log", "id")
+	return s
+}
+
+func txTestBalance(t *testing.T, s *Store, id string) float64 {
+	t.Helper()
+	coll, _ := s.GetCollection("accounts")
+	doc, er := coll.Get(id)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return toFloat(normalizeValue(doc.Fields["balance"].Value))
+}
+
+// txTestTransfer переказує amount з from на to і записує операцію в log
+func txTestTransfer(tx *Tx, id, from, to string, amount int) error {
+	if _, er := tx.Update("accounts", from, Update{"$inc": map[string]any{"balance": -amount}}); er != nil {
+		return er
+	}
+	if _, er := tx.Update("accounts", to, Update{"$inc": map[string]any{"balance": amount}}); er != nil {
+		return er
+	}
+	return tx.Insert("log", walTestDocument(id, from+"->"+to))
+}
+
+func TestTx_Commit(t *testing.T) {
+	s := txTestStore(t)
+	tx := s.Begin()
+	if er := txTestTransfer(tx, "t1", "a1", "a2", 30); er != nil {
+		t.Fatal(er)
+	}
+
+	// Власні записи видно в транзакції, але не поза нею
+	doc, er := tx.Get("accounts", "a2")
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got := toFloat(normalizeValue(doc.Fields["balance"].Value)); got != 80 {
+		t.Errorf("balance in tx = %v, want 80", got)
+	}
+	if got := txTestBalance(t, s, "a2"); got != 50 {
+		t.Errorf("balance before commit = %v, want 50", got)
+	}
+	if got := walTestIDs(t, s, "log"); len(got) != 0 {
+		t.Errorf("log before commit = %v, want empty", got)
+	}
+
+	if er := tx.Commit(); er != nil {
+		t.Fatal(er)
+	}
+	if got := txTestBalance(t, s, "a1"); got != 70 {
+		t.Errorf("a1 balance = %v, want 70", got)
+	}
+	if got := txTestBalance(t, s, "a2"); got != 80 {
+		t.Errorf("a2 balance = %v, want 80", got)
+	}
+	if got := walTestIDs(t, s, "log"); !reflect.DeepEqual(got, []string{"t1"}) {
+		t.Errorf("log = %v, want [t1]", got)
+	}
+
+	if er := tx.Commit(); !errors.Is(er, err.ErrTxDone) {
+		t.Errorf("second Commit() error = %v, want %v", er, err.ErrTxDone)
+	}
+	if _, er := tx.Get("accounts", "a1"); !errors.Is(er, err.ErrTxDone) {
+		t.Errorf("Get() after commit error = %v, want %v", er, err.ErrTxDone)
+	}
+}
+
+func TestTx_DeleteAndInsert(t *testing.T) {
+	s := txTestStore(t)
+	tx := s.Begin()
+	if er := tx.Delete("accounts", "a2"); er != nil {
+		t.Fatal(er)
+	}
+	if _, er := tx.Get("accounts", "a2"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Get() of deleted document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	if er := tx.Delete("accounts", "a9"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Delete() of missing document error = %v, want %v", er, err.ErrDocumentNotFound)
+	}
+	if er := tx.Insert("accounts", txTestAccount("a1", 1)); !errors.Is(er, err.ErrDuplicateKey) {
+		t.Errorf("Insert() of existing key error = %v, want %v", er, err.ErrDuplicateKey)
+	}
+	// Ключ звільнено в цій же транзакції
+	if er := tx.Insert("accounts", txTestAccount("a2", 5)); er != nil {
+		t.Fatal(er)
+	}
+	if er := tx.Commit(); er != nil {
+		t.Fatal(er)
+	}
+	if got := txTestBalance(t, s, "a2"); got != 5 {
+		t.Errorf("a2 balance = %v, want 5", got)
+	}
+}
+
+func TestTx_Rollback(t *testing.T) {
+	s := txTestStore(t)
+
+	tx := s.Begin()
+	txTestTransfer(tx, "t1", "a1", "a2", 30)
+	tx.Rollback()
+	if er := tx.Commit(); !errors.Is(er, err.ErrTxDone) {
+		t.Errorf("Commit() after rollback error = %v, want %v", er, err.ErrTxDone)
+	}
+
+	failed := errors.New("failed")
+	er := s.RunInTx(func(tx *Tx) error {
+		txTestTransfer(tx, "t2", "a1", "a2", 30)
+		return failed
+	})
+	if !errors.Is(er, failed) {
+		t.Errorf("RunInTx() error = %v, want %v", er, failed)
+	}
+
+	func() {
+		defer func() { recover() }()
+		s.RunInTx(func(tx *Tx) error {
+			txTestTransfer(tx, "t3", "a1", "a2", 30)
+			panic("boom")
+		})
+	}()
+
+	if got := txTestBalance(t, s, "a1"); got != 100 {
+		t.Errorf("a1 balance = %v, want 100", got)
+	}
+	if got := walTestIDs(t, s, "log"); len(got) != 0 {
+		t.Errorf("log = %v, want empty", got)
+	}
+}
+
+func TestTx_Conflict(t *testing.T) {
+	s := txTestStore(t)
+	accounts, _ := s.GetCollection("accounts")
+
+	tx := s.Begin()
+	if er := txTestTransfer(tx, "t1", "a1", "a2", 30); er != nil {
+		t.Fatal(er)
+	}
+	accounts.Update("a2", Update{"$inc": map[string]any{"balance": 1}})
+
+	er := tx.Commit()
+	if !errors.Is(er, err.ErrTxConflict) || !errors.Is(er, err.ErrRevisionConflict) {
+		t.Fatalf("Commit() error = %v, want %v", er, err.ErrTxConflict)
+	}
+	if got := txTestBalance(t, s, "a1"); got != 100 {
+		t.Errorf("a1 balance = %v, want 100", got)
+	}
+	if got := walTestIDs(t, s, "log"); len(got) != 0 {
+		t.Errorf("log = %v, want empty", got)
+	}
+
+	// Документ, якого не було під час читання, теж конфлікт
+	tx = s.Begin()
+	tx.Insert("accounts", txTestAccount("a3", 1))
+	accounts.Put(txTestAccount("a3", 2))
+	if er := tx.Commit(); !errors.Is(er, err.ErrTxConflict) {
+		t.Errorf("Commit() error = %v, want %v", er, err.ErrTxConflict)
+	}
+	if got := txTestBalance(t, s, "a3"); got != 2 {
+		t.Errorf("a3 balance = %v, want 2", got)
+	}
+}
+
+func TestTx_UniqueIndexUndo(t *testing.T) {
+	s := txTestStore(t)
+	log, _ := s.GetCollection("log")
+	if er := log.CreateIndexWithOptions("name", IndexOptions{Unique: true}); er != nil {
+		t.Fatal(er)
+	}
+	log.Put(walTestDocument("t0", "a1->a2"))
+	accounts, _ := s.GetCollection("accounts")
+	before := accounts.List()
+
+	// accounts застосовується раніше за log, тож порушення індексу відкочує вже записані документи
+	er := s.RunInTx(func(tx *Tx) error {
+		return txTestTransfer(tx, "t1", "a1", "a2", 30)
+	})
+	if !errors.Is(er, err.ErrDuplicateKey) {
+		t.Fatalf("RunInTx() error = %v, want %v", er, err.ErrDuplicateKey)
+	}
+	if got := accounts.List(); !reflect.DeepEqual(got, before) {
+		t.Errorf("accounts after failed commit = %v, want %v", got, before)
+	}
+	docs, _ := accounts.Find(Filter{"balance": Filter{"$gte": 80}})
+	if got := indexTestIDs(docs); !reflect.DeepEqual(got, []string{"a1"}) {
+		t.Errorf("Find() after failed commit = %v, want [a1]", got)
+	}
+}
+
+func TestTx_ConcurrentTransfers(t *testing.T) {
+	s := txTestStore(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			from, to := "a1", "a2"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			for {
+				er := s.RunInTx(func(tx *Tx) error {
+					return txTestTransfer(tx, "t"+string(rune('a'+i)), from, to, i)
+				})
+				if er == nil {
+					return
+				}
+				if !errors.Is(er, err.ErrTxConflict) {
+					t.Error(er)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := txTestBalance(t, s, "a1") + txTestBalance(t, s, "a2"); got != 150 {
+		t.Errorf("total balance = %v, want 150", got)
+	}
+	if got := walTestIDs(t, s, "log"); len(got) != 20 {
+		t.Errorf("log has %d transfers, want 20", len(got))
+	}
+}
+
+func TestTx_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, accounts := s.CreateCollection("accounts", "id")
+	accounts.Put(txTestAccount("a1", 100))
+	accounts.Put(txTestAccount("a2", 50))
+	s.CreateCollection("log", "id")
+	if er := s.RunInTx(func(tx *Tx) error {
+		if er := txTestTransfer(tx, "t1", "a1", "a2", 30); er != nil {
+			return er
+		}
+		return tx.Delete("accounts", "a1")
+	}); er != nil {
+		t.Fatal(er)
+	}
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	if got := walTestIDs(t, restored, "accounts"); !reflect.DeepEqual(got, []string{"a2"}) {
+		t.Errorf("restored accounts = %v, want [a2]", got)
+	}
+	if got := txTestBalance(t, restored, "a2"); got != 80 {
+		t.Errorf("restored a2 balance = %v, want 80", got)
+	}
+	if got := walTestIDs(t, restored, "log"); !reflect.DeepEqual(got, []string{"t1"}) {
+		t.Errorf("restored log = %v, want [t1]", got)
+	}
+}
+
+// txTestEngine перевіряє перед кожним записом у рушій, що журнал уже виріс
+type txTestEngine struct {
+	StorageEngine
+	walPath string
+	walSize int64
+	t       *testing.T
+}
+
+func (e *txTestEngine) Put(key string, doc Document) error {
+	if info, er := os.Stat(e.walPath); er != nil || info.Size() <= e.walSize {
+		e.t.Errorf("document %s written to engine before the transaction reached the log", key)
+	}
+	return e.StorageEngine.Put(key, doc)
+}
+
+func TestTx_WALBeforeEngine(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer s.Close()
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineFile, Path: filepath.Join(dir, "accounts")}}
+	_, accounts := s.CreateCollectionWithConfig("accounts", cfg)
+	accounts.Put(txTestAccount("a1", 100))
+
+	// Журнал не приймає записів: транзакція не доходить ні до рушія, ні до колекції
+	s.wal.mu.Lock()
+	file := s.wal.file
+	s.wal.file = nil
+	s.wal.mu.Unlock()
+	transfer := func(tx *Tx) error {
+		if er := tx.Put("accounts", txTestAccount("a1", 70)); er != nil {
+			return er
+		}
+		return tx.Put("accounts", txTestAccount("a2", 30))
+	}
+	er = s.RunInTx(transfer)
+	s.wal.mu.Lock()
+	s.wal.file = file
+	s.wal.mu.Unlock()
+	if !errors.Is(er, err.ErrWALClosed) {
+		t.Fatalf("RunInTx() error = %v, want %v", er, err.ErrWALClosed)
+	}
+	engine, er := OpenFileEngine(cfg.Engine.Path, false)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer engine.Close()
+	if doc, _, er := engine.Get("a1"); er != nil || engine.Len() != 1 || toFloat(normalizeValue(doc.Fields["balance"].Value)) != 100 {
+		t.Errorf("engine after failed commit has %d documents, a1 = %v, %v", engine.Len(), doc.Fields["balance"].Value, er)
+	}
+	if got := walTestIDs(t, s, "accounts"); !reflect.DeepEqual(got, []string{"a1"}) || txTestBalance(t, s, "a1") != 100 {
+		t.Errorf("accounts after failed commit = %v", got)
+	}
+
+	// Успішний коміт пише в рушій лише після журналу
+	walPath := filepath.Join(dir, walFileName)
+	info, _ := os.Stat(walPath)
+	accounts.mu.Lock()
+	accounts.engine = &txTestEngine{StorageEngine: accounts.engine, walPath: walPath, walSize: info.Size(), t: t}
+	accounts.mu.Unlock()
+	if er := s.RunInTx(transfer); er != nil {
+		t.Fatal(er)
+	}
+	if got := walTestIDs(t, s, "accounts"); !reflect.DeepEqual(got, []string{"a1", "a2"}) || txTestBalance(t, s, "a1") != 70 {
+		t.Errorf("accounts after commit = %v", got)
+	}
+}
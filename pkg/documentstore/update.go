@@ -0,0 +1,413 @@
+package documentstore
+
+import (
+	"fmt"
+	"lesson4/pkg/err"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Update - зміни документа в стилі MongoDB: {"$set": {"address.city": "Kyiv"}, "$inc": {"visits": 1}}.
+// Підтримуються $set, $unset, $inc, $push, $pull, $addToSet та $rename; шляхи можуть бути вкладеними.
+// $push та $addToSet приймають {"$each": [...]} для кількох значень, $pull - значення,
+// умову ({"$gt": 5}) або фільтр для елементів-об'єктів.
+type Update map[string]any
+
+// UpdateResult описує результат Update: Matched - документ з ключем існує, Modified - його змінено
+type UpdateResult struct {
+	Matched  bool
+	Modified bool
+	Revision uint64 // ревізія документа після Update
+}
+
+// updateOperators у порядку застосування; шлях може зустрічатися лише в одному операторі
+var updateOperators = []string{"$set", "$unset", "$inc", "$push", "$addToSet", "$pull", "$rename"}
+
+// pathUpdate змінює значення за шляхом: отримує старе значення і повертає нове;
+// keep == false видаляє поле
+type pathUpdate func(old any, exists bool) (value any, keep bool, er error)
+
+// Update атомарно застосовує зміни до документа з ключем key: інші записи в колекцію
+// чекають, доки документ буде прочитано, змінено, перевірено індексами та записано.
+// Якщо документа немає, повертається UpdateResult з Matched == false без помилки.
+func (s *Collection) Update(key string, update Update) (*UpdateResult, error) {
+	ops, er := s.compileUpdate(update)
+	if er != nil {
+		return nil, er
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists, er := s.current(key, now)
+	if er != nil {
+		return nil, er
+	}
+	if !exists {
+		return &UpdateResult{}, nil
+	}
+	doc := old.clone()
+	for _, op := range ops {
+		if er := op(doc); er != nil {
+			return nil, er
+		}
+	}
+	if reflect.DeepEqual(old.Fields, doc.Fields) {
+		return &UpdateResult{Matched: true, Revision: old.Revision}, nil
+	}
+	doc.Revision = s.revision + 1
+	doc.ExpiresAt = s.config.expiresAt(doc, now)
+	if er := s.checkIndexes(key, doc, now); er != nil {
+		return nil, er
+	}
+	evicted, er := s.evictions(key, doc)
+	if er != nil {
+		return nil, er
+	}
+	if er := s.log(s.withEvictions(walRecord{Op: walOpPut, Key: key, Document: &doc}, evicted)); er != nil {
+		return nil, er
+	}
+	if er := s.put(key, doc); er != nil {
+		return nil, s.applied(er)
+	}
+	if er := s.evict(evicted); er != nil {
+		return nil, s.applied(er)
+	}
+	return &UpdateResult{Matched: true, Modified: true, Revision: doc.Revision}, nil
+}
+
+// compileUpdate перевіряє оператори до блокування колекції і повертає зміни в порядку застосування
+func (s *Collection) compileUpdate(update Update) ([]func(doc Document) error, error) {
+	if len(update) == 0 {
+		return nil, fmt.Errorf("%w: empty update", err.ErrInvalidUpdate)
+	}
+	for op := range update {
+		if !containsString(updateOperators, op) {
+			return nil, fmt.Errorf("%w: unknown operator %s", err.ErrInvalidUpdate, op)
+		}
+	}
+
+	var ops []func(doc Document) error
+	var paths []string
+	for _, op := range updateOperators {
+		operand, ok := update[op]
+		if !ok {
+			continue
+		}
+		fields, ok := asMap(operand)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s expects an object", err.ErrInvalidUpdate, op)
+		}
+		names := make([]string, 0, len(fields))
+		for path := range fields {
+			names = append(names, path)
+		}
+		sort.Strings(names)
+		for _, path := range names {
+			arg := fields[path]
+			paths = append(paths, path)
+			if op == "$rename" {
+				to, ok := arg.(string)
+				if !ok || to == "" {
+					return nil, fmt.Errorf("%w: $rename of %s expects a path", err.ErrInvalidUpdate, path)
+				}
+				paths = append(paths, to)
+				ops = append(ops, renameOp(path, to))
+				continue
+			}
+			fn, er := compileUpdateOp(op, path, arg)
+			if er != nil {
+				return nil, er
+			}
+			ops = append(ops, fn)
+		}
+	}
+	if er := s.checkUpdatePaths(paths); er != nil {
+		return nil, er
+	}
+	return ops, nil
+}
+
+// checkUpdatePaths забороняє змінювати первинний ключ і змінювати один шлях двічі,
+// зокрема поле та його вкладене поле, бо результат залежав би від порядку операторів
+func (s *Collection) checkUpdatePaths(paths []string) error {
+	sort.Strings(paths)
+	for i, path := range paths {
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return fmt.Errorf("%w: empty segment in path %q", err.ErrInvalidUpdate, path)
+			}
+		}
+		if strings.Split(path, ".")[0] == s.config.PrimaryKey {
+			return fmt.Errorf("%w: primary key %s can not be updated", err.ErrInvalidUpdate, s.config.PrimaryKey)
+		}
+		if i > 0 && (paths[i-1] == path || strings.HasPrefix(path, paths[i-1]+".")) {
+			return fmt.Errorf("%w: paths %s and %s conflict", err.ErrInvalidUpdate, paths[i-1], path)
+		}
+	}
+	return nil
+}
+
+func compileUpdateOp(op, path string, arg any) (func(doc Document) error, error) {
+	var fn pathUpdate
+	switch op {
+	case "$set":
+		fn = func(any, bool) (any, bool, error) { return arg, true, nil }
+	case "$unset":
+		return func(doc Document) error {
+			if _, exists := lookupPath(doc, path); !exists {
+				return nil
+			}
+			return updatePath(doc, path, func(any, bool) (any, bool, error) { return nil, false, nil })
+		}, nil
+	case "$inc":
+		delta, ok := normalizeNumber(arg)
+		if !ok {
+			return nil, fmt.Errorf("%w: $inc of %s expects a number", err.ErrInvalidUpdate, path)
+		}
+		fn = func(old any, exists bool) (any, bool, error) {
+			if !exists {
+				return delta, true, nil
+			}
+			n, ok := normalizeNumber(old)
+			if !ok {
+				return nil, false, fmt.Errorf("%w: $inc of %s: field is %T, not a number", err.ErrInvalidUpdate, path, old)
+			}
+			if a, ok := n.(int64); ok {
+				if b, ok := delta.(int64); ok {
+					return a + b, true, nil
+				}
+			}
+			return toFloat(n) + toFloat(delta), true, nil
+		}
+	case "$push", "$addToSet":
+		values := []any{arg}
+		if ops, ok := operatorMap(arg); ok {
+			each, ok := sliceValues(ops["$each"])
+			if len(ops) != 1 || !ok {
+				return nil, fmt.Errorf("%w: %s of %s supports only $each", err.ErrInvalidUpdate, op, path)
+			}
+			values = each
+		}
+		fn = func(old any, exists bool) (any, bool, error) {
+			list, er := updateArray(op, path, old, exists)
+			if er != nil {
+				return nil, false, er
+			}
+			added := false
+			for _, v := range values {
+				if op == "$addToSet" && containsValue(list, v) {
+					continue
+				}
+				list, added = append(list, v), true
+			}
+			if !added && exists {
+				return old, true, nil // масив не змінився, тож документ теж
+			}
+			return list, true, nil
+		}
+	case "$pull":
+		match, er := pullPredicate(arg)
+		if er != nil {
+			return nil, er
+		}
+		return func(doc Document) error {
+			if _, exists := lookupPath(doc, path); !exists {
+				return nil
+			}
+			return updatePath(doc, path, func(old any, exists bool) (any, bool, error) {
+				list, er := updateArray(op, path, old, exists)
+				if er != nil {
+					return nil, false, er
+				}
+				kept := make([]any, 0, len(list))
+				for _, elem := range list {
+					if !match(elem) {
+						kept = append(kept, elem)
+					}
+				}
+				if len(kept) == len(list) {
+					return old, true, nil
+				}
+				return kept, true, nil
+			})
+		}, nil
+	}
+	return func(doc Document) error { return updatePath(doc, path, fn) }, nil
+}
+
+func renameOp(from, to string) func(doc Document) error {
+	return func(doc Document) error {
+		value, exists := lookupPath(doc, from)
+		if !exists {
+			return nil
+		}
+		if er := updatePath(doc, from, func(any, bool) (any, bool, error) { return nil, false, nil }); er != nil {
+			return er
+		}
+		return updatePath(doc, to, func(any, bool) (any, bool, error) { return value, true, nil })
+	}
+}
+
+// updateArray повертає копію масиву для зміни; відсутнє поле - порожній масив
+func updateArray(op, path string, old any, exists bool) ([]any, error) {
+	if !exists || old == nil {
+		return []any{}, nil
+	}
+	list, ok := sliceValues(old)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s of %s: field is %T, not an array", err.ErrInvalidUpdate, op, path, old)
+	}
+	return append([]any{}, list...), nil
+}
+
+func containsValue(list []any, v any) bool {
+	for _, elem := range list {
+		if valuesEqual(elem, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pullPredicate: умова з операторами перевіряє елемент, звичайний об'єкт - фільтр для
+// елементів-об'єктів, будь-яке інше значення - рівність
+func pullPredicate(arg any) (func(elem any) bool, error) {
+	if _, ok := operatorMap(arg); ok {
+		pred, er := compileCondition(arg)
+		if er != nil {
+			return nil, fmt.Errorf("%w: $pull: %v", err.ErrInvalidUpdate, er)
+		}
+		return func(elem any) bool { return pred(elem, true) }, nil
+	}
+	if filter, ok := asMap(arg); ok {
+		match, er := compileFilter(filter)
+		if er != nil {
+			return nil, fmt.Errorf("%w: $pull: %v", err.ErrInvalidUpdate, er)
+		}
+		return func(elem any) bool {
+			fields, ok := objectFields(elem)
+			if !ok {
+				return false
+			}
+			doc := Document{Fields: make(map[string]DocumentField, len(fields))}
+			for name, v := range fields {
+				doc.Fields[name] = DocumentField{Type: fieldTypeOf(v), Value: v}
+			}
+			return match(doc)
+		}, nil
+	}
+	return func(elem any) bool { return valuesEqual(elem, arg) }, nil
+}
+
+// updatePath застосовує fn до значення за шляхом у документі. Документ має бути копією:
+// поля верхнього рівня змінюються на місці, а вкладені об'єкти та масиви копіюються.
+// Відсутні проміжні об'єкти створюються.
+func updatePath(doc Document, path string, fn pathUpdate) error {
+	segments := strings.Split(path, ".")
+	field, exists := doc.Fields[segments[0]]
+	var value any
+	keep := true
+	var er error
+	if len(segments) == 1 {
+		value, keep, er = fn(field.Value, exists)
+	} else {
+		value, er = updateIn(field.Value, path, segments[1:], fn)
+	}
+	if er != nil {
+		return er
+	}
+	if !keep {
+		delete(doc.Fields, segments[0])
+		return nil
+	}
+	if !exists || len(segments) == 1 {
+		field.Type = fieldTypeOf(value)
+	}
+	field.Value = value
+	doc.Fields[segments[0]] = field
+	return nil
+}
+
+func updateIn(v any, path string, segments []string, fn pathUpdate) (any, error) {
+	segment := segments[0]
+	if list, ok := sliceValues(v); ok {
+		i, er := strconv.Atoi(segment)
+		if er != nil || i < 0 {
+			return nil, fmt.Errorf("%w: %s: %q is not an array index", err.ErrInvalidUpdate, path, segment)
+		}
+		// Індекс може вказувати лише на наявний елемент або на наступний за останнім,
+		// інакше шлях на кшталт tags.1000000000 змусив би виділити мільярд елементів
+		if i > len(list) {
+			return nil, fmt.Errorf("%w: %s: index %d is beyond the end of array of %d elements", err.ErrInvalidUpdate, path, i, len(list))
+		}
+		out := append([]any{}, list...)
+		if i == len(out) {
+			out = append(out, nil)
+		}
+		var value any
+		keep := true
+		if len(segments) == 1 {
+			value, keep, er = fn(elementAt(list, i))
+		} else {
+			value, er = updateIn(out[i], path, segments[1:], fn)
+		}
+		if er != nil {
+			return nil, er
+		}
+		if !keep {
+			value = nil // як і в MongoDB, $unset елемента масиву залишає на його місці null
+		}
+		out[i] = value
+		return out, nil
+	}
+
+	fields, ok := objectFields(v)
+	if !ok && v != nil {
+		return nil, fmt.Errorf("%w: %s: can not create field %s in %T", err.ErrInvalidUpdate, path, segment, v)
+	}
+	out := make(map[string]any, len(fields)+1)
+	for name, c := range fields {
+		out[name] = c
+	}
+	child, exists := fields[segment]
+	if len(segments) > 1 {
+		value, er := updateIn(child, path, segments[1:], fn)
+		if er != nil {
+			return nil, er
+		}
+		out[segment] = value
+		return out, nil
+	}
+	value, keep, er := fn(child, exists)
+	if er != nil {
+		return nil, er
+	}
+	if keep {
+		out[segment] = value
+	} else {
+		delete(out, segment)
+	}
+	return out, nil
+}
+
+// elementAt повертає елемент масиву і чи він існує
+func elementAt(list []any, i int) (any, bool) {
+	if i < len(list) {
+		return list[i], true
+	}
+	return nil, false
+}
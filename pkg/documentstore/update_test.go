@@ -0,0 +1,247 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var updateTestDocuments = []map[string]DocumentField{{
+	"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+	"name":    {Type: DocumentFieldTypeString, Value: "Andrii"},
+	"visits":  {Type: DocumentFieldTypeNumber, Value: 3},
+	"tags":    {Type: DocumentFieldTypeArray, Value: []string{"go", "vip"}},
+	"address": {Type: DocumentFieldTypeObject, Value: filterTestAddress{City: "Kyiv", Zip: 1001}},
+	"scores":  {Type: DocumentFieldTypeArray, Value: []any{int64(1), int64(7), int64(12)}},
+	"orders": {Type: DocumentFieldTypeArray, Value: []any{
+		map[string]any{"sku": "a1", "qty": int64(2)},
+		map[string]any{"sku": "b7", "qty": int64(5)},
+	}},
+}}
+
+func TestCollection_Update(t *testing.T) {
+	tests := []struct {
+		name         string
+		update       Update
+		want         map[string]any // очікувані значення полів; nil - поля немає
+		wantModified bool
+		wantErr      error
+	}{
+		{
+			name:         "set top level and nested",
+			update:       Update{"$set": map[string]any{"name": "Taras", "address.city": "Lviv", "profile.lang": "uk"}},
+			want:         map[string]any{"name": "Taras", "address": map[string]any{"city": "Lviv", "Zip": 1001}, "profile": map[string]any{"lang": "uk"}},
+			wantModified: true,
+		},
+		{
+			name:   "set same value",
+			update: Update{"$set": Filter{"name": "Andrii"}},
+			want:   map[string]any{"name": "Andrii"},
+		},
+		{
+			name:         "set array element",
+			update:       Update{"$set": map[string]any{"tags.1": "admin", "orders.0.qty": 3}},
+			want:         map[string]any{"tags": []any{"go", "admin"}, "orders": []any{map[string]any{"sku": "a1", "qty": 3}, map[string]any{"sku": "b7", "qty": int64(5)}}},
+			wantModified: true,
+		},
+		{
+			name:         "set element after array end",
+			update:       Update{"$set": map[string]any{"tags.2": "admin"}},
+			want:         map[string]any{"tags": []any{"go", "vip", "admin"}},
+			wantModified: true,
+		},
+		{
+			name:         "unset",
+			update:       Update{"$unset": map[string]any{"name": "", "address.Zip": "", "missing.path": ""}},
+			want:         map[string]any{"name": nil, "address": map[string]any{"city": "Kyiv"}},
+			wantModified: true,
+		},
+		{
+			name:   "unset missing field",
+			update: Update{"$unset": map[string]any{"missing": ""}},
+		},
+		{
+			name:         "inc",
+			update:       Update{"$inc": map[string]any{"visits": 2, "stats.views": 1, "rating": 0.5}},
+			want:         map[string]any{"visits": int64(5), "stats": map[string]any{"views": int64(1)}, "rating": 0.5},
+			wantModified: true,
+		},
+		{
+			name:         "inc by fraction",
+			update:       Update{"$inc": map[string]any{"visits": -0.5}},
+			want:         map[string]any{"visits": 2.5},
+			wantModified: true,
+		},
+		{
+			name:         "push",
+			update:       Update{"$push": map[string]any{"tags": "new", "scores": Filter{"$each": []int{12, 1}}, "history": "created"}},
+			want:         map[string]any{"tags": []any{"go", "vip", "new"}, "scores": []any{int64(1), int64(7), int64(12), 12, 1}, "history": []any{"created"}},
+			wantModified: true,
+		},
+		{
+			name:         "add to set",
+			update:       Update{"$addToSet": map[string]any{"tags": "go", "scores": Filter{"$each": []any{12.0, 20, 20}}}},
+			want:         map[string]any{"tags": []string{"go", "vip"}, "scores": []any{int64(1), int64(7), int64(12), 20}},
+			wantModified: true,
+		},
+		{
+			name:         "pull value, condition and object filter",
+			update:       Update{"$pull": map[string]any{"tags": "vip", "scores": Filter{"$gte": 7}, "orders": Filter{"qty": Filter{"$gt": 3}}}},
+			want:         map[string]any{"tags": []any{"go"}, "scores": []any{int64(1)}, "orders": []any{map[string]any{"sku": "a1", "qty": int64(2)}}},
+			wantModified: true,
+		},
+		{
+			name:   "pull nothing",
+			update: Update{"$pull": map[string]any{"tags": "rust", "missing": "x"}},
+			want:   map[string]any{"tags": []string{"go", "vip"}},
+		},
+		{
+			name:         "rename",
+			update:       Update{"$rename": map[string]any{"name": "profile.name", "missing": "other"}},
+			want:         map[string]any{"name": nil, "profile": map[string]any{"name": "Andrii"}, "other": nil},
+			wantModified: true,
+		},
+		{name: "empty update", update: Update{}, wantErr: err.ErrInvalidUpdate},
+		{name: "unknown operator", update: Update{"$max": map[string]any{"visits": 1}}, wantErr: err.ErrInvalidUpdate},
+		{name: "operand is not an object", update: Update{"$set": "name"}, wantErr: err.ErrInvalidUpdate},
+		{name: "primary key", update: Update{"$set": map[string]any{"id": "u2"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "rename to primary key", update: Update{"$rename": map[string]any{"name": "id"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "conflicting paths", update: Update{"$set": map[string]any{"address": nil}, "$unset": map[string]any{"address.city": ""}}, wantErr: err.ErrInvalidUpdate},
+		{name: "inc of string", update: Update{"$inc": map[string]any{"name": 1}}, wantErr: err.ErrInvalidUpdate},
+		{name: "inc by string", update: Update{"$inc": map[string]any{"visits": "1"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "push to non array", update: Update{"$push": map[string]any{"name": "x"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "field inside scalar", update: Update{"$set": map[string]any{"name.first": "A"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "field name inside array", update: Update{"$set": map[string]any{"tags.first": "A"}}, wantErr: err.ErrInvalidUpdate},
+		{name: "index beyond array end", update: Update{"$set": map[string]any{"tags.1000000000": "A"}}, wantErr: err.ErrInvalidUpdate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testCollection(t, updateTestDocuments)
+			before, _ := s.Get("u1")
+
+			got, er := s.Update("u1", tt.update)
+			if !errors.Is(er, tt.wantErr) {
+				t.Fatalf("Update() error = %v, wantErr %v", er, tt.wantErr)
+			}
+			doc, _ := s.Get("u1")
+			if tt.wantErr != nil {
+				if !reflect.DeepEqual(doc, before) {
+					t.Errorf("failed Update() changed document: %v", doc.Fields)
+				}
+				return
+			}
+			if !got.Matched || got.Modified != tt.wantModified {
+				t.Errorf("Update() = %+v, want matched, modified %v", *got, tt.wantModified)
+			}
+			for name, want := range tt.want {
+				field, ok := doc.Fields[name]
+				if want == nil {
+					if ok {
+						t.Errorf("field %s = %v, want no field", name, field.Value)
+					}
+					continue
+				}
+				if !ok || !reflect.DeepEqual(field.Value, want) && !valuesEqual(field.Value, want) {
+					t.Errorf("field %s = %#v, want %#v", name, field.Value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCollection_UpdateMissingDocument(t *testing.T) {
+	s := testCollection(t, updateTestDocuments)
+	got, er := s.Update("u9", Update{"$set": map[string]any{"name": "x"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got.Matched || got.Modified {
+		t.Errorf("Update() = %+v, want not matched", *got)
+	}
+	if _, er := s.Get("u9"); !errors.Is(er, err.ErrDocumentNotFound) {
+		t.Errorf("Update() created a document")
+	}
+}
+
+func TestCollection_UpdateIndexes(t *testing.T) {
+	s := testCollection(t, updateTestDocuments)
+	s.Put(Document{Fields: map[string]DocumentField{
+		"id":    {Type: DocumentFieldTypeString, Value: "u2"},
+		"name":  {Type: DocumentFieldTypeString, Value: "Taras"},
+		"email": {Type: DocumentFieldTypeString, Value: "taras@example.com"},
+	}})
+	s.CreateIndexWithOptions("visits", IndexOptions{Type: DocumentFieldTypeNumber})
+	if er := s.CreateIndexWithOptions("email", IndexOptions{Unique: true}); er != nil {
+		t.Fatal(er)
+	}
+
+	if _, er := s.Update("u1", Update{"$inc": map[string]any{"visits": 10}}); er != nil {
+		t.Fatal(er)
+	}
+	docs, _ := s.Query("visits", QueryParams{MinValue: 10})
+	if got := indexTestIDs(docs); !reflect.DeepEqual(got, []string{"u1"}) {
+		t.Errorf("Query() after $inc = %v, want [u1]", got)
+	}
+
+	_, er := s.Update("u1", Update{"$set": map[string]any{"email": "taras@example.com"}})
+	if !errors.Is(er, err.ErrDuplicateKey) {
+		t.Fatalf("Update() error = %v, want %v", er, err.ErrDuplicateKey)
+	}
+	docs, _ = s.Query("email", QueryParams{})
+	if got := indexTestIDs(docs); !reflect.DeepEqual(got, []string{"u2"}) {
+		t.Errorf("Query() after rejected update = %v, want [u2]", got)
+	}
+}
+
+func TestCollection_UpdateConcurrentInc(t *testing.T) {
+	s := testCollection(t, updateTestDocuments)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, er := s.Update("u1", Update{"$inc": map[string]any{"visits": 1}}); er != nil {
+				t.Error(er)
+			}
+		}()
+	}
+	wg.Wait()
+	doc, _ := s.Get("u1")
+	if got := doc.Fields["visits"].Value; got != int64(103) {
+		t.Errorf("visits = %v, want 103", got)
+	}
+}
+
+func TestCollection_UpdateRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, users := s.CreateCollection("users", "id")
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.Update("u1", Update{"$set": map[string]any{"address.city": "Kyiv"}, "$push": map[string]any{"tags": "go"}})
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	coll, _ := restored.GetCollection("users")
+	doc, er := coll.Get("u1")
+	if er != nil {
+		t.Fatal(er)
+	}
+	want := map[string]DocumentField{
+		"id":      {Type: DocumentFieldTypeString, Value: "u1"},
+		"name":    {Type: DocumentFieldTypeString, Value: "Andrii"},
+		"address": {Type: DocumentFieldTypeObject, Value: map[string]any{"city": "Kyiv"}},
+		"tags":    {Type: DocumentFieldTypeArray, Value: []any{"go"}},
+	}
+	if !reflect.DeepEqual(doc.Fields, want) {
+		t.Errorf("restored document = %v, want %v", doc.Fields, want)
+	}
+}
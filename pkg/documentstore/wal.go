@@ -0,0 +1,585 @@
+package documentstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"lesson4/pkg/err"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	walHeaderSize    = 8       // 4 байти довжини + 4 байти CRC32
+	walMaxRecordSize = 1 << 26 // захист від сміттєвої довжини в пошкодженому заголовку
+
+	defaultBatchInterval = 100 * time.Millisecond
+)
+
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = iota // fsync після кожного запису
+	SyncBatch                    // fsync раз на BatchInterval або кожні BatchSize записів
+	SyncNever                    // fsync робить лише ОС
+)
+
+type WALOptions struct {
+	Sync          SyncPolicy
+	BatchInterval time.Duration // Для SyncBatch: як часто робити fsync, за замовчуванням 100ms
+	BatchSize     int           // Для SyncBatch: fsync після стількох записів, 0 - лише за таймером
+}
+
+type walOp string
+
+const (
+	walOpCreateCollection walOp = "create_collection"
+	walOpDeleteCollection walOp = "delete_collection"
+	walOpPut              walOp = "put"
+	walOpDelete           walOp = "delete"
+	walOpCreateIndex      walOp = "create_index"
+	walOpDeleteIndex      walOp = "delete_index"
+	walOpTx               walOp = "tx" // зміни транзакції: або всі, або жодної
+)
+
+type walRecord struct {
+	Op         walOp             `json:"op"`
+	Collection string            `json:"collection"`
+	Key        string            `json:"key,omitempty"`
+	Document   *Document         `json:"document,omitempty"`
+	Config     *CollectionConfig `json:"config,omitempty"`
+	Index      *IndexDefinition  `json:"index,omitempty"`
+	Field      string            `json:"field,omitempty"`
+	Batch      []walRecord       `json:"batch,omitempty"`    // для walOpTx
+	Revision   uint64            `json:"revision,omitempty"` // для walOpCreateCollection: ревізія документів, які вже були в рушії
+}
+
+// walFile - файл журналу; тести підміняють його, щоб зламати запис чи fsync
+type walFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Seek(offset int64, whence int) (int64, error)
+	Close() error
+}
+
+type wal struct {
+	mu      sync.Mutex
+	file    walFile
+	opts    WALOptions
+	offset  int64 // кінець останнього цілого запису
+	pending int   // кількість записів після останнього fsync
+	done    chan struct{}
+	wg      sync.WaitGroup
+	// failed - чому журнал більше не приймає записів: невдалий fsync чи запис, який не вдалося
+	// прибрати з файлу. Після перезапуску стор відновиться з того, що є у файлі.
+	failed error
+}
+
+// openWAL відкриває журнал, читає всі цілі записи та обрізає пошкоджений хвіст
+func openWAL(path string, opts WALOptions) (*wal, []walRecord, error) {
+	file, er := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if er != nil {
+		return nil, nil, er
+	}
+	records, offset, er := readWAL(file)
+	if er != nil {
+		if !errors.Is(er, err.ErrWALCorrupted) {
+			file.Close()
+			return nil, nil, er
+		}
+		slog.Warn("truncating corrupted wal tail", slog.Int64("offset", offset), slog.String("reason", er.Error()))
+		if er := file.Truncate(offset); er != nil {
+			file.Close()
+			return nil, nil, er
+		}
+		if er := file.Sync(); er != nil {
+			file.Close()
+			return nil, nil, er
+		}
+	}
+	if _, er := file.Seek(offset, io.SeekStart); er != nil {
+		file.Close()
+		return nil, nil, er
+	}
+
+	if opts.Sync == SyncBatch && opts.BatchInterval <= 0 {
+		opts.BatchInterval = defaultBatchInterval
+	}
+	w := &wal{
+		file:   file,
+		opts:   opts,
+		offset: offset,
+		done:   make(chan struct{}),
+	}
+	if opts.Sync == SyncBatch {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, records, nil
+}
+
+// readWAL повертає записи до першого обрізаного чи пошкодженого та зміщення кінця останнього цілого запису
+func readWAL(r io.Reader) ([]walRecord, int64, error) {
+	reader := bufio.NewReader(r)
+	var records []walRecord
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, er := io.ReadFull(reader, header); er != nil {
+			if er == io.EOF {
+				return records, offset, nil
+			}
+			if er == io.ErrUnexpectedEOF {
+				return records, offset, fmt.Errorf("%w: truncated record header at offset %d", err.ErrWALCorrupted, offset)
+			}
+			return records, offset, er
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if size > walMaxRecordSize {
+			return records, offset, fmt.Errorf("%w: invalid record size %d at offset %d", err.ErrWALCorrupted, size, offset)
+		}
+		payload := make([]byte, size)
+		if _, er := io.ReadFull(reader, payload); er != nil {
+			if er == io.EOF || er == io.ErrUnexpectedEOF {
+				return records, offset, fmt.Errorf("%w: truncated record at offset %d", err.ErrWALCorrupted, offset)
+			}
+			return records, offset, er
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return records, offset, fmt.Errorf("%w: checksum mismatch at offset %d", err.ErrWALCorrupted, offset)
+		}
+		var rec walRecord
+		if er := json.Unmarshal(payload, &rec); er != nil {
+			return records, offset, fmt.Errorf("%w: invalid record at offset %d: %v", err.ErrWALCorrupted, offset, er)
+		}
+		records = append(records, rec)
+		offset += int64(walHeaderSize) + int64(size)
+	}
+}
+
+func (w *wal) append(rec walRecord) error {
+	payload, er := json.Marshal(rec)
+	if er != nil {
+		return er
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return err.ErrWALClosed
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+	if _, er := w.file.Write(buf); er != nil {
+		// Частину запису вже могло бути записано; наступні записи після неї відновлення не прочитало б
+		return w.discard(er)
+	}
+	w.pending++
+	switch w.opts.Sync {
+	case SyncAlways:
+		er = w.syncLocked()
+	case SyncBatch:
+		if w.opts.BatchSize > 0 && w.pending >= w.opts.BatchSize {
+			er = w.syncLocked()
+		}
+	}
+	if er != nil {
+		// Викликач отримає помилку, тож запис не повинен застосуватися і після перезапуску
+		w.discard(er)
+		return w.failed
+	}
+	w.offset += int64(len(buf))
+	return nil
+}
+
+// discard прибирає з файлу запис, який не вдалося записати; якщо й це не вдалося, журнал ламається
+func (w *wal) discard(cause error) error {
+	if er := w.file.Truncate(w.offset); er != nil {
+		w.fail(fmt.Errorf("%v; truncate: %v", cause, er))
+		return w.failed
+	}
+	if _, er := w.file.Seek(w.offset, io.SeekStart); er != nil {
+		w.fail(fmt.Errorf("%v; seek: %v", cause, er))
+		return w.failed
+	}
+	return cause
+}
+
+// fail ламає журнал: після невдалого fsync невідомо, що з уже записаного дійшло до диску,
+// тож подальші записи відхиляються до перезапуску стору
+func (w *wal) fail(cause error) {
+	if w.failed == nil {
+		w.failed = fmt.Errorf("%w: %v", err.ErrWALFailed, cause)
+		slog.Error("wal failed", slog.String("error", cause.Error()))
+	}
+}
+
+// abandon ламає журнал, коли зміну вже записано в журнал, але не вдалося застосувати до рушія.
+// Відновлення після перезапуску її застосує, тож до того стор не приймає змін, які могли б
+// їй суперечити, і викликач дізнається, що зміна не пропала.
+func (w *wal) abandon(cause error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.fail(fmt.Errorf("logged change not applied: %v", cause))
+	return fmt.Errorf("%w: change is logged and will be applied when the store is reopened: %w", err.ErrWALFailed, cause)
+}
+
+// broken повертає причину, з якої журнал зламано, або nil
+func (w *wal) broken() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.failed
+}
+
+func (w *wal) syncLocked() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if er := w.file.Sync(); er != nil {
+		w.fail(fmt.Errorf("sync: %v", er))
+		return er
+	}
+	w.pending = 0
+	return nil
+}
+
+func (w *wal) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.file != nil && w.failed == nil {
+				w.syncLocked()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// reset очищує журнал після того, як його вміст потрапив у снапшот
+func (w *wal) reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return err.ErrWALClosed
+	}
+	if er := w.file.Truncate(0); er != nil {
+		return er
+	}
+	if _, er := w.file.Seek(0, io.SeekStart); er != nil {
+		return er
+	}
+	w.offset, w.pending = 0, 0
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.done)
+	er := w.file.Sync()
+	if cer := w.file.Close(); er == nil {
+		er = cer
+	}
+	w.file = nil
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return er
+}
+
+// NewStoreWithWAL відновлює стор з каталогу dir: читає снапшот і програє журнал поверх нього.
+// Усі подальші зміни стору записуються в журнал до того, як стануть видимими.
+func NewStoreWithWAL(dir string, opts WALOptions) (*Store, error) {
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return nil, er
+	}
+	s := NewStore()
+	snapshot, er := os.Open(filepath.Join(dir, snapshotFileName))
+	switch {
+	case er == nil:
+		s, er = loadFrom(context.Background(), snapshot, StreamOptions{}, true)
+		snapshot.Close()
+		if er != nil {
+			return nil, fmt.Errorf("read snapshot: %w", er)
+		}
+	case !errors.Is(er, os.ErrNotExist):
+		return nil, er
+	}
+
+	w, records, er := openWAL(filepath.Join(dir, walFileName), opts)
+	if er != nil {
+		return nil, er
+	}
+	for i, rec := range records {
+		if er := s.replay(rec); er != nil {
+			w.close()
+			return nil, fmt.Errorf("%w: record %d: %v", err.ErrWALCorrupted, i, er)
+		}
+	}
+
+	s.dir = dir
+	s.wal = w
+	for name, coll := range s.collections {
+		coll.wal = w
+		// Документи, які рушій мав ще до створення колекції, журнал у чергу не поставив
+		if coll.config.Engine.persistent() {
+			if er := coll.syncCapped(); er != nil {
+				s.Close()
+				return nil, fmt.Errorf("collection %s: %w", name, er)
+			}
+		}
+		// Індекси снапшоту та журналу будуються одним обходом рушія за остаточним вмістом колекції
+		if er := coll.buildPending(); er != nil {
+			s.Close()
+			return nil, fmt.Errorf("collection %s: %w", name, er)
+		}
+	}
+	slog.Info("store recovered from wal", slog.String("dir", dir), slog.Int("records", len(records)))
+	return s, nil
+}
+
+// replay застосовує запис журналу до стору, не записуючи його повторно
+func (s *Store) replay(rec walRecord) error {
+	switch rec.Op {
+	case walOpCreateCollection:
+		if _, exists := s.collections[rec.Collection]; exists {
+			return err.ErrCollectionAlreadyExists
+		}
+		var cfg CollectionConfig
+		if rec.Config != nil {
+			cfg = *rec.Config
+		}
+		coll, er := openCollection(rec.Collection, cfg)
+		if er != nil {
+			return er
+		}
+		coll.revision = rec.Revision
+		coll.store = s
+		s.collections[rec.Collection] = coll
+		return nil
+	case walOpDeleteCollection:
+		coll, exists := s.collections[rec.Collection]
+		if !exists {
+			return err.ErrCollectionNotFound
+		}
+		// Журнал повторює зміни поверх того, що рушій зберіг сам, тож дані видаленої колекції
+		// видаляються і тут; наступні записи журналу відновлять те, що потрібно
+		coll.drop()
+		delete(s.collections, rec.Collection)
+		return nil
+	case walOpTx:
+		// Транзакція потрапляє в журнал одним записом, тож обрізаний хвіст не залишить її половину
+		for _, sub := range rec.Batch {
+			if er := s.replay(sub); er != nil {
+				return er
+			}
+		}
+		return nil
+	}
+
+	coll, ok := s.collections[rec.Collection]
+	if !ok {
+		return err.ErrCollectionNotFound
+	}
+	switch rec.Op {
+	case walOpPut:
+		if rec.Document == nil {
+			return errors.New("put record without document")
+		}
+		// Журнал пишеться перед рушієм, тож дисковий рушій уже має цей запис або новіший,
+		// якщо стор не впав між ними; такий документ лише займає свою ревізію та місце в черзі
+		current, exists, er := coll.storage().Get(rec.Key)
+		if er != nil {
+			return er
+		}
+		if exists && rec.Document.Revision > 0 && current.Revision >= rec.Document.Revision {
+			coll.revision = max(coll.revision, rec.Document.Revision)
+			coll.track(rec.Key, current)
+			return nil
+		}
+		return coll.put(rec.Key, *rec.Document)
+	case walOpDelete:
+		// Журнал пише лише видалення наявних документів, і кожне займає ревізію. Дисковий рушій
+		// міг уже видалити документ сам, тоді ревізія займається тут.
+		deleted, er := coll.delete(rec.Key)
+		if er == nil && !deleted {
+			coll.revision++
+		}
+		return er
+	case walOpCreateIndex:
+		if rec.Index == nil {
+			return errors.New("create_index record without definition")
+		}
+		return coll.deferIndex(*rec.Index)
+	case walOpDeleteIndex:
+		if coll.undeferIndex(rec.Field) {
+			return nil
+		}
+		return coll.deleteIndex(rec.Field)
+	}
+	return fmt.Errorf("unknown operation %q", rec.Op)
+}
+
+// checkpointSources - колекції для снапшоту Checkpoint за абеткою; викликач тримає блокування всіх колекцій
+func (s *Store) checkpointSources() []dumpSource {
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]dumpSource, 0, len(names))
+	for _, name := range names {
+		coll := s.collections[name]
+		src := dumpSource{
+			name: name,
+			meta: DTOCollection{Config: coll.config, Indexes: coll.indexDefinitions(), Revision: coll.revision, Order: coll.insertionOrder()},
+		}
+		if coll.config.Engine.persistent() {
+			src.meta.Stored, src.meta.Expiry = true, coll.expiry
+		} else {
+			src.scan = func(fn func(key string, doc Document) bool) error {
+				return coll.storage().Scan("", fn)
+			}
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// Checkpoint записує снапшот поточного стану та очищує журнал.
+// На час запису всі колекції заблоковані, тому снапшот і журнал завжди узгоджені.
+func (s *Store) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return err.ErrWALDisabled
+	}
+	// Зламаний журнал може тримати зміни, яких немає в колекціях; снапшот їх би загубив
+	if er := s.wal.broken(); er != nil {
+		return er
+	}
+	for _, coll := range s.collections {
+		coll.mu.Lock()
+		defer coll.mu.Unlock()
+	}
+
+	// Дискові рушії зберігають документи самі, тож у снапшот потрапляють лише їхні метадані,
+	// а записи рушіїв скидаються на диск до того, як журнал буде очищено
+	for name, coll := range s.collections {
+		if coll.engine != nil && coll.config.Engine.persistent() {
+			if er := coll.engine.Sync(); er != nil {
+				return fmt.Errorf("collection %s: %w", name, er)
+			}
+		}
+	}
+	er := writeFileAtomicFrom(filepath.Join(s.dir, snapshotFileName), func(w io.Writer) error {
+		return writeDump(context.Background(), w, s.checkpointSources(), StreamOptions{})
+	})
+	if er != nil {
+		return er
+	}
+	if er := s.wal.reset(); er != nil {
+		return er
+	}
+	slog.Info("checkpoint done", slog.String("dir", s.dir))
+	return nil
+}
+
+// Close зупиняє sweeper, скидає журнал на диск і закриває його разом з рушіями колекцій;
+// стор без журналу, без sweeper і з колекціями лише в пам'яті закривати не потрібно
+func (s *Store) Close() error {
+	s.mu.Lock()
+	sw := s.sweeper
+	s.sweeper = nil
+	s.mu.Unlock()
+	// sweeper бере блокування стору, тож чекати на нього під блокуванням не можна
+	sw.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for name, coll := range s.collections {
+		coll.mu.Lock()
+		if coll.engine != nil {
+			if er := coll.engine.Close(); er != nil {
+				errs = append(errs, fmt.Errorf("collection %s: %w", name, er))
+			}
+		}
+		coll.mu.Unlock()
+	}
+	if s.wal != nil {
+		errs = append(errs, s.wal.close())
+	}
+	return errors.Join(errs...)
+}
+
+// writeFileAtomic пише файл через тимчасовий файл і rename, щоб не залишити напівзаписаний снапшот
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicFrom(path, func(w io.Writer) error {
+		_, er := w.Write(data)
+		return er
+	})
+}
+
+// writeFileAtomicFrom робить те саме, що writeFileAtomic, для даних, які write пише потоком
+func writeFileAtomicFrom(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	file, er := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if er != nil {
+		return er
+	}
+	if er := write(file); er != nil {
+		file.Close()
+		return er
+	}
+	if er := file.Sync(); er != nil {
+		file.Close()
+		return er
+	}
+	if er := file.Close(); er != nil {
+		return er
+	}
+	if er := os.Rename(tmp, path); er != nil {
+		return er
+	}
+	dir, er := os.Open(filepath.Dir(path))
+	if er != nil {
+		return er
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
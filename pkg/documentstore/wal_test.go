@@ -0,0 +1,436 @@
+package documentstore
+
+import (
+	"errors"
+	"lesson4/pkg/err"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func walTestDocument(id, name string) Document {
+	return Document{Fields: map[string]DocumentField{
+		"id":   {Type: DocumentFieldTypeString, Value: id},
+		"name": {Type: DocumentFieldTypeString, Value: name},
+	}}
+}
+
+func walTestIDs(t *testing.T, s *Store, collection string) []string {
+	t.Helper()
+	coll, er := s.GetCollection(collection)
+	if er != nil {
+		t.Fatal(er)
+	}
+	ids := []string{}
+	for _, doc := range coll.List() {
+		ids = append(ids, doc.Fields["id"].Value.(string))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestNewStoreWithWAL_Recovery(t *testing.T) {
+	tests := []struct {
+		name string
+		opts WALOptions
+	}{
+		{name: "sync always", opts: WALOptions{Sync: SyncAlways}},
+		{name: "sync batch", opts: WALOptions{Sync: SyncBatch, BatchInterval: time.Millisecond, BatchSize: 2}},
+		{name: "sync never", opts: WALOptions{Sync: SyncNever}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, er := NewStoreWithWAL(dir, tt.opts)
+			if er != nil {
+				t.Fatal(er)
+			}
+			_, users := s.CreateCollection("users", "id")
+			users.Put(walTestDocument("u1", "Andrii"))
+			users.Put(walTestDocument("u2", "Taras"))
+			users.Put(walTestDocument("u3", "Roman"))
+			if er := users.CreateIndex("name"); er != nil {
+				t.Fatal(er)
+			}
+			users.Put(walTestDocument("u2", "Stepan"))
+			users.Delete("u1")
+			s.CreateCollection("tmp", "id")
+			s.DeleteCollection("tmp")
+			before, _ := users.Get("u2")
+			if er := s.Close(); er != nil {
+				t.Fatal(er)
+			}
+
+			restored, er := NewStoreWithWAL(dir, tt.opts)
+			if er != nil {
+				t.Fatal(er)
+			}
+			defer restored.Close()
+
+			if got, want := walTestIDs(t, restored, "users"), []string{"u2", "u3"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("restored ids = %v, want %v", got, want)
+			}
+			if _, er := restored.GetCollection("tmp"); er == nil {
+				t.Errorf("deleted collection was restored")
+			}
+			coll, _ := restored.GetCollection("users")
+			docs, er := coll.Query("name", QueryParams{MinValue: "S"})
+			if er != nil {
+				t.Fatal(er)
+			}
+			if len(docs) != 1 || docs[0].Fields["name"].Value != "Stepan" {
+				t.Errorf("Query() after recovery = %v", docs)
+			}
+			if after, _ := coll.Get("u2"); after.Revision != before.Revision {
+				t.Errorf("revision after recovery = %d, want %d", after.Revision, before.Revision)
+			}
+		})
+	}
+}
+
+func TestStore_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, users := s.CreateCollection("users", "id")
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.CreateIndex("name")
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	info, er := os.Stat(filepath.Join(dir, walFileName))
+	if er != nil {
+		t.Fatal(er)
+	}
+	if info.Size() != 0 {
+		t.Errorf("wal size after checkpoint = %d, want 0", info.Size())
+	}
+	users.Put(walTestDocument("u2", "Taras"))
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	if got, want := walTestIDs(t, restored, "users"), []string{"u1", "u2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored ids = %v, want %v", got, want)
+	}
+	coll, _ := restored.GetCollection("users")
+	if docs, er := coll.Query("name", QueryParams{}); er != nil || len(docs) != 2 {
+		t.Errorf("Query() after checkpoint = %v, %v", docs, er)
+	}
+}
+
+func TestStore_CheckpointDiskEngine(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	cfg := CollectionConfig{PrimaryKey: "id", Capped: &CappedOptions{MaxDocuments: 3},
+		Engine: EngineOptions{Type: EngineBTree, Path: filepath.Join(dir, "events.btree")}}
+	_, events := s.CreateCollectionWithConfig("events", cfg)
+	for _, id := range []string{"c", "a", "d", "b"} {
+		events.Put(walTestDocument(id, "event-"+id))
+	}
+	events.CreateIndex("name")
+	_, users := s.CreateCollection("users", "id")
+	users.Put(walTestDocument("u1", "Andrii"))
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	// Документи дискового рушія лишаються в ньому, у снапшоті лише документи колекції в пам'яті
+	snapshot, er := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if er != nil {
+		t.Fatal(er)
+	}
+	if dump := string(snapshot); strings.Contains(dump, "event-") || !strings.Contains(dump, `"stored":true`) || !strings.Contains(dump, "Andrii") {
+		t.Errorf("snapshot = %s", dump)
+	}
+	events.Put(walTestDocument("e", "event-e"))
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	events, _ = restored.GetCollection("events")
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"d", "b", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored insertion order = %v, want %v", got, want)
+	}
+	if docs, er := events.Find(Filter{"name": "event-b"}); er != nil || len(docs) != 1 {
+		t.Errorf("Find() by restored index = %v, %v", docs, er)
+	}
+	res, er := events.Insert(walTestDocument("f", "event-f"))
+	if er != nil || res.Revision != 8 {
+		t.Errorf("Insert() after recovery = %+v, %v, want revision 8", res, er)
+	}
+	if got, want := cappedTestOrder(t, events, false, 0), []string{"b", "e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("insertion order after insert = %v, want %v", got, want)
+	}
+	if got, want := walTestIDs(t, restored, "users"), []string{"u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored users = %v, want %v", got, want)
+	}
+}
+
+func TestNewStoreWithWAL_IndexesAfterLog(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	cfg := CollectionConfig{PrimaryKey: "id", Engine: EngineOptions{Type: EngineBTree, Path: filepath.Join(dir, "users.btree")}}
+	_, users := s.CreateCollectionWithConfig("users", cfg)
+	users.Put(walTestDocument("u1", "Andrii"))
+	users.CreateIndexWithOptions("name", IndexOptions{Unique: true})
+	if er := s.Checkpoint(); er != nil {
+		t.Fatal(er)
+	}
+	// Унікальний індекс снапшоту видалено в журналі, тож повторені імена після нього не конфліктують
+	users.DeleteIndex("name")
+	users.Put(walTestDocument("u2", "Andrii"))
+	users.CreateIndex("id")
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	users, _ = restored.GetCollection("users")
+	if defs := users.indexDefinitions(); len(defs) != 1 || indexName(defs[0].Fields) != "id" {
+		t.Errorf("restored indexes = %+v, want only id", defs)
+	}
+	if docs, er := users.Find(Filter{"id": "u2"}); er != nil || len(docs) != 1 {
+		t.Errorf("Find() by index from log = %v, %v", docs, er)
+	}
+}
+
+// walTestFile - файл журналу, запис чи fsync якого можна зламати
+type walTestFile struct {
+	*os.File
+	failWrite bool // записати половину запису і повернути помилку
+	failSync  bool
+}
+
+func (f *walTestFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("disk full")
+	}
+	return f.File.Write(p)
+}
+
+func (f *walTestFile) Sync() error {
+	if f.failSync {
+		return errors.New("io error")
+	}
+	return f.File.Sync()
+}
+
+func TestWAL_AppendFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, users := s.CreateCollection("users", "id")
+	users.Put(walTestDocument("u1", "Andrii"))
+	file := &walTestFile{File: s.wal.file.(*os.File)}
+	s.wal.file = file
+
+	// Обірваний запис прибирається з файлу, тож наступні записи відновлення прочитає
+	file.failWrite = true
+	if er := users.Put(walTestDocument("u2", "Taras")); er == nil {
+		t.Errorf("Put() with failed write succeeded")
+	}
+	file.failWrite = false
+	if er := users.Put(walTestDocument("u3", "Olena")); er != nil {
+		t.Errorf("Put() after failed write: %v", er)
+	}
+
+	// Після невдалого fsync запис не застосовується ні зараз, ні після перезапуску, а журнал більше не пише
+	file.failSync = true
+	if er := users.Put(walTestDocument("u4", "Roman")); !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("Put() with failed sync error = %v, want %v", er, err.ErrWALFailed)
+	}
+	file.failSync = false
+	if er := users.Put(walTestDocument("u5", "Ivan")); !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("Put() after failed sync error = %v, want %v", er, err.ErrWALFailed)
+	}
+	if got, want := walTestIDs(t, s, "users"), []string{"u1", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+	s.Close()
+
+	restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer restored.Close()
+	if got, want := walTestIDs(t, restored, "users"), []string{"u1", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored ids = %v, want %v", got, want)
+	}
+}
+
+// walTestEngine - рушій, запис у який можна зламати
+type walTestEngine struct {
+	StorageEngine
+	fail bool
+}
+
+func (e *walTestEngine) Put(key string, doc Document) error {
+	if e.fail {
+		return errors.New("engine is broken")
+	}
+	return e.StorageEngine.Put(key, doc)
+}
+
+func TestStore_EngineFailureAfterLog(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*Store, *walTestEngine) {
+		s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+		if er != nil {
+			t.Fatal(er)
+		}
+		if _, er := s.GetCollection("users"); er != nil {
+			s.CreateCollection("users", "id")
+		}
+		users, _ := s.GetCollection("users")
+		engine := &walTestEngine{StorageEngine: users.engine, fail: true}
+		users.engine = engine
+		return s, engine
+	}
+
+	// Зміна вже в журналі, тож викликач дізнається, що вона застосується після перезапуску,
+	// а до того стор не приймає змін і не робить снапшот без неї
+	s, _ := open()
+	users, _ := s.GetCollection("users")
+	if er := users.Put(walTestDocument("u1", "Andrii")); !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("Put() with broken engine error = %v, want %v", er, err.ErrWALFailed)
+	}
+	if _, er := users.Insert(walTestDocument("u2", "Taras")); !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("Insert() after broken engine error = %v, want %v", er, err.ErrWALFailed)
+	}
+	if er := s.Checkpoint(); !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("Checkpoint() after broken engine error = %v, want %v", er, err.ErrWALFailed)
+	}
+	s.Close()
+
+	s, _ = open()
+	if got, want := walTestIDs(t, s, "users"), []string{"u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ids after reopen = %v, want %v", got, want)
+	}
+	er := s.RunInTx(func(tx *Tx) error { return tx.Put("users", walTestDocument("u3", "Olena")) })
+	if !errors.Is(er, err.ErrWALFailed) {
+		t.Errorf("RunInTx() with broken engine error = %v, want %v", er, err.ErrWALFailed)
+	}
+	s.Close()
+
+	s, engine := open()
+	defer s.Close()
+	engine.fail = false
+	if got, want := walTestIDs(t, s, "users"), []string{"u1", "u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ids after second reopen = %v, want %v", got, want)
+	}
+}
+
+func TestNewStoreWithWAL_CorruptedTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, path string, lastRecord int64)
+	}{
+		{
+			name: "truncated record",
+			corrupt: func(t *testing.T, path string, lastRecord int64) {
+				info, _ := os.Stat(path)
+				if er := os.Truncate(path, info.Size()-3); er != nil {
+					t.Fatal(er)
+				}
+			},
+		},
+		{
+			name: "truncated header",
+			corrupt: func(t *testing.T, path string, lastRecord int64) {
+				if er := os.Truncate(path, lastRecord+4); er != nil {
+					t.Fatal(er)
+				}
+			},
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, path string, lastRecord int64) {
+				f, er := os.OpenFile(path, os.O_RDWR, 0644)
+				if er != nil {
+					t.Fatal(er)
+				}
+				defer f.Close()
+				if _, er := f.WriteAt([]byte("X"), lastRecord+walHeaderSize+2); er != nil {
+					t.Fatal(er)
+				}
+			},
+		},
+		{
+			name: "garbage appended",
+			corrupt: func(t *testing.T, path string, lastRecord int64) {
+				f, er := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+				if er != nil {
+					t.Fatal(er)
+				}
+				defer f.Close()
+				f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x01})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, walFileName)
+			s, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+			if er != nil {
+				t.Fatal(er)
+			}
+			_, users := s.CreateCollection("users", "id")
+			users.Put(walTestDocument("u1", "Andrii"))
+			info, _ := os.Stat(path)
+			lastRecord := info.Size()
+			users.Put(walTestDocument("u2", "Taras"))
+			s.Close()
+
+			tt.corrupt(t, path, lastRecord)
+
+			restored, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+			if er != nil {
+				t.Fatal(er)
+			}
+			want := []string{"u1", "u2"}
+			if tt.name != "garbage appended" {
+				want = []string{"u1"}
+			}
+			if got := walTestIDs(t, restored, "users"); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored ids = %v, want %v", got, want)
+			}
+
+			// Після обрізання хвоста журнал знову придатний для запису
+			coll, _ := restored.GetCollection("users")
+			coll.Put(walTestDocument("u3", "Roman"))
+			restored.Close()
+			again, er := NewStoreWithWAL(dir, WALOptions{Sync: SyncAlways})
+			if er != nil {
+				t.Fatal(er)
+			}
+			defer again.Close()
+			if got, want := walTestIDs(t, again, "users"), append(want, "u3"); !reflect.DeepEqual(got, want) {
+				t.Errorf("ids after second recovery = %v, want %v", got, want)
+			}
+		})
+	}
+}
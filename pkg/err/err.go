@@ -1,6 +1,9 @@
 package err
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrDocumentNotFound = errors.New("document not found")
 var ErrCollectionAlreadyExists = errors.New("collection already exists")
@@ -10,3 +13,72 @@ var ErrCreatedUser = errors.New("error creating user")
 var ErrListEmpty = errors.New("the list is empty")
 var ErrNotFound = errors.New("not found")
 var ErrAddUser = errors.New("error adding user")
+var ErrWALCorrupted = errors.New("write-ahead log is corrupted")
+var ErrWALClosed = errors.New("write-ahead log is closed")
+var ErrWALDisabled = errors.New("store has no write-ahead log")
+var ErrWALFailed = errors.New("write-ahead log has failed")
+var ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+var ErrIndexTypeMismatch = errors.New("value type does not match index type")
+var ErrUnsupportedIndexType = errors.New("unsupported index type")
+var ErrDuplicateKey = errors.New("duplicate key")
+var ErrInvalidFilter = errors.New("invalid filter")
+var ErrInvalidCursor = errors.New("invalid cursor")
+var ErrInvalidProjection = errors.New("invalid projection")
+var ErrInvalidPipeline = errors.New("invalid aggregation pipeline")
+var ErrInvalidUpdate = errors.New("invalid update")
+var ErrRevisionConflict = errors.New("revision conflict")
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+var ErrTxConflict = errors.New("transaction conflict")
+var ErrSnapshotReleased = errors.New("snapshot has been released")
+var ErrInvalidCollectionConfig = errors.New("invalid collection config")
+var ErrNotCapped = errors.New("collection is not capped")
+var ErrDocumentTooLarge = errors.New("document is too large")
+var ErrStorageCorrupted = errors.New("storage engine data is corrupted")
+var ErrDumpCorrupted = errors.New("dump is corrupted")
+var ErrKeyTooLong = errors.New("document key is too long")
+var ErrEnginePathInUse = errors.New("storage engine path is already open")
+
+// DuplicateKeyError повертається, коли значення вже зайняте іншим документом в унікальному індексі
+// або коли Insert отримує документ з уже наявним первинним ключем
+type DuplicateKeyError struct {
+	Index      string // ім'я унікального індексу або поле первинного ключа
+	Value      any    // значення, що повторюється
+	DocumentID string // документ, якому вже належить це значення
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key %v in unique index %s: already used by document %s", e.Value, e.Index, e.DocumentID)
+}
+
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// RevisionConflictError повертається умовним записом, коли ревізія документа не збігається з очікуваною
+type RevisionConflictError struct {
+	Key      string // первинний ключ документа
+	Expected uint64 // ревізія, яку передав викликач
+	Actual   uint64 // поточна ревізія; 0, якщо документа немає
+}
+
+func (e *RevisionConflictError) Error() string {
+	return fmt.Sprintf("revision conflict for document %s: expected %d, actual %d", e.Key, e.Expected, e.Actual)
+}
+
+func (e *RevisionConflictError) Is(target error) bool {
+	return target == ErrRevisionConflict
+}
+
+// DumpCorruptedError повертається, коли бінарний дамп пошкоджений або обрізаний
+type DumpCorruptedError struct {
+	Offset int64  // зсув у дампі, з якого починається пошкоджений блок
+	Reason string // що саме не так
+}
+
+func (e *DumpCorruptedError) Error() string {
+	return fmt.Sprintf("dump is corrupted at offset %d: %s", e.Offset, e.Reason)
+}
+
+func (e *DumpCorruptedError) Is(target error) bool {
+	return target == ErrDumpCorrupted
+}
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"lesson4/pkg/documentstore"
 	"lesson4/pkg/err"
 	"log/slog"
@@ -29,10 +30,10 @@ func NewService(s *documentstore.Store) Service {
 }
 
 func (s *Service) CreateUser(id, name string, doc *documentstore.Document) (*User, error) {
-	if _, er := s.coll.Get(id); er == nil {
-		return nil, err.ErrCreatedUser
-	}
-	if er := s.coll.Put(*doc); er != nil {
+	if _, er := s.coll.Insert(*doc); er != nil {
+		if errors.Is(er, err.ErrDuplicateKey) {
+			return nil, err.ErrCreatedUser
+		}
 		slog.Error(err.ErrAddUser.Error())
 		return nil, err.ErrAddUser
 	}
@@ -190,8 +190,8 @@ func TestService_ListUsers(t *testing.T) {
 			},
 			want: []User{
 				{ID: "u1", Name: "Andrii"},
-				{ID: "u4", Name: "Taras"},
 				{ID: "u3", Name: "Roman"},
+				{ID: "u4", Name: "Taras"},
 			},
 			wantErr: false,
 		},